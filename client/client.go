@@ -0,0 +1,235 @@
+package client
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"goPBFT/consensus"
+	"goPBFT/linearizability"
+	"goPBFT/network"
+	"sort"
+	"sync"
+	"time"
+)
+
+// RetransmitTimeout 是客户端等待回复的时间，超时后请求会被广播给所有节点
+const RetransmitTimeout = time.Second * 5
+
+// Client 向集群提交请求，并通过自己的 Transport 接收节点的回复
+type Client struct {
+	ClientID   string
+	PrivateKey ed25519.PrivateKey
+	NodeTable  map[string]string
+	// 用于检查回复的签名
+	Keys *consensus.KeyRegistry
+	// 接收回复的地址
+	Addr string
+	// 不为 nil 时记录每个操作的提交和完成，用于检查线性一致性
+	History *linearizability.Recorder
+
+	// 每个客户端同时只有一个请求。节点对每个客户端只记录最后执行的时间戳，并发提交时先执行的较新请求
+	// 会让较早的请求被当作已经执行过而不再回复
+	outstanding   chan struct{}
+	mu            sync.Mutex
+	view          int64
+	lastTimestamp int64
+	calls         map[int64]*call
+	transport     network.Transport
+	done          chan struct{}
+	closeOnce     sync.Once
+}
+
+// call 是一个正在等待回复的请求，Results 以结果为 key 记录回复了该结果的节点以及回复中的视图
+type call struct {
+	Results map[string]map[string]int64
+	Done    chan string
+}
+
+// NewClient 通过 transport 发送请求并接收回复，transport 必须和集群中的节点使用相同的传输方式
+func NewClient(clientID string, transport network.Transport, nodeTable map[string]string, keys *consensus.KeyRegistry, privateKey ed25519.PrivateKey) *Client {
+	client := &Client{
+		ClientID:    clientID,
+		PrivateKey:  privateKey,
+		NodeTable:   nodeTable,
+		Keys:        keys,
+		Addr:        transport.Addr(),
+		calls:       make(map[int64]*call),
+		outstanding: make(chan struct{}, 1),
+		transport:   transport,
+		done:        make(chan struct{}),
+	}
+	go client.receive()
+
+	return client
+}
+
+// Submit 提交一个操作并等待 f+1 个节点回复相同的结果。
+// 请求先发送给客户端所知道的主节点，每次超时后广播给所有节点，直到收到结果或者 ctx 结束。
+// 同一个客户端上并发的 Submit 依次执行，后面的调用等待前面的请求完成。
+func (client *Client) Submit(ctx context.Context, operation string) (string, error) {
+	select {
+	case client.outstanding <- struct{}{}:
+		defer func() { <-client.outstanding }()
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+
+	reqMsg, pending, err := client.newRequest(operation)
+	if err != nil {
+		return "", err
+	}
+	defer client.finish(reqMsg.Timestamp)
+
+	jsonMsg, err := json.Marshal(reqMsg)
+	if err != nil {
+		return "", err
+	}
+	msg := &network.Message{Path: "/req", Payload: jsonMsg}
+	var historyID int64
+	if client.History != nil {
+		historyID = client.History.Invoke(client.ClientID, operation)
+	}
+	client.transport.Send(client.NodeTable[client.primary()], msg)
+
+	timer := time.NewTimer(RetransmitTimeout)
+	defer timer.Stop()
+	for {
+		select {
+		case result := <-pending.Done:
+			// 超时或者取消的操作没有完成事件，检查时认为它可能已经生效
+			if client.History != nil {
+				client.History.Complete(historyID, client.ClientID, result)
+			}
+			return result, nil
+		case <-timer.C:
+			// 主节点可能已经失效，将请求广播给所有节点，备份节点会将其转发给主节点并开启计时器
+			addrs := make([]string, 0, len(client.NodeTable))
+			for _, addr := range client.NodeTable {
+				addrs = append(addrs, addr)
+			}
+			client.transport.Broadcast(addrs, msg)
+			timer.Reset(RetransmitTimeout)
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+}
+
+// Close 停止接收回复，并关闭 transport
+func (client *Client) Close() error {
+	client.closeOnce.Do(func() {
+		close(client.done)
+	})
+	return client.transport.Close()
+}
+
+// newRequest 创建并签名一个新的请求，时间戳严格递增，以保证每个请求只被执行一次
+func (client *Client) newRequest(operation string) (*consensus.RequestMsg, *call, error) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	timestamp := time.Now().UnixNano()
+	if timestamp <= client.lastTimestamp {
+		timestamp = client.lastTimestamp + 1
+	}
+	client.lastTimestamp = timestamp
+
+	reqMsg := &consensus.RequestMsg{
+		Timestamp: timestamp,
+		ClinetID:  client.ClientID,
+		Operation: operation,
+		ReplyAddr: client.Addr,
+	}
+	if err := consensus.Sign(client.PrivateKey, reqMsg); err != nil {
+		return nil, nil, err
+	}
+
+	pending := &call{
+		Results: make(map[string]map[string]int64),
+		Done:    make(chan string, 1),
+	}
+	client.calls[timestamp] = pending
+	return reqMsg, pending, nil
+}
+
+func (client *Client) finish(timestamp int64) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	delete(client.calls, timestamp)
+}
+
+// receive 处理收到的回复，直到客户端被关闭
+func (client *Client) receive() {
+	for {
+		select {
+		case msg := <-client.transport.Receive():
+			if msg.Path != "/reply" {
+				continue
+			}
+			var replyMsg consensus.ReplyMsg
+			if err := json.Unmarshal(msg.Payload, &replyMsg); err != nil {
+				continue
+			}
+			if err := network.CheckPeer(msg.Peer, &replyMsg); err != nil {
+				continue
+			}
+			client.resolveReply(&replyMsg)
+		case <-client.done:
+			return
+		}
+	}
+}
+
+// resolveReply 记录一个回复，f+1 个节点回复相同的结果时其中至少有一个正常节点，该结果就是正确的
+func (client *Client) resolveReply(msg *consensus.ReplyMsg) error {
+	if msg.ClientID != client.ClientID {
+		return errors.New("the reply is not for this client")
+	}
+	if err := client.Keys.Verify(msg.NodeID, msg); err != nil {
+		return err
+	}
+
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	pending, ok := client.calls[msg.Timestamp]
+	if !ok {
+		return nil
+	}
+	if pending.Results[msg.Result] == nil {
+		pending.Results[msg.Result] = make(map[string]int64)
+	}
+	pending.Results[msg.Result][msg.NodeID] = msg.ViewID
+
+	replies := pending.Results[msg.Result]
+	if len(replies) != consensus.NewQuorum(len(client.NodeTable)).Reply() {
+		return nil
+	}
+	// 通过回复中的视图得知当前的主节点。只采用 f+1 个回复中最小的视图，其中至少有一个正常节点已经进入该视图，
+	// 单个错误节点回复的视图不能把客户端引向不存在或者错误的主节点
+	view := msg.ViewID
+	for _, viewID := range replies {
+		if viewID < view {
+			view = viewID
+		}
+	}
+	if view > client.view {
+		client.view = view
+	}
+	pending.Done <- msg.Result
+	return nil
+}
+
+// primary 根据 p = v mod |R| 计算客户端所知道的视图的主节点
+func (client *Client) primary() string {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	ids := make([]string, 0, len(client.NodeTable))
+	for nodeID := range client.NodeTable {
+		ids = append(ids, nodeID)
+	}
+	sort.Strings(ids)
+	return ids[client.view%int64(len(ids))]
+}
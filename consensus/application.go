@@ -0,0 +1,15 @@
+package consensus
+
+// Application 是被复制的状态机，节点在请求提交之后严格按照序列号的顺序调用 Execute。
+// 所有节点必须得到相同的结果和状态摘要，因此实现中不能依赖时间、随机数等不确定的输入。
+type Application interface {
+	// Execute 执行已经提交的请求，返回值会放入 ReplyMsg.Result 中
+	Execute(request *RequestMsg) string
+	// Query 执行不修改状态的只读操作，不经过共识
+	Query(operation string) (string, error)
+	// Snapshot 和 Restore 用于保存和恢复检查点处的状态
+	Snapshot() ([]byte, error)
+	Restore(snapshot []byte) error
+	// StateDigest 返回当前状态的摘要，用于比较各节点的状态机。检查点的摘要由分块的快照计算。
+	StateDigest() string
+}
@@ -0,0 +1,56 @@
+package consensus
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+)
+
+// 集群的认证方式，同一个集群中的所有节点必须相同
+const (
+	// SignatureMode 中所有消息都使用 Ed25519 签名
+	SignatureMode = "signature"
+	// MACMode 中 VoteMsg 使用认证码向量，其余消息仍然使用签名
+	MACMode = "mac"
+)
+
+// AddAuthenticators 为投票消息的每一个接收者（包括自己）计算 HMAC-SHA256 认证码
+func (keys *KeyRegistry) AddAuthenticators(msg *VoteMsg) error {
+	payload, err := msg.signingPayload()
+	if err != nil {
+		return err
+	}
+
+	msg.Authenticators = make(map[string][]byte)
+	for nodeID, sessionKey := range keys.SessionKeys {
+		msg.Authenticators[nodeID] = authenticator(sessionKey, payload)
+	}
+	return nil
+}
+
+// Authenticate 检查消息是否由 nodeID 发出，MACMode 中的投票消息检查发给本节点的认证码，其余消息检查签名
+func (keys *KeyRegistry) Authenticate(nodeID string, msg SignedMsg) error {
+	voteMsg, ok := msg.(*VoteMsg)
+	if keys.Mode != MACMode || !ok {
+		return keys.Verify(nodeID, msg)
+	}
+
+	sessionKey, ok := keys.SessionKeys[nodeID]
+	if !ok {
+		return errors.New("the message is sent by an unknown node " + nodeID)
+	}
+	payload, err := voteMsg.signingPayload()
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(voteMsg.Authenticators[keys.NodeID], authenticator(sessionKey, payload)) {
+		return errors.New("the authenticator of the message from " + nodeID + " is invalid")
+	}
+	return nil
+}
+
+func authenticator(sessionKey []byte, payload []byte) []byte {
+	mac := hmac.New(sha256.New, sessionKey)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
@@ -0,0 +1,59 @@
+package consensus
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// 主节点将多个请求打包在同一个序列号中，满足任意一个条件时发送 pre-prepare 消息。
+// 以下为默认值，可以在节点的配置文件中修改
+const (
+	MaxBatchSize  = 64                    // 一个批次中最多的请求数量
+	MaxBatchBytes = 1 << 20               // 一个批次中请求编码后的最大字节数
+	BatchDelay    = time.Millisecond * 10 // 第一个请求进入批次后最多等待的时间
+)
+
+// BatchDigest 是批次中每个请求摘要的 Merkle 根，请求的顺序也是摘要的一部分
+func BatchDigest(requests []*RequestMsg) (string, error) {
+	leaves := make([]string, 0, len(requests))
+	for _, request := range requests {
+		requestDigest, err := digest(request)
+		if err != nil {
+			return "", err
+		}
+		leaves = append(leaves, requestDigest)
+	}
+	return MerkleRoot(leaves), nil
+}
+
+// RequestSize 返回请求编码后的字节数，用于限制批次的大小
+func RequestSize(request *RequestMsg) int {
+	jsonMsg, err := json.Marshal(request)
+	if err != nil {
+		return 0
+	}
+	return len(jsonMsg)
+}
+
+// IsNull 判断 pre-prepare 消息是否为视图切换时用来填补序列号的空批次
+func (msg *PrePrepareMsg) IsNull() bool {
+	return len(msg.RequestMsgs) == 0
+}
+
+// verifyBatch 检查批次的摘要，以及批次中每个请求的序列号和客户端签名
+func verifyBatch(prePrepareMsg *PrePrepareMsg, keys *KeyRegistry) bool {
+	if prePrepareMsg == nil {
+		return false
+	}
+	for _, request := range prePrepareMsg.RequestMsgs {
+		if request == nil || request.SequenceID != prePrepareMsg.SequenceID {
+			return false
+		}
+		if keys.VerifyRequest(request) != nil {
+			return false
+		}
+	}
+
+	digest, err := BatchDigest(prePrepareMsg.RequestMsgs)
+	return err == nil && digest == prePrepareMsg.Digest
+}
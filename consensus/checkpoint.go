@@ -0,0 +1,147 @@
+package consensus
+
+import (
+	"errors"
+	"sort"
+)
+
+// CheckpointPeriod 即论文中的 K，每提交 K 个请求生成一次检查点
+const CheckpointPeriod = 10
+
+// WaterMarkRange 即论文中的 L，序列号 n 需要满足 h < n <= h+L，h 为最新稳定检查点的序列号
+const WaterMarkRange = 2 * CheckpointPeriod
+
+// InWaterMarks 判断序列号是否处于高低水位之间
+func InWaterMarks(lowWaterMark int64, sequenceID int64) bool {
+	return sequenceID > lowWaterMark && sequenceID <= lowWaterMark+WaterMarkRange
+}
+
+// StableCheckpoint 是由 2f+1 个摘要相同的 checkpoint 消息证明的稳定检查点
+type StableCheckpoint struct {
+	SequenceID     int64            `json:"sequenceID"`
+	Digest         string           `json:"digest"`
+	CheckpointMsgs []*CheckpointMsg `json:"checkpointMsgs"`
+}
+
+// Snapshot 是检查点处被复制的状态，包括状态机的快照、回复表和副本集合
+type Snapshot struct {
+	App        []byte                `json:"app"`
+	Replies    map[string]*LastReply `json:"replies"`
+	Membership *Membership           `json:"membership,omitempty"`
+}
+
+// CheckpointLog 保存高低水位之间尚未成为稳定检查点的 checkpoint 消息。
+// 高水位之上的消息只保留每个节点最新的一个，仅用于发现本节点已经落后，因此日志的大小有上限。
+type CheckpointLog struct {
+	CheckpointMsgs map[int64]map[string]*CheckpointMsg
+	AheadMsgs      map[string]*CheckpointMsg
+}
+
+func CreateCheckpointLog() *CheckpointLog {
+	return &CheckpointLog{
+		CheckpointMsgs: make(map[int64]map[string]*CheckpointMsg),
+		AheadMsgs:      make(map[string]*CheckpointMsg),
+	}
+}
+
+// GenesisCheckpoint 是节点启动时的稳定检查点，此时还没有提交任何请求
+func GenesisCheckpoint() *StableCheckpoint {
+	return &StableCheckpoint{
+		SequenceID:     -1,
+		CheckpointMsgs: make([]*CheckpointMsg, 0),
+	}
+}
+
+// IsCheckpoint 判断提交序列号为 sequenceID 的请求后是否需要生成检查点
+func IsCheckpoint(sequenceID int64) bool {
+	return (sequenceID+1)%CheckpointPeriod == 0
+}
+
+// Add 将高低水位之间的 checkpoint 消息加入日志，当该序列号收集到 2f+1 个摘要相同的消息时返回稳定检查点。
+// lowWaterMark 为本节点稳定检查点的序列号，水位之外的消息不会加入日志。
+func (log *CheckpointLog) Add(msg *CheckpointMsg, lowWaterMark int64, quorum Quorum) *StableCheckpoint {
+	if !InWaterMarks(lowWaterMark, msg.SequenceID) {
+		return nil
+	}
+	if log.CheckpointMsgs[msg.SequenceID] == nil {
+		log.CheckpointMsgs[msg.SequenceID] = make(map[string]*CheckpointMsg)
+	}
+	log.CheckpointMsgs[msg.SequenceID][msg.NodeID] = msg
+
+	checkpointMsgs := make([]*CheckpointMsg, 0)
+	for _, checkpointMsg := range log.CheckpointMsgs[msg.SequenceID] {
+		if checkpointMsg.Digest == msg.Digest {
+			checkpointMsgs = append(checkpointMsgs, checkpointMsg)
+		}
+	}
+	if len(checkpointMsgs) < quorum.Commit() {
+		return nil
+	}
+	sort.Slice(checkpointMsgs, func(i, j int) bool {
+		return checkpointMsgs[i].NodeID < checkpointMsgs[j].NodeID
+	})
+
+	return &StableCheckpoint{
+		SequenceID:     msg.SequenceID,
+		Digest:         msg.Digest,
+		CheckpointMsgs: checkpointMsgs,
+	}
+}
+
+// AddAhead 记录高于高水位的 checkpoint 消息。f+1 个节点都在高水位之上生成了检查点时，
+// 其中至少有一个正常节点，本节点已经落后，返回其中第 f+1 高的序列号。
+func (log *CheckpointLog) AddAhead(msg *CheckpointMsg, quorum Quorum) (int64, bool) {
+	if other, ok := log.AheadMsgs[msg.NodeID]; ok && other.SequenceID >= msg.SequenceID {
+		return 0, false
+	}
+	log.AheadMsgs[msg.NodeID] = msg
+
+	sequenceIDs := make([]int64, 0, len(log.AheadMsgs))
+	for _, aheadMsg := range log.AheadMsgs {
+		sequenceIDs = append(sequenceIDs, aheadMsg.SequenceID)
+	}
+	if len(sequenceIDs) < quorum.Reply() {
+		return 0, false
+	}
+	sort.Slice(sequenceIDs, func(i, j int) bool {
+		return sequenceIDs[i] > sequenceIDs[j]
+	})
+	return sequenceIDs[quorum.Reply()-1], true
+}
+
+// Discard 丢弃序列号不大于 sequenceID 的 checkpoint 消息
+func (log *CheckpointLog) Discard(sequenceID int64) {
+	for checkpointSequenceID := range log.CheckpointMsgs {
+		if checkpointSequenceID <= sequenceID {
+			delete(log.CheckpointMsgs, checkpointSequenceID)
+		}
+	}
+	for nodeID, msg := range log.AheadMsgs {
+		if msg.SequenceID <= sequenceID {
+			delete(log.AheadMsgs, nodeID)
+		}
+	}
+}
+
+// VerifyCheckpoint 检查 checkpointMsgs 是否能证明 sequenceID 处的检查点是稳定的
+func VerifyCheckpoint(sequenceID int64, checkpointMsgs []*CheckpointMsg, keys *KeyRegistry) error {
+	// 初始状态不需要证明
+	if sequenceID == -1 {
+		return nil
+	}
+
+	nodes := make(map[string]bool)
+	for _, msg := range checkpointMsgs {
+		if msg.SequenceID != sequenceID || msg.Digest != checkpointMsgs[0].Digest {
+			return errors.New("checkpoint proof contains mismatched checkpoint messages")
+		}
+		if err := keys.Verify(msg.NodeID, msg); err != nil {
+			return err
+		}
+		nodes[msg.NodeID] = true
+	}
+	if len(nodes) < keys.Quorum().Commit() {
+		return errors.New("checkpoint proof does not contain 2f+1 checkpoint messages")
+	}
+	return nil
+}
@@ -1,206 +1,298 @@
-package consensus
-
-import (
-	"encoding/json"
-	"fmt"
-	"errors"
-	"time"
-)
-
-type State struct {
-	ViewID int64
-	MsgLogs *MsgLogs
-	LastSequenceID int64
-	CurrentStage Stage
-}
-
-type MsgLogs struct {
-	ReqMsg *RequestMsg
-	PrepareMsgs map[string]*VoteMsg
-	CommitMsgs map[string]*VoteMsg
-}
-
-type Stage int
-const (
-	Idle        Stage = iota // Node is created successfully, but the consensus process is not started yet.
-	PrePrepared              // The ReqMsgs is processed successfully. The node is ready to head to the Prepare stage.
-	Prepared                 // Same with `prepared` stage explained in the original paper.
-	Committed                // Same with `committed-local` stage explained in the original paper.
-)
-
-const f = 1
-
-func CreateState(viewID int64, lastSequenceID int64) *State{
-	return &State{
-		ViewID: viewID,
-		MsgLogs: &MsgLogs{
-			ReqMsg:nil,
-			PrepareMsgs:make(map[string]*VoteMsg),
-			CommitMsgs:make(map[string]*VoteMsg),
-		},
-		LastSequenceID: lastSequenceID,
-		CurrentStage: Idle,
-	}
-}
-
-func (state *State) StartConsensus(request *RequestMsg)(*PrePrepareMsg, error) {
-	sequenceID := time.Now().UnixNano()
-
-	// 找到当前序列 id 中的最大值
-	if state.LastSequenceID != -1 {
-		for state.LastSequenceID >= sequenceID {
-			sequenceID += 1
-		}
-	}
-	// 为请求消息对象分配一个新的序列ID
-	request.SequenceID = sequenceID
-
-	// 向日志中保存 reqMsgs
-	state.MsgLogs.ReqMsg = request
-
-	// 获取请求消息的签名
-	digest, err := digest(request)
-	if err != nil {
-		fmt.Println(err)
-		return nil, err
-	}
-
-	// 将状态转换为 pre-prepared
-	state.CurrentStage = PrePrepared
-
-	return &PrePrepareMsg{
-		ViewID: state.ViewID,
-		SequenceID: sequenceID,
-		Digest: digest,
-		RequestMsg: request,
-	}, nil
-}
-
-func digest(object interface{}) (string, error) {
-	msg, err := json.Marshal(object)
-
-	if err != nil {
-		return "", nil
-	}
-	return Hash(msg), nil
-}
-
-func (state *State) PrePrepare(prePrepareMsg *PrePrepareMsg) (*VoteMsg, error) {
-	// 获取 msg 并将其放入 log 中
-	state.MsgLogs.ReqMsg = prePrepareMsg.RequestMsg
-	// 检验信息正确与否
-	if !state.verifyMsg(prePrepareMsg.ViewID, prePrepareMsg.SequenceID, prePrepareMsg.Digest) {
-		return nil, errors.New("pre-prepare message is corrupted")
-	}
-	// 将状态更改为 pre-prepare
-	state.CurrentStage = PrePrepared
-
-	return &VoteMsg {
-		ViewID: state.ViewID,
-		SequenceID: prePrepareMsg.SequenceID,
-		Digest: prePrepareMsg.Digest,
-		MsgType: PrepareMsg,
-	}, nil
-}
-
-func (state *State) Prepare(prepareMsg *VoteMsg) (*VoteMsg, error) {
-	if !state.verifyMsg(prepareMsg.ViewID, prepareMsg.SequenceID, prepareMsg.Digest) {
-		return nil, errors.New("Prepare message is corrupted.")
-	}
-
-	// 将信息添加到 logs
-	state.MsgLogs.PrepareMsgs[prepareMsg.NodeID] = prepareMsg
-
-	// 输出当前投片信息
-	fmt.Printf("[Prepare-Vote]: %d\n", len(state.MsgLogs.PrepareMsgs))
-
-	if state.prepared() {
-		// 更改当前状态至 prepared
-		state.CurrentStage = Prepared
-
-		return &VoteMsg{
-			ViewID: state.ViewID,
-			SequenceID: prepareMsg.SequenceID,
-			Digest: prepareMsg.Digest,
-			MsgType: CommitMsg,
-		}, nil
-	}
-
-	return nil, nil
-}
-
-func (state *State) Commit(commitMsg *VoteMsg) (*ReplyMsg, *RequestMsg, error) {
-	if !state.verifyMsg(commitMsg.ViewID, commitMsg.SequenceID, commitMsg.Digest) {
-		return nil, nil, errors.New("commit message is corrupted")
-	}
-
-	// 将 msg 加入 log
-	state.MsgLogs.CommitMsgs[commitMsg.NodeID] = commitMsg
-
-	// 输出当前投票状态
-	fmt.Printf("[Commit-Vote]: %d\n", len(state.MsgLogs.CommitMsgs))
-
-	if state.committed() {
-		// 此节点在本地执行请求的操作并获取结果。
-		result := "Executed"
-
-		// 更改状态至 prepared
-		state.CurrentStage = Committed
-
-		return &ReplyMsg{
-			ViewID: state.ViewID,
-			Timestamp: state.MsgLogs.ReqMsg.Timestamp,
-			ClientID: state.MsgLogs.ReqMsg.ClinetID,
-			Result: result,
-		}, state.MsgLogs.ReqMsg, nil
-	}
-	return nil, nil, nil
-}
-
-func (state *State) committed() bool {
-	if !state.prepared() {
-		return false
-	}
-	if len(state.MsgLogs.CommitMsgs) < 2 * f {
-		return false
-	}
-	return true
-}
-
-func (state *State) verifyMsg(viewID int64, sequenceID int64, digestGot string) bool {
-	// 试图错误，将导致无法启动共识
-	if state.ViewID != viewID {
-		return false
-	}
-
-	// 检查是否传递错误序列号
-	if state.LastSequenceID != -1 {
-		// 要保证传递的 sequenceID 是比 LastSequenceID 大的
-		if state.LastSequenceID >= sequenceID {
-			return false
-		}
-	}
-
-	digest, err := digest(state.MsgLogs.ReqMsg)
-	if err != nil {
-		fmt.Println(err)
-		return false
-	}
-
-	// 检验 digest
-	if digestGot != digest {
-		return false
-	}
-
-	return true
-}
-
-func (state *State) prepared() bool {
-	if state.MsgLogs.ReqMsg == nil {
-		return false
-	}
-	if len(state.MsgLogs.PrepareMsgs) < 2 * f {
-		return false
-	}
-	return true
-}
+package consensus
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// State 是某一视图中某一序列号上的一次共识实例
+type State struct {
+	ViewID       int64
+	SequenceID   int64
+	MsgLogs      *MsgLogs
+	CurrentStage Stage
+	// 用于检查每一条消息的签名
+	Keys *KeyRegistry
+}
+
+// InstanceKey 唯一确定一次共识实例
+type InstanceKey struct {
+	ViewID     int64
+	SequenceID int64
+}
+
+type MsgLogs struct {
+	PrePrepareMsg *PrePrepareMsg
+	Digest        string
+	PrepareMsgs   map[string]*VoteMsg
+	CommitMsgs    map[string]*VoteMsg
+}
+
+type Stage int
+
+const (
+	Idle        Stage = iota // Node is created successfully, but the consensus process is not started yet.
+	PrePrepared              // The ReqMsgs is processed successfully. The node is ready to head to the Prepare stage.
+	Prepared                 // Same with `prepared` stage explained in the original paper.
+	Committed                // Same with `committed-local` stage explained in the original paper.
+)
+
+func CreateState(viewID int64, sequenceID int64, keys *KeyRegistry) *State {
+	return &State{
+		ViewID:     viewID,
+		SequenceID: sequenceID,
+		MsgLogs: &MsgLogs{
+			PrePrepareMsg: nil,
+			PrepareMsgs:   make(map[string]*VoteMsg),
+			CommitMsgs:    make(map[string]*VoteMsg),
+		},
+		CurrentStage: Idle,
+		Keys:         keys,
+	}
+}
+
+// RestoreState 用 WAL 中记录的 pre-prepare 消息恢复共识实例，该消息在写入 WAL 之前已经检查过
+func RestoreState(prePrepareMsg *PrePrepareMsg, keys *KeyRegistry) *State {
+	state := CreateState(prePrepareMsg.ViewID, prePrepareMsg.SequenceID, keys)
+	state.MsgLogs.PrePrepareMsg = prePrepareMsg
+	state.MsgLogs.Digest = prePrepareMsg.Digest
+	state.CurrentStage = PrePrepared
+	return state
+}
+
+// RestoreVote 将本节点发送过的投票重新加入共识实例。
+// MACMode 中节点给自己的认证码在重启后无法验证，因此不再检查。
+func (state *State) RestoreVote(vote *VoteMsg) {
+	switch vote.MsgType {
+	case PrepareMsg:
+		state.MsgLogs.PrepareMsgs[vote.NodeID] = vote
+	case CommitMsg:
+		state.MsgLogs.CommitMsgs[vote.NodeID] = vote
+		// 只有 prepared 之后才会发送 commit 消息
+		if state.CurrentStage < Prepared {
+			state.CurrentStage = Prepared
+		}
+	}
+}
+
+// Key 返回共识实例的 (view, seq)
+func (state *State) Key() InstanceKey {
+	return InstanceKey{state.ViewID, state.SequenceID}
+}
+
+// StartConsensus 由主节点调用，将一批请求放在同一个序列号中
+func (state *State) StartConsensus(requests []*RequestMsg) (*PrePrepareMsg, error) {
+	// 序列号由节点在高低水位之间连续分配，视图切换时才能用空批次补齐缺失的序列号
+	sequenceID := state.SequenceID
+
+	// 为请求消息对象分配一个新的序列ID
+	for _, request := range requests {
+		request.SequenceID = sequenceID
+	}
+
+	// 获取整个批次的摘要
+	digest, err := BatchDigest(requests)
+	if err != nil {
+		fmt.Println(err)
+		return nil, err
+	}
+
+	// 将状态转换为 pre-prepared
+	state.MsgLogs.Digest = digest
+	state.CurrentStage = PrePrepared
+
+	// 节点签名之后，该消息同时作为 prepared 证明的一部分
+	state.MsgLogs.PrePrepareMsg = &PrePrepareMsg{
+		ViewID:      state.ViewID,
+		SequenceID:  sequenceID,
+		Digest:      digest,
+		RequestMsgs: requests,
+	}
+	return state.MsgLogs.PrePrepareMsg, nil
+}
+
+func digest(object interface{}) (string, error) {
+	msg, err := json.Marshal(object)
+
+	if err != nil {
+		return "", nil
+	}
+	return Hash(msg), nil
+}
+
+func (state *State) PrePrepare(prePrepareMsg *PrePrepareMsg) (*VoteMsg, error) {
+	// 同一视图的同一序列号只能接受一个 pre-prepare 消息
+	if state.MsgLogs.PrePrepareMsg != nil {
+		return nil, errors.New("another pre-prepare message has been accepted for this sequence")
+	}
+
+	// 检验信息正确与否，批次中的每个请求都需要由客户端签名
+	if !verifyBatch(prePrepareMsg, state.Keys) {
+		return nil, errors.New("pre-prepare message is corrupted")
+	}
+	if !state.verifyMsg(prePrepareMsg.ViewID, prePrepareMsg.SequenceID, prePrepareMsg.Digest, prePrepareMsg.NodeID, prePrepareMsg) {
+		return nil, errors.New("pre-prepare message is corrupted")
+	}
+
+	// 获取 msg 并将其放入 log 中
+	state.MsgLogs.PrePrepareMsg = prePrepareMsg
+	state.MsgLogs.Digest = prePrepareMsg.Digest
+
+	// 将状态更改为 pre-prepare
+	state.CurrentStage = PrePrepared
+
+	return &VoteMsg{
+		ViewID:     state.ViewID,
+		SequenceID: prePrepareMsg.SequenceID,
+		Digest:     prePrepareMsg.Digest,
+		MsgType:    PrepareMsg,
+	}, nil
+}
+
+func (state *State) Prepare(prepareMsg *VoteMsg) (*VoteMsg, error) {
+	if !state.verifyMsg(prepareMsg.ViewID, prepareMsg.SequenceID, prepareMsg.Digest, prepareMsg.NodeID, prepareMsg) {
+		return nil, errors.New("Prepare message is corrupted.")
+	}
+
+	// 将信息添加到 logs，pre-prepare 消息到达之前的投票也先保存下来
+	state.MsgLogs.PrepareMsgs[prepareMsg.NodeID] = prepareMsg
+
+	// 输出当前投片信息
+	fmt.Printf("[Prepare-Vote]: %d\n", state.countVotes(state.MsgLogs.PrepareMsgs))
+
+	// 只在第一次达到 prepared 时发送 commit 消息
+	if state.CurrentStage == PrePrepared && state.prepared() {
+		// 更改当前状态至 prepared
+		state.CurrentStage = Prepared
+
+		return &VoteMsg{
+			ViewID:     state.ViewID,
+			SequenceID: prepareMsg.SequenceID,
+			Digest:     prepareMsg.Digest,
+			MsgType:    CommitMsg,
+		}, nil
+	}
+
+	return nil, nil
+}
+
+// Commit 在第一次达到 committed 时返回被提交的 pre-prepare 消息
+func (state *State) Commit(commitMsg *VoteMsg) (*PrePrepareMsg, error) {
+	if !state.verifyMsg(commitMsg.ViewID, commitMsg.SequenceID, commitMsg.Digest, commitMsg.NodeID, commitMsg) {
+		return nil, errors.New("commit message is corrupted")
+	}
+
+	// 将 msg 加入 log
+	state.MsgLogs.CommitMsgs[commitMsg.NodeID] = commitMsg
+
+	// 输出当前投票状态
+	fmt.Printf("[Commit-Vote]: %d\n", state.countVotes(state.MsgLogs.CommitMsgs))
+
+	if state.CurrentStage == Prepared && state.committed() {
+		// 更改状态至 committed
+		state.CurrentStage = Committed
+
+		// 请求需要等到之前的序列号全部执行之后才能由 Application 执行
+		return state.MsgLogs.PrePrepareMsg, nil
+	}
+	return nil, nil
+}
+
+// PreparedCert 返回当前请求的 prepared 证明，用于视图切换
+func (state *State) PreparedCert() *PreparedCert {
+	if state.CurrentStage < Prepared {
+		return nil
+	}
+
+	prepareMsgs := make([]*VoteMsg, 0, len(state.MsgLogs.PrepareMsgs))
+	for _, prepareMsg := range state.MsgLogs.PrepareMsgs {
+		if prepareMsg.Digest == state.MsgLogs.Digest {
+			prepareMsgs = append(prepareMsgs, prepareMsg)
+		}
+	}
+
+	return &PreparedCert{
+		PrePrepareMsg: state.MsgLogs.PrePrepareMsg,
+		PrepareMsgs:   prepareMsgs,
+	}
+}
+
+// committed 需要 2f+1 个（包括自己的）与 pre-prepare 匹配的 commit 消息
+func (state *State) committed() bool {
+	if !state.prepared() {
+		return false
+	}
+	if state.countVotes(state.MsgLogs.CommitMsgs) < state.Keys.Quorum().Commit() {
+		return false
+	}
+	return true
+}
+
+func (state *State) verifyMsg(viewID int64, sequenceID int64, digestGot string, nodeID string, msg SignedMsg) bool {
+	// 签名或认证码错误的消息不能计入投票，否则一个错误节点就可以冒充其他节点投票
+	if state.Keys.Authenticate(nodeID, msg) != nil {
+		return false
+	}
+
+	// 试图错误，将导致无法启动共识
+	if state.ViewID != viewID {
+		return false
+	}
+
+	// 检查是否传递错误序列号
+	if state.SequenceID != sequenceID {
+		return false
+	}
+
+	// 还没有收到 pre-prepare 消息时无法检验 digest
+	if state.MsgLogs.PrePrepareMsg == nil {
+		return true
+	}
+
+	// 检验 digest
+	if digestGot != state.MsgLogs.Digest {
+		return false
+	}
+
+	return true
+}
+
+// prepared 需要 pre-prepare 消息以及 2f 个（包括自己的）与之匹配的 prepare 消息
+func (state *State) prepared() bool {
+	if state.MsgLogs.PrePrepareMsg == nil {
+		return false
+	}
+	if state.countVotes(state.MsgLogs.PrepareMsgs) < state.Keys.Quorum().Prepare() {
+		return false
+	}
+	return true
+}
+
+// Voters 返回与 pre-prepare 消息摘要一致的 prepare 或 commit 投票的节点，按字典序排列
+func (state *State) Voters(msgType MsgType) []string {
+	votes := state.MsgLogs.PrepareMsgs
+	if msgType == CommitMsg {
+		votes = state.MsgLogs.CommitMsgs
+	}
+	voters := make([]string, 0, len(votes))
+	for nodeID, vote := range votes {
+		if vote.Digest == state.MsgLogs.Digest {
+			voters = append(voters, nodeID)
+		}
+	}
+	sort.Strings(voters)
+	return voters
+}
+
+// countVotes 统计与 pre-prepare 消息摘要一致的投票数
+func (state *State) countVotes(votes map[string]*VoteMsg) int {
+	count := 0
+	for _, vote := range votes {
+		if vote.Digest == state.MsgLogs.Digest {
+			count++
+		}
+	}
+	return count
+}
@@ -0,0 +1,151 @@
+package consensus
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"strings"
+)
+
+// ReconfigPrefix 是重配置请求的操作前缀。重配置请求和普通请求一样经过三阶段协议排序，
+// 但不交给状态机执行，而是修改副本集合，公钥为十六进制编码的 Ed25519 公钥：
+//
+//	RECONFIG ADD <NodeID> <Addr> <PublicKey>
+//	RECONFIG REMOVE <NodeID>
+//	RECONFIG ROTATE <NodeID> <PublicKey>
+const ReconfigPrefix = "RECONFIG"
+
+const (
+	ReconfigAdd    = "ADD"
+	ReconfigRemove = "REMOVE"
+	ReconfigRotate = "ROTATE"
+)
+
+// Replica 是副本集合中的一个节点
+type Replica struct {
+	Addr      string            `json:"addr"`
+	PublicKey ed25519.PublicKey `json:"publicKey"`
+}
+
+// Membership 是被复制的副本集合，作为状态的一部分保存在快照中。Epoch 在每次重配置生效时加一。
+type Membership struct {
+	Epoch    int64               `json:"epoch"`
+	Replicas map[string]*Replica `json:"replicas"`
+}
+
+// Reconfig 是解析之后的重配置请求
+type Reconfig struct {
+	Op        string
+	NodeID    string
+	Addr      string
+	PublicKey ed25519.PublicKey
+}
+
+// NewMembership 由节点列表和每个节点的公钥构造初始的副本集合
+func NewMembership(nodeTable map[string]string, publicKeys map[string]ed25519.PublicKey) *Membership {
+	membership := &Membership{Replicas: make(map[string]*Replica)}
+	for nodeID, addr := range nodeTable {
+		membership.Replicas[nodeID] = &Replica{Addr: addr, PublicKey: publicKeys[nodeID]}
+	}
+	return membership
+}
+
+// NodeTable 返回副本集合中每个节点的地址
+func (membership *Membership) NodeTable() map[string]string {
+	nodeTable := make(map[string]string, len(membership.Replicas))
+	for nodeID, replica := range membership.Replicas {
+		nodeTable[nodeID] = replica.Addr
+	}
+	return nodeTable
+}
+
+// IDs 返回按字典序排列的副本集合
+func (membership *Membership) IDs() []string {
+	ids := make([]string, 0, len(membership.Replicas))
+	for nodeID := range membership.Replicas {
+		ids = append(ids, nodeID)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Apply 返回执行重配置之后的副本集合，membership 本身不会被修改
+func (membership *Membership) Apply(reconfig *Reconfig) (*Membership, error) {
+	next := &Membership{
+		Epoch:    membership.Epoch,
+		Replicas: make(map[string]*Replica, len(membership.Replicas)+1),
+	}
+	for nodeID, replica := range membership.Replicas {
+		next.Replicas[nodeID] = replica
+	}
+
+	replica, ok := next.Replicas[reconfig.NodeID]
+	switch reconfig.Op {
+	case ReconfigAdd:
+		if ok {
+			return nil, errors.New("replica " + reconfig.NodeID + " already exists")
+		}
+		next.Replicas[reconfig.NodeID] = &Replica{Addr: reconfig.Addr, PublicKey: reconfig.PublicKey}
+	case ReconfigRemove:
+		if !ok {
+			return nil, errors.New("replica " + reconfig.NodeID + " does not exist")
+		}
+		if len(next.Replicas) == 1 {
+			return nil, errors.New("cannot remove the last replica")
+		}
+		delete(next.Replicas, reconfig.NodeID)
+	case ReconfigRotate:
+		if !ok {
+			return nil, errors.New("replica " + reconfig.NodeID + " does not exist")
+		}
+		next.Replicas[reconfig.NodeID] = &Replica{Addr: replica.Addr, PublicKey: reconfig.PublicKey}
+	default:
+		return nil, errors.New("unknown reconfiguration " + reconfig.Op)
+	}
+	return next, nil
+}
+
+// IsReconfig 判断请求是否为重配置请求
+func IsReconfig(reqMsg *RequestMsg) bool {
+	fields := strings.Fields(reqMsg.Operation)
+	return len(fields) != 0 && fields[0] == ReconfigPrefix
+}
+
+// ParseReconfig 解析重配置请求的操作
+func ParseReconfig(operation string) (*Reconfig, error) {
+	fields := strings.Fields(operation)
+	if len(fields) < 3 || fields[0] != ReconfigPrefix {
+		return nil, errors.New("malformed reconfiguration " + operation)
+	}
+
+	reconfig := &Reconfig{Op: strings.ToUpper(fields[1]), NodeID: fields[2]}
+	var publicKey string
+	switch {
+	case reconfig.Op == ReconfigAdd && len(fields) == 5:
+		reconfig.Addr = fields[3]
+		publicKey = fields[4]
+	case reconfig.Op == ReconfigRemove && len(fields) == 3:
+		return reconfig, nil
+	case reconfig.Op == ReconfigRotate && len(fields) == 4:
+		publicKey = fields[3]
+	default:
+		return nil, errors.New("malformed reconfiguration " + operation)
+	}
+
+	key, err := hex.DecodeString(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, errors.New("the public key in the reconfiguration has a wrong size")
+	}
+	reconfig.PublicKey = key
+	return reconfig, nil
+}
+
+// ReconfigBoundary 返回在 sequenceID 处执行的重配置生效的位置，即第一个不小于 sequenceID 的检查点。
+// 新的副本集合从该检查点之后的序列号开始使用，所有节点都在执行到同一个序列号时切换。
+func ReconfigBoundary(sequenceID int64) int64 {
+	return (sequenceID/CheckpointPeriod+1)*CheckpointPeriod - 1
+}
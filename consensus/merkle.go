@@ -0,0 +1,100 @@
+package consensus
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// Merkle 树中叶子和内部节点摘要的前缀（RFC 6962），叶子不能被当作内部节点，内部节点也不能被当作叶子
+const (
+	merkleLeafPrefix  = 0x00
+	merkleInnerPrefix = 0x01
+)
+
+// MerkleRoot 计算叶子摘要的 Merkle 根，每一层中落单的节点直接进入上一层，没有叶子时为空字符串的摘要
+func MerkleRoot(leaves []string) string {
+	if len(leaves) == 0 {
+		return Hash(nil)
+	}
+
+	level := merkleLeaves(leaves)
+	for len(level) > 1 {
+		level = merkleLevel(level)
+	}
+	return level[0]
+}
+
+// MerkleProof 返回第 index 个叶子到根的路径上每一层的兄弟节点，落单的节点没有兄弟，不占用路径
+func MerkleProof(leaves []string, index int) []string {
+	proof := make([]string, 0)
+	level := merkleLeaves(leaves)
+	for len(level) > 1 {
+		if sibling := index ^ 1; sibling < len(level) {
+			proof = append(proof, level[sibling])
+		}
+		level = merkleLevel(level)
+		index /= 2
+	}
+	return proof
+}
+
+// VerifyMerkleProof 由叶子的摘要和路径重新计算 Merkle 根，count 为叶子的数量，用于确定每一层中节点的位置
+func VerifyMerkleProof(root string, leaf string, index int, count int, proof []string) bool {
+	if index < 0 || index >= count {
+		return false
+	}
+
+	hash, ok := merkleHash(merkleLeafPrefix, leaf)
+	for ok && count > 1 {
+		if sibling := index ^ 1; sibling < count {
+			if len(proof) == 0 {
+				return false
+			}
+			if index%2 == 0 {
+				hash, ok = merkleHash(merkleInnerPrefix, hash, proof[0])
+			} else {
+				hash, ok = merkleHash(merkleInnerPrefix, proof[0], hash)
+			}
+			proof = proof[1:]
+		}
+		index /= 2
+		count = (count + 1) / 2
+	}
+	return ok && len(proof) == 0 && hash == root
+}
+
+// merkleHash 计算前缀与各个摘要的原始字节拼接之后的摘要，摘要不是 Hash 的十六进制结果时返回 false
+func merkleHash(prefix byte, digests ...string) (string, bool) {
+	content := []byte{prefix}
+	for _, digest := range digests {
+		raw, err := hex.DecodeString(digest)
+		if err != nil || len(raw) != sha256.Size {
+			return "", false
+		}
+		content = append(content, raw...)
+	}
+	return Hash(content), true
+}
+
+// merkleLeaves 计算叶子节点。叶子都是本节点计算的摘要，不会是非法的编码
+func merkleLeaves(leaves []string) []string {
+	level := make([]string, 0, len(leaves))
+	for _, leaf := range leaves {
+		hash, _ := merkleHash(merkleLeafPrefix, leaf)
+		level = append(level, hash)
+	}
+	return level
+}
+
+func merkleLevel(level []string) []string {
+	next := make([]string, 0, (len(level)+1)/2)
+	for i := 0; i < len(level); i += 2 {
+		if i+1 == len(level) {
+			next = append(next, level[i])
+			continue
+		}
+		hash, _ := merkleHash(merkleInnerPrefix, level[i], level[i+1])
+		next = append(next, hash)
+	}
+	return next
+}
@@ -0,0 +1,170 @@
+package consensus
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"testing"
+)
+
+func testLeaves(count int) []string {
+	leaves := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		leaves = append(leaves, Hash([]byte(fmt.Sprintf("leaf %d", i))))
+	}
+	return leaves
+}
+
+// testHash 计算前缀与各个摘要的原始字节拼接之后的摘要，不经过 merkleHash
+func testHash(prefix byte, digests ...string) string {
+	content := []byte{prefix}
+	for _, digest := range digests {
+		raw, _ := hex.DecodeString(digest)
+		content = append(content, raw...)
+	}
+	return Hash(content)
+}
+
+func TestMerkleRoot(t *testing.T) {
+	leaves := testLeaves(5)
+	a, b, c, d, e := testHash(0, leaves[0]), testHash(0, leaves[1]), testHash(0, leaves[2]), testHash(0, leaves[3]), testHash(0, leaves[4])
+	tests := []struct {
+		name   string
+		leaves []string
+		root   string
+	}{
+		{"empty", nil, Hash(nil)},
+		{"one leaf", leaves[:1], a},
+		{"two leaves", leaves[:2], testHash(1, a, b)},
+		// 落单的叶子直接进入上一层
+		{"three leaves", leaves[:3], testHash(1, testHash(1, a, b), c)},
+		{"four leaves", leaves[:4], testHash(1, testHash(1, a, b), testHash(1, c, d))},
+		{"five leaves", leaves, testHash(1, testHash(1, testHash(1, a, b), testHash(1, c, d)), e)},
+	}
+
+	for _, test := range tests {
+		if root := MerkleRoot(test.leaves); root != test.root {
+			t.Errorf("%s: MerkleRoot = %s, want %s", test.name, root, test.root)
+		}
+	}
+}
+
+func TestMerkleProof(t *testing.T) {
+	for count := 1; count <= 9; count++ {
+		leaves := testLeaves(count)
+		root := MerkleRoot(leaves)
+		for index := range leaves {
+			proof := MerkleProof(leaves, index)
+			if !VerifyMerkleProof(root, leaves[index], index, count, proof) {
+				t.Errorf("%d leaves: the proof of leaf %d is rejected", count, index)
+			}
+		}
+	}
+}
+
+func TestVerifyMerkleProof(t *testing.T) {
+	leaves := testLeaves(5)
+	root := MerkleRoot(leaves)
+	proof := MerkleProof(leaves, 2)
+	tampered := append([]string{}, proof...)
+	tampered[0] = leaves[0]
+
+	tests := []struct {
+		name  string
+		root  string
+		leaf  string
+		index int
+		count int
+		proof []string
+		valid bool
+	}{
+		{"valid", root, leaves[2], 2, 5, proof, true},
+		{"wrong leaf", root, leaves[3], 2, 5, proof, false},
+		{"wrong index", root, leaves[2], 3, 5, proof, false},
+		{"wrong count", root, leaves[2], 2, 4, proof, false},
+		{"wrong root", MerkleRoot(leaves[:4]), leaves[2], 2, 5, proof, false},
+		{"tampered proof", root, leaves[2], 2, 5, tampered, false},
+		{"truncated proof", root, leaves[2], 2, 5, proof[:len(proof)-1], false},
+		{"extra proof", root, leaves[2], 2, 5, append(append([]string{}, proof...), leaves[0]), false},
+		{"invalid digest in proof", root, leaves[2], 2, 5, append([]string{"xyz"}, proof[1:]...), false},
+		{"invalid leaf", root, "xyz", 2, 5, proof, false},
+		{"negative index", root, leaves[2], -1, 5, proof, false},
+		{"index out of range", root, leaves[4], 5, 5, MerkleProof(leaves, 4), false},
+		// 最后一个叶子在前两层落单，路径中只有一个节点
+		{"last leaf", root, leaves[4], 4, 5, MerkleProof(leaves, 4), true},
+		// 内部节点不能被当作叶子
+		{"inner node as leaf", MerkleRoot(leaves[:4]), testHash(1, testHash(0, leaves[0]), testHash(0, leaves[1])), 0, 2,
+			[]string{testHash(1, testHash(0, leaves[2]), testHash(0, leaves[3]))}, false},
+	}
+
+	for _, test := range tests {
+		if valid := VerifyMerkleProof(test.root, test.leaf, test.index, test.count, test.proof); valid != test.valid {
+			t.Errorf("%s: VerifyMerkleProof = %v, want %v", test.name, valid, test.valid)
+		}
+	}
+}
+
+func TestSnapshotChunks(t *testing.T) {
+	tests := []struct {
+		name  string
+		size  int
+		count int
+		last  int
+	}{
+		{"empty", 0, 0, 0},
+		{"smaller than a chunk", 100, 1, 100},
+		{"exactly one chunk", SnapshotChunkSize, 1, SnapshotChunkSize},
+		{"one byte more", SnapshotChunkSize + 1, 2, 1},
+		{"odd chunk count", SnapshotChunkSize*2 + SnapshotChunkSize/2, 3, SnapshotChunkSize / 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data := make([]byte, test.size)
+			for i := range data {
+				data[i] = byte(i * 7)
+			}
+			chunks := SplitSnapshot(data)
+			if len(chunks.Chunks) != test.count || len(chunks.Hashes) != test.count {
+				t.Fatalf("%d chunks, want %d", len(chunks.Chunks), test.count)
+			}
+			if !bytes.Equal(chunks.Data(), data) {
+				t.Error("the joined chunks differ from the snapshot")
+			}
+			if test.count == 0 {
+				return
+			}
+			if last := len(chunks.Chunks[test.count-1]); last != test.last {
+				t.Errorf("the last chunk has %d bytes, want %d", last, test.last)
+			}
+
+			root := chunks.Root()
+			for index, chunk := range chunks.Chunks {
+				if !VerifyChunk(root, index, test.count, chunk, chunks.Proof(index)) {
+					t.Errorf("chunk %d is rejected", index)
+				}
+			}
+			last := test.count - 1
+			corrupted := append([]byte{}, chunks.Chunks[last]...)
+			corrupted[0] ^= 0xff
+			if VerifyChunk(root, last, test.count, corrupted, chunks.Proof(last)) {
+				t.Error("a corrupted last chunk is accepted")
+			}
+			if VerifyChunk(root, test.count, test.count, chunks.Chunks[last], chunks.Proof(last)) {
+				t.Error("a chunk out of range is accepted")
+			}
+
+			// 块数也由检查点的摘要证明
+			if SnapshotDigest(test.count, root) != chunks.Digest() {
+				t.Error("the digest differs from SnapshotDigest")
+			}
+			if SnapshotDigest(test.count+1, root) == chunks.Digest() {
+				t.Error("the digest does not depend on the chunk count")
+			}
+		})
+	}
+
+	if digest := SnapshotDigest(1, "xyz"); digest != "" {
+		t.Errorf("SnapshotDigest of an invalid root = %q, want empty", digest)
+	}
+}
@@ -1,36 +1,123 @@
-package consensus
-
-type RequestMsg struct {
-	Timestamp  int64 `json:"timestamp"`
-	ClinetID   string `json:"clientID"`
-	Operation  string `json:"operation"`
-	SequenceID int64 `json:"sequenceID"`
-}
-
-type PrePrepareMsg struct {
-	ViewID int64 `json:"viewID"`
-	SequenceID int64 `json:"sequenceID"`
-	Digest string `json:"digest"`
-	RequestMsg *RequestMsg `json:"requestMsg"`
-}
-
-type VoteMsg struct {
-	ViewID     int64  `json:"viewID"`
-	SequenceID int64  `json:"sequenceID"`
-	Digest     string `json:"digest"`
-	NodeID     string `json:"nodeID"`
-	MsgType           `json:"msgType"`
-}
-type MsgType int
-const (
-	PrepareMsg MsgType = iota
-	CommitMsg
-)
-
-type ReplyMsg struct {
-	ViewID int64 `json:"viewID"`
-	Timestamp int64 `json:"timestamp"`
-	ClientID string `json:"clientID"`
-	NodeID string `json:"nodeID"`
-	Result string `json:"result"`
-}
\ No newline at end of file
+package consensus
+
+type RequestMsg struct {
+	Timestamp  int64  `json:"timestamp"`
+	ClinetID   string `json:"clientID"`
+	Operation  string `json:"operation"`
+	SequenceID int64  `json:"sequenceID"`
+	// 客户端接收回复的地址，为空时回复发送给主节点
+	ReplyAddr string `json:"replyAddr,omitempty"`
+	// 客户端的签名，不包括由主节点分配的 SequenceID
+	Signature []byte `json:"signature"`
+}
+
+type PrePrepareMsg struct {
+	ViewID     int64  `json:"viewID"`
+	SequenceID int64  `json:"sequenceID"`
+	Digest     string `json:"digest"`
+	// 同一个序列号中的一批请求，视图切换产生的空批次中没有请求
+	RequestMsgs []*RequestMsg `json:"requestMsgs"`
+	NodeID      string        `json:"nodeID"`
+	Signature   []byte        `json:"signature"`
+}
+
+type VoteMsg struct {
+	ViewID     int64  `json:"viewID"`
+	SequenceID int64  `json:"sequenceID"`
+	Digest     string `json:"digest"`
+	NodeID     string `json:"nodeID"`
+	MsgType    `json:"msgType"`
+	Signature  []byte `json:"signature"`
+	// MACMode 中代替签名，key 为接收者的 NodeID
+	Authenticators map[string][]byte `json:"authenticators,omitempty"`
+}
+type MsgType int
+
+const (
+	PrepareMsg MsgType = iota
+	CommitMsg
+)
+
+type ReplyMsg struct {
+	ViewID    int64  `json:"viewID"`
+	Timestamp int64  `json:"timestamp"`
+	ClientID  string `json:"clientID"`
+	NodeID    string `json:"nodeID"`
+	Result    string `json:"result"`
+	Signature []byte `json:"signature"`
+}
+
+// ViewChangeMsg 由备份节点在怀疑主节点失效时广播，用于进入视图 NewViewID
+type ViewChangeMsg struct {
+	NewViewID        int64            `json:"newViewID"`
+	StableSequenceID int64            `json:"stableSequenceID"`
+	CheckpointMsgs   []*CheckpointMsg `json:"checkpointMsgs"`
+	PreparedCerts    []*PreparedCert  `json:"preparedCerts"`
+	// MACMode 中其他节点无法检查 prepare 消息的认证码，因此还需要携带已经接受的 pre-prepare 消息
+	PrePrepareMsgs []*PrePrepareMsg `json:"prePrepareMsgs,omitempty"`
+	NodeID         string           `json:"nodeID"`
+	Signature      []byte           `json:"signature"`
+}
+
+// PreparedCert 是某个请求在某一视图中达到 prepared 状态的证明
+type PreparedCert struct {
+	PrePrepareMsg *PrePrepareMsg `json:"prePrepareMsg"`
+	PrepareMsgs   []*VoteMsg     `json:"prepareMsgs"`
+}
+
+// NewViewMsg 由新视图的主节点在收集到 2f+1 个 view-change 消息后广播
+type NewViewMsg struct {
+	ViewID         int64            `json:"viewID"`
+	ViewChangeMsgs []*ViewChangeMsg `json:"viewChangeMsgs"`
+	PrePrepareMsgs []*PrePrepareMsg `json:"prePrepareMsgs"`
+	NodeID         string           `json:"nodeID"`
+	Signature      []byte           `json:"signature"`
+}
+
+// FetchStateMsg 由落后的节点广播，请求 SequenceID 之后的稳定检查点和已经提交的批次
+type FetchStateMsg struct {
+	SequenceID int64  `json:"sequenceID"`
+	NodeID     string `json:"nodeID"`
+	Signature  []byte `json:"signature"`
+}
+
+// StateMsg 是对 FetchStateMsg 的回复。发送者的稳定检查点不超过请求中的序列号时 Checkpoint 为空，
+// 否则 SnapshotChunks 为该检查点处快照的块数，SnapshotRoot 为各块摘要的 Merkle 根，快照需要通过 FetchChunkMsg 逐块获取。
+// CommittedMsgs 是此后发送者已经执行的批次。
+type StateMsg struct {
+	ViewID         int64             `json:"viewID"`
+	Checkpoint     *StableCheckpoint `json:"checkpoint,omitempty"`
+	SnapshotChunks int               `json:"snapshotChunks,omitempty"`
+	SnapshotRoot   string            `json:"snapshotRoot,omitempty"`
+	CommittedMsgs  []*PrePrepareMsg  `json:"committedMsgs"`
+	NodeID         string            `json:"nodeID"`
+	Signature      []byte            `json:"signature"`
+}
+
+// FetchChunkMsg 请求稳定检查点 SequenceID 处快照的第 Index 块
+type FetchChunkMsg struct {
+	SequenceID int64  `json:"sequenceID"`
+	Index      int    `json:"index"`
+	NodeID     string `json:"nodeID"`
+	Signature  []byte `json:"signature"`
+}
+
+// ChunkMsg 是快照的第 Index 块，Proof 为该块到快照的 Merkle 根的路径。
+// 接收者可以单独检查每一块，签名用于确认错误的分块确实来自 NodeID，之后不再向它请求分块。
+type ChunkMsg struct {
+	SequenceID int64    `json:"sequenceID"`
+	Index      int      `json:"index"`
+	Count      int      `json:"count"`
+	Data       []byte   `json:"data"`
+	Proof      []string `json:"proof"`
+	NodeID     string   `json:"nodeID"`
+	Signature  []byte   `json:"signature"`
+}
+
+// CheckpointMsg 每提交 K 个请求广播一次，Digest 为此时状态的摘要
+type CheckpointMsg struct {
+	SequenceID int64  `json:"sequenceID"`
+	Digest     string `json:"digest"`
+	NodeID     string `json:"nodeID"`
+	Signature  []byte `json:"signature"`
+}
@@ -1,8 +1,8 @@
-package consensus
-
-type PBFT interface {
-	StartConsensus(request *RequestMsg) (*PrePrepareMsg, error)
-	PrePrepare(prePrepareMsg *PrePrepareMsg) (*VoteMsg, error)
-	Prepare(prepareMsg *VoteMsg) (*VoteMsg, error)
-	Commit(commitMsg *VoteMsg) (*ReplyMsg, *RequestMsg, error)
-}
\ No newline at end of file
+package consensus
+
+type PBFT interface {
+	StartConsensus(requests []*RequestMsg) (*PrePrepareMsg, error)
+	PrePrepare(prePrepareMsg *PrePrepareMsg) (*VoteMsg, error)
+	Prepare(prepareMsg *VoteMsg) (*VoteMsg, error)
+	Commit(commitMsg *VoteMsg) (*PrePrepareMsg, error)
+}
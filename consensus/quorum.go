@@ -0,0 +1,36 @@
+package consensus
+
+// Quorum 根据副本数 n 计算最多能容忍的错误节点数 f = ⌊(n-1)/3⌋ 以及各阶段需要的投票数
+type Quorum struct {
+	N int
+	F int
+}
+
+func NewQuorum(n int) Quorum {
+	f := 0
+	if n > 0 {
+		f = (n - 1) / 3
+	}
+	return Quorum{N: n, F: f}
+}
+
+// Quorum 返回由 KeyRegistry 中的副本集合决定的法定人数
+func (keys *KeyRegistry) Quorum() Quorum {
+	return NewQuorum(len(keys.PublicKeys))
+}
+
+// Commit 返回 commit、checkpoint、view-change 等需要的法定人数，n = 3f+1 时为 2f+1。
+// n 不是 3f+1 时取 ⌈(n+f+1)/2⌉，保证任意两个法定人数至少在 f+1 个节点上相交，即至少有一个正常节点。
+func (quorum Quorum) Commit() int {
+	return (quorum.N + quorum.F + 2) / 2
+}
+
+// Prepare 返回 prepared 需要的 prepare 消息数，加上 pre-prepare 即构成一个法定人数
+func (quorum Quorum) Prepare() int {
+	return quorum.Commit() - 1
+}
+
+// Reply 返回至少包含一个正常节点的回复数 f+1，客户端和状态传输据此接受结果
+func (quorum Quorum) Reply() int {
+	return quorum.F + 1
+}
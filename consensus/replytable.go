@@ -0,0 +1,43 @@
+package consensus
+
+// LastReply 是某个客户端最后一个被执行的请求的时间戳及其结果。
+// 不同节点的回复中 ViewID、NodeID 和签名可能不同，因此只保存所有节点都相同的部分。
+type LastReply struct {
+	Timestamp int64  `json:"timestamp"`
+	Result    string `json:"result"`
+}
+
+// ReplyTable 记录每个客户端的最后一个回复，用于保证每个请求只被执行一次。
+// 它是被复制状态的一部分，与状态机的快照一起保存在检查点的快照中。
+type ReplyTable struct {
+	Replies map[string]*LastReply
+}
+
+func CreateReplyTable() *ReplyTable {
+	return &ReplyTable{
+		Replies: make(map[string]*LastReply),
+	}
+}
+
+// Executed 判断请求是否已经执行过，客户端的时间戳是递增的，不大于最后一个回复的请求都已经执行过了
+func (table *ReplyTable) Executed(request *RequestMsg) bool {
+	lastReply, ok := table.Replies[request.ClinetID]
+	return ok && request.Timestamp <= lastReply.Timestamp
+}
+
+// Get 返回请求对应的回复，只有最后一个请求的回复会被保存
+func (table *ReplyTable) Get(request *RequestMsg) (*LastReply, bool) {
+	lastReply, ok := table.Replies[request.ClinetID]
+	if !ok || lastReply.Timestamp != request.Timestamp {
+		return nil, false
+	}
+	return lastReply, true
+}
+
+// Save 记录请求执行后的结果
+func (table *ReplyTable) Save(request *RequestMsg, result string) {
+	table.Replies[request.ClinetID] = &LastReply{
+		Timestamp: request.Timestamp,
+		Result:    result,
+	}
+}
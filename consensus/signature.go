@@ -0,0 +1,188 @@
+package consensus
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+)
+
+// SignedMsg 是需要签名的消息，签名覆盖除 Signature 字段以外的全部内容
+type SignedMsg interface {
+	signingPayload() ([]byte, error)
+	signatureField() *[]byte
+}
+
+// KeyRegistry 保存集群中每个节点的公钥，与 NodeTable 一一对应，以及每个已注册客户端的公钥。
+// MACMode 中还保存本节点与每个节点（包括自己）之间的会话密钥。
+type KeyRegistry struct {
+	NodeID      string
+	Mode        string
+	PublicKeys  map[string]ed25519.PublicKey
+	ClientKeys  map[string]ed25519.PublicKey
+	SessionKeys map[string][]byte
+	// 可以提交重配置请求的客户端
+	Admins map[string]bool
+}
+
+func CreateKeyRegistry(nodeID string, mode string) *KeyRegistry {
+	return &KeyRegistry{
+		NodeID:      nodeID,
+		Mode:        mode,
+		PublicKeys:  make(map[string]ed25519.PublicKey),
+		ClientKeys:  make(map[string]ed25519.PublicKey),
+		SessionKeys: make(map[string][]byte),
+		Admins:      make(map[string]bool),
+	}
+}
+
+// Sign 使用节点的私钥为消息签名
+func Sign(privateKey ed25519.PrivateKey, msg SignedMsg) error {
+	payload, err := msg.signingPayload()
+	if err != nil {
+		return err
+	}
+	*msg.signatureField() = ed25519.Sign(privateKey, payload)
+	return nil
+}
+
+// Verify 检查消息是否由 nodeID 对应的节点签名
+func (keys *KeyRegistry) Verify(nodeID string, msg SignedMsg) error {
+	publicKey, ok := keys.PublicKeys[nodeID]
+	if !ok {
+		return errors.New("the message is sent by an unknown node " + nodeID)
+	}
+	return verifySignature(publicKey, nodeID, msg)
+}
+
+// VerifyRequest 检查请求是否由已注册的客户端签名，防止错误的主节点伪造客户端的操作
+func (keys *KeyRegistry) VerifyRequest(request *RequestMsg) error {
+	publicKey, ok := keys.ClientKeys[request.ClinetID]
+	if !ok {
+		return errors.New("the request is sent by an unknown client " + request.ClinetID)
+	}
+	return verifySignature(publicKey, request.ClinetID, request)
+}
+
+func verifySignature(publicKey ed25519.PublicKey, signer string, msg SignedMsg) error {
+	payload, err := msg.signingPayload()
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(publicKey, payload, *msg.signatureField()) {
+		return errors.New("the signature of the message from " + signer + " is invalid")
+	}
+	return nil
+}
+
+// 客户端签名时还不知道序列号，因此签名不包括 SequenceID
+func (msg *RequestMsg) signingPayload() ([]byte, error) {
+	unsigned := *msg
+	unsigned.Signature = nil
+	unsigned.SequenceID = 0
+	return json.Marshal(unsigned)
+}
+
+func (msg *RequestMsg) signatureField() *[]byte {
+	return &msg.Signature
+}
+
+func (msg *PrePrepareMsg) signingPayload() ([]byte, error) {
+	unsigned := *msg
+	unsigned.Signature = nil
+	return json.Marshal(unsigned)
+}
+
+func (msg *PrePrepareMsg) signatureField() *[]byte {
+	return &msg.Signature
+}
+
+func (msg *VoteMsg) signingPayload() ([]byte, error) {
+	unsigned := *msg
+	unsigned.Signature = nil
+	unsigned.Authenticators = nil
+	return json.Marshal(unsigned)
+}
+
+func (msg *VoteMsg) signatureField() *[]byte {
+	return &msg.Signature
+}
+
+func (msg *ReplyMsg) signingPayload() ([]byte, error) {
+	unsigned := *msg
+	unsigned.Signature = nil
+	return json.Marshal(unsigned)
+}
+
+func (msg *ReplyMsg) signatureField() *[]byte {
+	return &msg.Signature
+}
+
+func (msg *ViewChangeMsg) signingPayload() ([]byte, error) {
+	unsigned := *msg
+	unsigned.Signature = nil
+	return json.Marshal(unsigned)
+}
+
+func (msg *ViewChangeMsg) signatureField() *[]byte {
+	return &msg.Signature
+}
+
+func (msg *NewViewMsg) signingPayload() ([]byte, error) {
+	unsigned := *msg
+	unsigned.Signature = nil
+	return json.Marshal(unsigned)
+}
+
+func (msg *NewViewMsg) signatureField() *[]byte {
+	return &msg.Signature
+}
+
+func (msg *CheckpointMsg) signingPayload() ([]byte, error) {
+	unsigned := *msg
+	unsigned.Signature = nil
+	return json.Marshal(unsigned)
+}
+
+func (msg *CheckpointMsg) signatureField() *[]byte {
+	return &msg.Signature
+}
+
+func (msg *FetchStateMsg) signingPayload() ([]byte, error) {
+	unsigned := *msg
+	unsigned.Signature = nil
+	return json.Marshal(unsigned)
+}
+
+func (msg *FetchStateMsg) signatureField() *[]byte {
+	return &msg.Signature
+}
+
+func (msg *StateMsg) signingPayload() ([]byte, error) {
+	unsigned := *msg
+	unsigned.Signature = nil
+	return json.Marshal(unsigned)
+}
+
+func (msg *StateMsg) signatureField() *[]byte {
+	return &msg.Signature
+}
+
+func (msg *FetchChunkMsg) signingPayload() ([]byte, error) {
+	unsigned := *msg
+	unsigned.Signature = nil
+	return json.Marshal(unsigned)
+}
+
+func (msg *FetchChunkMsg) signatureField() *[]byte {
+	return &msg.Signature
+}
+
+func (msg *ChunkMsg) signingPayload() ([]byte, error) {
+	unsigned := *msg
+	unsigned.Signature = nil
+	return json.Marshal(unsigned)
+}
+
+func (msg *ChunkMsg) signatureField() *[]byte {
+	return &msg.Signature
+}
@@ -0,0 +1,100 @@
+package consensus
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+)
+
+// SnapshotChunkSize 是快照分块传输时每一块的大小
+const SnapshotChunkSize = 1 << 20
+
+// SnapshotChunks 是编码之后按 SnapshotChunkSize 分块的快照。
+// Hashes 为每一块的摘要，其 Merkle 根和块数一起构成检查点的摘要，因此每一块都可以单独检查。
+type SnapshotChunks struct {
+	Chunks [][]byte `json:"chunks"`
+	Hashes []string `json:"hashes"`
+}
+
+// ChunkSnapshot 编码快照并分块，所有节点在同一个检查点得到的分块完全相同
+func ChunkSnapshot(snapshot *Snapshot) (*SnapshotChunks, error) {
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return nil, err
+	}
+	return SplitSnapshot(data), nil
+}
+
+// SplitSnapshot 将编码之后的快照分块，用于读取保存在文件中的快照
+func SplitSnapshot(data []byte) *SnapshotChunks {
+	chunks := make([][]byte, 0, len(data)/SnapshotChunkSize+1)
+	for start := 0; start < len(data); start += SnapshotChunkSize {
+		end := start + SnapshotChunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		chunks = append(chunks, data[start:end])
+	}
+	return NewSnapshotChunks(chunks)
+}
+
+// NewSnapshotChunks 计算每一块的摘要，用于组装从其他节点下载的分块
+func NewSnapshotChunks(chunks [][]byte) *SnapshotChunks {
+	hashes := make([]string, 0, len(chunks))
+	for _, chunk := range chunks {
+		hashes = append(hashes, Hash(chunk))
+	}
+	return &SnapshotChunks{chunks, hashes}
+}
+
+// Root 返回各块摘要的 Merkle 根
+func (chunks *SnapshotChunks) Root() string {
+	return MerkleRoot(chunks.Hashes)
+}
+
+// Digest 返回检查点的摘要
+func (chunks *SnapshotChunks) Digest() string {
+	return SnapshotDigest(len(chunks.Hashes), chunks.Root())
+}
+
+// snapshotPrefix 区分检查点的摘要与 Merkle 树中的节点
+const snapshotPrefix = 0x02
+
+// SnapshotDigest 由快照的块数和 Merkle 根计算检查点的摘要。块数因此也由 2f+1 个 checkpoint 消息证明，
+// 落后的节点在下载之前就可以检查其他节点给出的块数。root 不是合法的摘要时返回空字符串，与任何检查点都不相同。
+func SnapshotDigest(count int, root string) string {
+	raw, err := hex.DecodeString(root)
+	if err != nil || len(raw) != sha256.Size {
+		return ""
+	}
+	content := make([]byte, 9, 9+len(raw))
+	content[0] = snapshotPrefix
+	binary.BigEndian.PutUint64(content[1:], uint64(count))
+	return Hash(append(content, raw...))
+}
+
+// Proof 返回第 index 块到 Merkle 根的路径
+func (chunks *SnapshotChunks) Proof(index int) []string {
+	return MerkleProof(chunks.Hashes, index)
+}
+
+// Data 将所有的分块拼接为编码之后的快照
+func (chunks *SnapshotChunks) Data() []byte {
+	return bytes.Join(chunks.Chunks, nil)
+}
+
+// Snapshot 将所有的分块拼接起来并解码
+func (chunks *SnapshotChunks) Snapshot() (*Snapshot, error) {
+	var snapshot Snapshot
+	if err := json.Unmarshal(chunks.Data(), &snapshot); err != nil {
+		return nil, err
+	}
+	return &snapshot, nil
+}
+
+// VerifyChunk 检查快照的第 index 块（共 count 块）是否属于 Merkle 根为 root 的快照，root 和 count 需要先由 SnapshotDigest 检查
+func VerifyChunk(root string, index int, count int, data []byte, proof []string) bool {
+	return VerifyMerkleProof(root, Hash(data), index, count, proof)
+}
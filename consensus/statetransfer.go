@@ -0,0 +1,88 @@
+package consensus
+
+import (
+	"errors"
+	"sort"
+)
+
+// VerifyState 检查 StateMsg 的签名、其中稳定检查点的证明，以及每个批次的摘要和客户端签名。
+// 快照的块数和 Merkle 根由检查点的摘要检查，每一块在收到时由 VerifyChunk 单独检查。
+func VerifyState(msg *StateMsg, keys *KeyRegistry) error {
+	if err := keys.Verify(msg.NodeID, msg); err != nil {
+		return err
+	}
+
+	if checkpoint := msg.Checkpoint; checkpoint != nil {
+		if msg.SnapshotChunks <= 0 {
+			return errors.New("state message contains a checkpoint without its snapshot")
+		}
+		if len(checkpoint.CheckpointMsgs) == 0 || checkpoint.CheckpointMsgs[0].Digest != checkpoint.Digest {
+			return errors.New("state message contains a checkpoint with a mismatched digest")
+		}
+		if err := VerifyCheckpoint(checkpoint.SequenceID, checkpoint.CheckpointMsgs, keys); err != nil {
+			return err
+		}
+		if SnapshotDigest(msg.SnapshotChunks, msg.SnapshotRoot) != checkpoint.Digest {
+			return errors.New("state message contains a snapshot layout that does not match the checkpoint")
+		}
+	}
+
+	for _, prePrepareMsg := range msg.CommittedMsgs {
+		if !verifyBatch(prePrepareMsg, keys) {
+			return errors.New("state message contains a corrupted batch")
+		}
+	}
+	return nil
+}
+
+// SelectBatches 从 sequenceID 之后开始，依次选出至少 f+1 个节点回复了相同摘要的批次，其中至少有一个正常节点。
+// 遇到没有足够回复的序列号时停止，之后的批次需要等待更多的回复。
+func SelectBatches(sequenceID int64, stateMsgs []*StateMsg, quorum Quorum) []*PrePrepareMsg {
+	// 序列号 -> 摘要 -> 回复了该批次的节点
+	votes := make(map[int64]map[string]map[string]*PrePrepareMsg)
+	for _, stateMsg := range stateMsgs {
+		for _, prePrepareMsg := range stateMsg.CommittedMsgs {
+			if votes[prePrepareMsg.SequenceID] == nil {
+				votes[prePrepareMsg.SequenceID] = make(map[string]map[string]*PrePrepareMsg)
+			}
+			digests := votes[prePrepareMsg.SequenceID]
+			if digests[prePrepareMsg.Digest] == nil {
+				digests[prePrepareMsg.Digest] = make(map[string]*PrePrepareMsg)
+			}
+			digests[prePrepareMsg.Digest][stateMsg.NodeID] = prePrepareMsg
+		}
+	}
+
+	batches := make([]*PrePrepareMsg, 0)
+	for next := sequenceID + 1; ; next++ {
+		var selected *PrePrepareMsg
+		for _, nodes := range votes[next] {
+			if len(nodes) < quorum.Reply() {
+				continue
+			}
+			for _, prePrepareMsg := range nodes {
+				selected = prePrepareMsg
+				break
+			}
+		}
+		if selected == nil {
+			return batches
+		}
+		batches = append(batches, selected)
+	}
+}
+
+// StateView 返回至少 f+1 个节点已经进入的最高视图，回复不足 f+1 个时返回 -1
+func StateView(stateMsgs []*StateMsg, quorum Quorum) int64 {
+	if len(stateMsgs) < quorum.Reply() {
+		return -1
+	}
+	views := make([]int64, 0, len(stateMsgs))
+	for _, stateMsg := range stateMsgs {
+		views = append(views, stateMsg.ViewID)
+	}
+	sort.Slice(views, func(i, j int) bool {
+		return views[i] > views[j]
+	})
+	return views[quorum.F]
+}
@@ -1,12 +1,12 @@
-package consensus
-
-import (
-	"crypto/sha256"
-	"encoding/hex"
-)
-
-func Hash(content []byte) string {
-	h := sha256.New()
-	h.Write(content)
-	return hex.EncodeToString(h.Sum(nil))
+package consensus
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+func Hash(content []byte) string {
+	h := sha256.New()
+	h.Write(content)
+	return hex.EncodeToString(h.Sum(nil))
 }
\ No newline at end of file
@@ -0,0 +1,316 @@
+package consensus
+
+import (
+	"errors"
+	"sort"
+)
+
+// CreateViewChange 根据节点的稳定检查点和已经 prepared 的请求生成 view-change 消息。
+// 只有序列号大于稳定检查点的证明才会被携带，prePrepareMsgs 只在 MACMode 中需要。
+func CreateViewChange(newViewID int64, stable *StableCheckpoint, certs map[int64]*PreparedCert, prePrepareMsgs map[int64]*PrePrepareMsg) *ViewChangeMsg {
+	preparedCerts := make([]*PreparedCert, 0)
+	for sequenceID, cert := range certs {
+		if sequenceID <= stable.SequenceID {
+			continue
+		}
+		preparedCerts = append(preparedCerts, cert)
+	}
+	sort.Slice(preparedCerts, func(i, j int) bool {
+		return preparedCerts[i].PrePrepareMsg.SequenceID < preparedCerts[j].PrePrepareMsg.SequenceID
+	})
+
+	var prePrepared []*PrePrepareMsg
+	for sequenceID, prePrepareMsg := range prePrepareMsgs {
+		if sequenceID <= stable.SequenceID {
+			continue
+		}
+		prePrepared = append(prePrepared, prePrepareMsg)
+	}
+	sort.Slice(prePrepared, func(i, j int) bool {
+		return prePrepared[i].SequenceID < prePrepared[j].SequenceID
+	})
+
+	return &ViewChangeMsg{
+		NewViewID:        newViewID,
+		StableSequenceID: stable.SequenceID,
+		CheckpointMsgs:   stable.CheckpointMsgs,
+		PreparedCerts:    preparedCerts,
+		PrePrepareMsgs:   prePrepared,
+	}
+}
+
+// VerifyViewChange 检查 view-change 消息的签名，以及其中携带的稳定检查点证明和每一个 prepared 证明
+func VerifyViewChange(msg *ViewChangeMsg, keys *KeyRegistry) error {
+	if err := keys.Verify(msg.NodeID, msg); err != nil {
+		return err
+	}
+	if err := VerifyCheckpoint(msg.StableSequenceID, msg.CheckpointMsgs, keys); err != nil {
+		return err
+	}
+	for _, cert := range msg.PreparedCerts {
+		if !cert.verify(keys) {
+			return errors.New("view-change message carries an invalid prepared certificate")
+		}
+		if cert.PrePrepareMsg.ViewID >= msg.NewViewID {
+			return errors.New("view-change message carries a certificate from a future view")
+		}
+		if cert.PrePrepareMsg.SequenceID <= msg.StableSequenceID {
+			return errors.New("view-change message carries a certificate below its stable sequence")
+		}
+	}
+	for _, prePrepareMsg := range msg.PrePrepareMsgs {
+		if !verifyPrePrepare(prePrepareMsg, keys) {
+			return errors.New("view-change message carries an invalid pre-prepare message")
+		}
+		if prePrepareMsg.ViewID >= msg.NewViewID || prePrepareMsg.SequenceID <= msg.StableSequenceID {
+			return errors.New("view-change message carries an unexpected pre-prepare message")
+		}
+	}
+	return nil
+}
+
+// ViewChangeTarget 在收到 f+1 个节点请求切换到比 viewID 更高的视图时，
+// 返回其中最小的视图编号，此时本节点也应当加入视图切换。
+func ViewChangeTarget(msgs map[int64]map[string]*ViewChangeMsg, viewID int64, quorum Quorum) (int64, bool) {
+	nodes := make(map[string]bool)
+	target := int64(-1)
+	for newViewID, viewChangeMsgs := range msgs {
+		if newViewID <= viewID {
+			continue
+		}
+		for nodeID := range viewChangeMsgs {
+			nodes[nodeID] = true
+		}
+		if target == -1 || newViewID < target {
+			target = newViewID
+		}
+	}
+	if len(nodes) < quorum.Reply() {
+		return 0, false
+	}
+	return target, true
+}
+
+// CreateNewView 由新视图的主节点调用，需要至少 2f+1 个（包括自己的）view-change 消息
+func CreateNewView(viewID int64, msgs map[string]*ViewChangeMsg, keys *KeyRegistry) (*NewViewMsg, error) {
+	if len(msgs) < keys.Quorum().Commit() {
+		return nil, errors.New("not enough view-change messages for the new view")
+	}
+
+	viewChangeMsgs := make([]*ViewChangeMsg, 0, len(msgs))
+	for _, msg := range msgs {
+		viewChangeMsgs = append(viewChangeMsgs, msg)
+	}
+	sort.Slice(viewChangeMsgs, func(i, j int) bool {
+		return viewChangeMsgs[i].NodeID < viewChangeMsgs[j].NodeID
+	})
+
+	prePrepareMsgs, err := newViewPrePrepares(viewID, viewChangeMsgs, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	return &NewViewMsg{
+		ViewID:         viewID,
+		ViewChangeMsgs: viewChangeMsgs,
+		PrePrepareMsgs: prePrepareMsgs,
+	}, nil
+}
+
+// VerifyNewView 由备份节点调用，重新计算 new-view 中的 pre-prepare 集合并与主节点给出的进行比较
+func VerifyNewView(msg *NewViewMsg, keys *KeyRegistry) error {
+	if err := keys.Verify(msg.NodeID, msg); err != nil {
+		return err
+	}
+
+	nodes := make(map[string]bool)
+	for _, viewChangeMsg := range msg.ViewChangeMsgs {
+		if viewChangeMsg.NewViewID != msg.ViewID {
+			return errors.New("new-view message contains a view-change message for another view")
+		}
+		if err := VerifyViewChange(viewChangeMsg, keys); err != nil {
+			return err
+		}
+		nodes[viewChangeMsg.NodeID] = true
+	}
+	if len(nodes) < keys.Quorum().Commit() {
+		return errors.New("new-view message does not contain 2f+1 view-change messages")
+	}
+
+	prePrepareMsgs, err := newViewPrePrepares(msg.ViewID, msg.ViewChangeMsgs, keys)
+	if err != nil {
+		return err
+	}
+	if len(prePrepareMsgs) != len(msg.PrePrepareMsgs) {
+		return errors.New("new-view message carries a wrong number of pre-prepare messages")
+	}
+	for i, prePrepareMsg := range prePrepareMsgs {
+		got := msg.PrePrepareMsgs[i]
+		if got.ViewID != prePrepareMsg.ViewID || got.SequenceID != prePrepareMsg.SequenceID || got.Digest != prePrepareMsg.Digest {
+			return errors.New("new-view message carries an unexpected pre-prepare message")
+		}
+		// 重新提议的 pre-prepare 消息需要由新的主节点签名
+		if got.NodeID != msg.NodeID {
+			return errors.New("new-view pre-prepare message is not sent by the new primary")
+		}
+		if !verifyPrePrepare(got, keys) {
+			return errors.New("new-view pre-prepare message is corrupted")
+		}
+	}
+	return nil
+}
+
+// SequenceRange 返回 new-view 消息对应的 min-s 与 max-s
+func (msg *NewViewMsg) SequenceRange() (int64, int64) {
+	if len(msg.PrePrepareMsgs) != 0 {
+		return msg.PrePrepareMsgs[0].SequenceID - 1, msg.PrePrepareMsgs[len(msg.PrePrepareMsgs)-1].SequenceID
+	}
+
+	minSequenceID := int64(-1)
+	for _, viewChangeMsg := range msg.ViewChangeMsgs {
+		if viewChangeMsg.StableSequenceID > minSequenceID {
+			minSequenceID = viewChangeMsg.StableSequenceID
+		}
+	}
+	return minSequenceID, minSequenceID
+}
+
+// newViewPrePrepares 计算论文中的集合 O：
+// 对 min-s 与 max-s 之间的每一个序列号，选择视图最高的 prepared 证明重新提议，没有证明则提议空批次。
+// MACMode 中 prepared 证明无法被其他节点检查，改为使用 selectMAC 的规则。
+func newViewPrePrepares(viewID int64, viewChangeMsgs []*ViewChangeMsg, keys *KeyRegistry) ([]*PrePrepareMsg, error) {
+	minSequenceID := int64(-1)
+	for _, msg := range viewChangeMsgs {
+		if msg.StableSequenceID > minSequenceID {
+			minSequenceID = msg.StableSequenceID
+		}
+	}
+
+	maxSequenceID := minSequenceID
+	selected := make(map[int64]*PrePrepareMsg)
+	for _, msg := range viewChangeMsgs {
+		for _, cert := range msg.PreparedCerts {
+			prePrepareMsg := cert.PrePrepareMsg
+			if prePrepareMsg.SequenceID <= minSequenceID {
+				continue
+			}
+			if prePrepareMsg.SequenceID > maxSequenceID {
+				maxSequenceID = prePrepareMsg.SequenceID
+			}
+			if old, ok := selected[prePrepareMsg.SequenceID]; !ok || old.ViewID < prePrepareMsg.ViewID {
+				selected[prePrepareMsg.SequenceID] = prePrepareMsg
+			}
+		}
+	}
+
+	prePrepareMsgs := make([]*PrePrepareMsg, 0, maxSequenceID-minSequenceID)
+	for sequenceID := minSequenceID + 1; sequenceID <= maxSequenceID; sequenceID++ {
+		requests := make([]*RequestMsg, 0)
+		if keys.Mode == MACMode {
+			var err error
+			requests, err = selectMAC(sequenceID, viewChangeMsgs, keys.Quorum())
+			if err != nil {
+				return nil, err
+			}
+		} else if prePrepareMsg, ok := selected[sequenceID]; ok {
+			requests = prePrepareMsg.RequestMsgs
+		}
+		digest, err := BatchDigest(requests)
+		if err != nil {
+			return nil, err
+		}
+		prePrepareMsgs = append(prePrepareMsgs, &PrePrepareMsg{
+			ViewID:      viewID,
+			SequenceID:  sequenceID,
+			Digest:      digest,
+			RequestMsgs: requests,
+		})
+	}
+	return prePrepareMsgs, nil
+}
+
+// selectMAC 是 MACMode 中为 sequenceID 选择请求的规则，view-change 消息中的证明只是其发送者的声明：
+// A1. 至少 2f+1 个消息在该序列号上没有 prepared 证明，或者证明的视图小于 v，或者与 (v, d) 相同；
+// A2. 至少 f+1 个消息接受过视图不小于 v、摘要为 d 的 pre-prepare 消息。
+// 满足以上两个条件时选择摘要为 d 的批次；否则如果至少 2f+1 个消息没有 prepared 证明，则选择空批次；
+// 两者都不满足时需要等待更多的 view-change 消息。
+func selectMAC(sequenceID int64, viewChangeMsgs []*ViewChangeMsg, quorum Quorum) ([]*RequestMsg, error) {
+	prepared := make(map[string]*PrePrepareMsg)
+	for _, msg := range viewChangeMsgs {
+		for _, cert := range msg.PreparedCerts {
+			if cert.PrePrepareMsg.SequenceID == sequenceID {
+				prepared[msg.NodeID] = cert.PrePrepareMsg
+			}
+		}
+	}
+
+	// 按视图从高到低检查每一个候选请求
+	candidates := make([]*PrePrepareMsg, 0, len(prepared))
+	for _, prePrepareMsg := range prepared {
+		candidates = append(candidates, prePrepareMsg)
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].ViewID != candidates[j].ViewID {
+			return candidates[i].ViewID > candidates[j].ViewID
+		}
+		return candidates[i].Digest < candidates[j].Digest
+	})
+
+	for _, candidate := range candidates {
+		a1, a2 := 0, 0
+		for _, msg := range viewChangeMsgs {
+			cert, ok := prepared[msg.NodeID]
+			if !ok || cert.ViewID < candidate.ViewID || (cert.ViewID == candidate.ViewID && cert.Digest == candidate.Digest) {
+				a1++
+			}
+			for _, prePrepareMsg := range msg.PrePrepareMsgs {
+				if prePrepareMsg.SequenceID == sequenceID && prePrepareMsg.ViewID >= candidate.ViewID && prePrepareMsg.Digest == candidate.Digest {
+					a2++
+					break
+				}
+			}
+		}
+		if a1 >= quorum.Commit() && a2 >= quorum.Reply() {
+			return candidate.RequestMsgs, nil
+		}
+	}
+
+	if len(viewChangeMsgs)-len(prepared) >= quorum.Commit() {
+		return make([]*RequestMsg, 0), nil
+	}
+	return nil, errors.New("not enough view-change messages to decide the request for the new view")
+}
+
+// verifyPrePrepare 检查 pre-prepare 消息中的批次和主节点的签名
+func verifyPrePrepare(prePrepareMsg *PrePrepareMsg, keys *KeyRegistry) bool {
+	if !verifyBatch(prePrepareMsg, keys) {
+		return false
+	}
+	return keys.Verify(prePrepareMsg.NodeID, prePrepareMsg) == nil
+}
+
+// verify 检查证明中是否包含 2f 个与 pre-prepare 匹配、且签名正确的 prepare 消息。
+// MACMode 中 prepare 消息的认证码只有其接收者才能检查，因此只检查 pre-prepare 消息。
+func (cert *PreparedCert) verify(keys *KeyRegistry) bool {
+	prePrepareMsg := cert.PrePrepareMsg
+	if !verifyPrePrepare(prePrepareMsg, keys) {
+		return false
+	}
+	if keys.Mode == MACMode {
+		return true
+	}
+
+	nodes := make(map[string]bool)
+	for _, vote := range cert.PrepareMsgs {
+		if vote.MsgType != PrepareMsg || vote.ViewID != prePrepareMsg.ViewID ||
+			vote.SequenceID != prePrepareMsg.SequenceID || vote.Digest != prePrepareMsg.Digest {
+			continue
+		}
+		// 主节点不参与 prepare 阶段的投票
+		if vote.NodeID == prePrepareMsg.NodeID || keys.Verify(vote.NodeID, vote) != nil {
+			continue
+		}
+		nodes[vote.NodeID] = true
+	}
+	return len(nodes) >= keys.Quorum().Prepare()
+}
@@ -0,0 +1,3 @@
+module goPBFT
+
+go 1.21
@@ -0,0 +1,125 @@
+package kvstore
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// 支持的操作
+const (
+	OpPut    = "PUT"
+	OpGet    = "GET"
+	OpDelete = "DELETE"
+	OpCAS    = "CAS"
+	OpRange  = "RANGE"
+)
+
+// Command 是解析后的操作，RequestMsg.Operation 既可以是文本命令，也可以是 Command 的 JSON 编码：
+//
+//	PUT <key> <value>
+//	GET <key>
+//	DELETE <key>
+//	CAS <key> <expected> <value>
+//	RANGE <start> <end> [limit]
+//
+// 文本命令中 PUT 的 value 为 key 之后的所有内容，其余参数不能包含空白字符。
+// Expected 为 nil 的 CAS 只有在 key 不存在时才会成功，这种情况只能使用 JSON 编码表示。
+// RANGE 返回 [start, end) 中的键值对，end 为空表示没有上界，limit 为 0 表示不限制数量。
+type Command struct {
+	Op       string  `json:"op"`
+	Key      string  `json:"key"`
+	Value    string  `json:"value,omitempty"`
+	Expected *string `json:"expected,omitempty"`
+	End      string  `json:"end,omitempty"`
+	Limit    int     `json:"limit,omitempty"`
+}
+
+// ParseCommand 解析 RequestMsg.Operation
+func ParseCommand(operation string) (*Command, error) {
+	operation = strings.TrimSpace(operation)
+	if strings.HasPrefix(operation, "{") {
+		var command Command
+		if err := json.Unmarshal([]byte(operation), &command); err != nil {
+			return nil, err
+		}
+		command.Op = strings.ToUpper(command.Op)
+		return &command, command.validate()
+	}
+
+	fields := strings.Fields(operation)
+	if len(fields) == 0 {
+		return nil, errors.New("empty command")
+	}
+	command := &Command{Op: strings.ToUpper(fields[0])}
+	args := fields[1:]
+
+	switch command.Op {
+	case OpPut:
+		// value 可以包含空白字符，op 和 key 与其他命令一样按任意空白字符分隔
+		if len(args) < 2 {
+			return nil, errors.New("usage: PUT <key> <value>")
+		}
+		_, rest := cutField(operation)
+		command.Key, command.Value = cutField(rest)
+	case OpGet, OpDelete:
+		if len(args) != 1 {
+			return nil, errors.New("usage: " + command.Op + " <key>")
+		}
+		command.Key = args[0]
+	case OpCAS:
+		if len(args) != 3 {
+			return nil, errors.New("usage: CAS <key> <expected> <value>")
+		}
+		command.Key = args[0]
+		command.Expected = &args[1]
+		command.Value = args[2]
+	case OpRange:
+		if len(args) != 2 && len(args) != 3 {
+			return nil, errors.New("usage: RANGE <start> <end> [limit]")
+		}
+		command.Key = args[0]
+		command.End = args[1]
+		if len(args) == 3 {
+			limit, err := strconv.Atoi(args[2])
+			if err != nil {
+				return nil, errors.New("the limit of RANGE must be an integer")
+			}
+			command.Limit = limit
+		}
+	}
+	return command, command.validate()
+}
+
+// cutField 按与 strings.Fields 相同的空白字符规则取出 s 的第一个字段，以及之后去掉开头空白的内容
+func cutField(s string) (string, string) {
+	s = strings.TrimLeftFunc(s, unicode.IsSpace)
+	end := strings.IndexFunc(s, unicode.IsSpace)
+	if end < 0 {
+		return s, ""
+	}
+	return s[:end], strings.TrimLeftFunc(s[end:], unicode.IsSpace)
+}
+
+// ReadOnly 判断命令是否不会修改状态
+func (command *Command) ReadOnly() bool {
+	return command.Op == OpGet || command.Op == OpRange
+}
+
+func (command *Command) validate() error {
+	switch command.Op {
+	case OpPut, OpGet, OpDelete, OpCAS:
+		if command.Key == "" {
+			return errors.New("the key of " + command.Op + " must not be empty")
+		}
+	case OpRange:
+		if command.Limit < 0 {
+			return errors.New("the limit of RANGE must not be negative")
+		}
+	default:
+		return errors.New("unknown command " + command.Op)
+	}
+	return nil
+}
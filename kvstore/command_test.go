@@ -0,0 +1,37 @@
+package kvstore
+
+import "testing"
+
+func TestParsePutWhitespace(t *testing.T) {
+	tests := []struct {
+		operation string
+		key       string
+		value     string
+	}{
+		{"PUT key value", "key", "value"},
+		{"PUT\tkey\tvalue", "key", "value"},
+		{"PUT   key   value", "key", "value"},
+		{"put \t key \t value", "key", "value"},
+		{"PUT key hello  world", "key", "hello  world"},
+		{"PUT key hello\tworld", "key", "hello\tworld"},
+		{"  PUT key value  ", "key", "value"},
+	}
+	for _, test := range tests {
+		command, err := ParseCommand(test.operation)
+		if err != nil {
+			t.Errorf("ParseCommand(%q): %v", test.operation, err)
+			continue
+		}
+		if command.Op != OpPut || command.Key != test.key || command.Value != test.value {
+			t.Errorf("ParseCommand(%q) = %s %q %q, want PUT %q %q", test.operation, command.Op, command.Key, command.Value, test.key, test.value)
+		}
+	}
+}
+
+func TestParsePutMissingValue(t *testing.T) {
+	for _, operation := range []string{"PUT", "PUT key", "PUT\tkey", "PUT key \t "} {
+		if _, err := ParseCommand(operation); err == nil {
+			t.Errorf("ParseCommand(%q) should fail", operation)
+		}
+	}
+}
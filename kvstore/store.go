@@ -0,0 +1,159 @@
+package kvstore
+
+import (
+	"encoding/json"
+	"errors"
+	"goPBFT/consensus"
+	"sort"
+)
+
+// 执行结果的状态
+const (
+	StatusOK        = "OK"
+	StatusNotFound  = "NOT_FOUND"
+	StatusCASFailed = "CAS_FAILED"
+	StatusError     = "ERROR"
+)
+
+// Result 是命令的执行结果，以 JSON 编码放入 ReplyMsg.Result 中
+type Result struct {
+	Status string `json:"status"`
+	// GET 返回的值，以及 CAS 失败时的当前值
+	Value string `json:"value,omitempty"`
+	// RANGE 返回的键值对，按键的字典序排列
+	Pairs []*Pair `json:"pairs,omitempty"`
+	Error string  `json:"error,omitempty"`
+}
+
+type Pair struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// ParseResult 供客户端解析 ReplyMsg.Result
+func ParseResult(result string) (*Result, error) {
+	var parsed Result
+	if err := json.Unmarshal([]byte(result), &parsed); err != nil {
+		return nil, err
+	}
+	return &parsed, nil
+}
+
+func (result *Result) String() string {
+	jsonResult, err := json.Marshal(result)
+	if err != nil {
+		return ""
+	}
+	return string(jsonResult)
+}
+
+// Store 是内存中的键值存储，实现了 consensus.Application
+type Store struct {
+	Data map[string]string
+}
+
+func NewStore() *Store {
+	return &Store{
+		Data: make(map[string]string),
+	}
+}
+
+// Execute 执行已经提交的命令，无法解析的命令返回 ERROR，而不会影响其他请求
+func (store *Store) Execute(request *consensus.RequestMsg) string {
+	command, err := ParseCommand(request.Operation)
+	if err != nil {
+		return (&Result{Status: StatusError, Error: err.Error()}).String()
+	}
+	return store.Apply(command).String()
+}
+
+// Query 只执行 GET 和 RANGE
+func (store *Store) Query(operation string) (string, error) {
+	command, err := ParseCommand(operation)
+	if err != nil {
+		return "", err
+	}
+	if !command.ReadOnly() {
+		return "", errors.New(command.Op + " is not a read-only command")
+	}
+	return store.Apply(command).String(), nil
+}
+
+// Apply 在存储上执行一个命令
+func (store *Store) Apply(command *Command) *Result {
+	switch command.Op {
+	case OpPut:
+		store.Data[command.Key] = command.Value
+		return &Result{Status: StatusOK}
+	case OpGet:
+		value, ok := store.Data[command.Key]
+		if !ok {
+			return &Result{Status: StatusNotFound}
+		}
+		return &Result{Status: StatusOK, Value: value}
+	case OpDelete:
+		if _, ok := store.Data[command.Key]; !ok {
+			return &Result{Status: StatusNotFound}
+		}
+		delete(store.Data, command.Key)
+		return &Result{Status: StatusOK}
+	case OpCAS:
+		value, ok := store.Data[command.Key]
+		if command.Expected == nil {
+			if ok {
+				return &Result{Status: StatusCASFailed, Value: value}
+			}
+		} else if !ok {
+			return &Result{Status: StatusNotFound}
+		} else if value != *command.Expected {
+			return &Result{Status: StatusCASFailed, Value: value}
+		}
+		store.Data[command.Key] = command.Value
+		return &Result{Status: StatusOK}
+	case OpRange:
+		return &Result{Status: StatusOK, Pairs: store.scan(command.Key, command.End, command.Limit)}
+	}
+	return &Result{Status: StatusError, Error: "unknown command " + command.Op}
+}
+
+// scan 按字典序返回 [start, end) 中的键值对
+func (store *Store) scan(start string, end string, limit int) []*Pair {
+	keys := make([]string, 0)
+	for key := range store.Data {
+		if key >= start && (end == "" || key < end) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	if limit > 0 && len(keys) > limit {
+		keys = keys[:limit]
+	}
+
+	pairs := make([]*Pair, 0, len(keys))
+	for _, key := range keys {
+		pairs = append(pairs, &Pair{key, store.Data[key]})
+	}
+	return pairs
+}
+
+// Snapshot 中 map 的键按字典序编码，所有节点得到的快照完全相同
+func (store *Store) Snapshot() ([]byte, error) {
+	return json.Marshal(store.Data)
+}
+
+func (store *Store) Restore(snapshot []byte) error {
+	data := make(map[string]string)
+	if err := json.Unmarshal(snapshot, &data); err != nil {
+		return err
+	}
+	store.Data = data
+	return nil
+}
+
+func (store *Store) StateDigest() string {
+	snapshot, err := store.Snapshot()
+	if err != nil {
+		return ""
+	}
+	return consensus.Hash(snapshot)
+}
@@ -0,0 +1,215 @@
+package linearizability
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Model 是被检查对象的顺序规约
+type Model interface {
+	// Partition 将历史划分为互不影响的子历史（例如操作不同的键），整个历史可以线性化当且仅当每个子历史都可以线性化
+	Partition(history []*Operation) [][]*Operation
+	Init() interface{}
+	// Step 在状态 state 上执行 operation，返回结果是否与 operation.Output 相符，以及执行之后的状态。
+	// 不能修改 state，未完成的操作的结果可以是任意值。
+	Step(state interface{}, operation *Operation) (bool, interface{})
+	// Key 返回状态的编码，用于记录已经搜索过的状态
+	Key(state interface{}) string
+}
+
+// Result 是检查的结果
+type Result struct {
+	Linearizable bool
+	// 在时限内没有完成搜索，结论未知
+	TimedOut bool
+	// 无法线性化的子历史，以及其中能够线性化的最长的操作序列
+	Partition []*Operation
+	Longest   []*Operation
+}
+
+// Err 在历史无法线性化或者检查超时时返回描述问题的错误
+func (result *Result) Err() error {
+	if result.Linearizable {
+		return nil
+	}
+	if result.TimedOut {
+		return fmt.Errorf("the check timed out on a history of %d operations", len(result.Partition))
+	}
+	linearized := make(map[*Operation]bool)
+	for _, operation := range result.Longest {
+		linearized[operation] = true
+	}
+	// 最长的序列之外最早调用的操作，通常就是出错的地方
+	for _, operation := range result.Partition {
+		if !linearized[operation] {
+			return fmt.Errorf("%d operations are not linearizable, at most %d of them can be ordered, %v cannot be placed after %v",
+				len(result.Partition), len(result.Longest), operation, lastOperation(result.Longest))
+		}
+	}
+	return fmt.Errorf("%d operations are not linearizable", len(result.Partition))
+}
+
+func lastOperation(operations []*Operation) interface{} {
+	if len(operations) == 0 {
+		return "the initial state"
+	}
+	return operations[len(operations)-1]
+}
+
+// Check 检查历史是否可以线性化：存在一个所有操作的顺序，每个操作都在调用和返回之间的某个时刻生效，
+// 并且按照这个顺序在 model 上执行得到的结果与客户端收到的结果相同。
+// 每个子历史使用 Wing & Gong 的回溯搜索，并记录已经搜索过的（已线性化的操作集合，状态），不再重复搜索。
+// timeout 为 0 表示不限制时间。
+func Check(model Model, history []*Operation, timeout time.Duration) *Result {
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	for _, partition := range model.Partition(history) {
+		if result := checkPartition(model, partition, deadline); !result.Linearizable {
+			return result
+		}
+	}
+	return &Result{Linearizable: true}
+}
+
+// entry 是调用或者返回事件，搜索时已经线性化的操作从链表中摘除
+type entry struct {
+	id        int
+	operation *Operation
+	// 调用事件对应的返回事件，返回事件为 nil
+	match *entry
+	prev  *entry
+	next  *entry
+}
+
+// frame 记录线性化一个操作之前的状态，用于回溯
+type frame struct {
+	entry *entry
+	state interface{}
+}
+
+func checkPartition(model Model, history []*Operation, deadline time.Time) *Result {
+	head := buildEntries(history)
+	linearized := make(bitset, (len(history)+7)/8)
+	cache := make(map[string]bool)
+	calls := make([]frame, 0, len(history))
+	longest := make([]*Operation, 0)
+	state := model.Init()
+
+	current := head.next
+	for steps := 0; head.next != nil; steps++ {
+		if !deadline.IsZero() && steps%1024 == 0 && time.Now().After(deadline) {
+			return &Result{TimedOut: true, Partition: history}
+		}
+
+		if current.match != nil {
+			ok, next := model.Step(state, current.operation)
+			if ok {
+				linearized.set(current.id)
+				key := string(linearized) + "\x00" + model.Key(next)
+				if !cache[key] {
+					cache[key] = true
+					calls = append(calls, frame{entry: current, state: state})
+					state = next
+					lift(current)
+					if len(calls) > len(longest) {
+						longest = longest[:0]
+						for _, call := range calls {
+							longest = append(longest, call.entry.operation)
+						}
+					}
+					current = head.next
+					continue
+				}
+				linearized.clear(current.id)
+			}
+			current = current.next
+			continue
+		}
+
+		// 到达一个还没有线性化的操作的返回事件，它必须在此之前生效，只能撤销上一个线性化的操作
+		if len(calls) == 0 {
+			return &Result{Partition: history, Longest: longest}
+		}
+		top := calls[len(calls)-1]
+		calls = calls[:len(calls)-1]
+		state = top.state
+		linearized.clear(top.entry.id)
+		unlift(top.entry)
+		current = top.entry.next
+	}
+	return &Result{Linearizable: true}
+}
+
+// buildEntries 按时间排列所有的调用和返回事件，返回链表的哨兵。
+// 时间相同时调用排在返回之前，即认为两个操作是并发的；未完成的操作的返回事件排在最后。
+func buildEntries(history []*Operation) *entry {
+	type event struct {
+		entry   *entry
+		time    time.Time
+		call    bool
+		pending bool
+	}
+	events := make([]event, 0, 2*len(history))
+	for i, operation := range history {
+		ret := &entry{id: i, operation: operation}
+		call := &entry{id: i, operation: operation, match: ret}
+		events = append(events,
+			event{entry: call, time: operation.Call, call: true},
+			event{entry: ret, time: operation.Return, pending: !operation.Done})
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		a, b := events[i], events[j]
+		if a.pending != b.pending {
+			return b.pending
+		}
+		if !a.time.Equal(b.time) {
+			return a.time.Before(b.time)
+		}
+		return a.call && !b.call
+	})
+
+	head := &entry{id: -1}
+	last := head
+	for _, event := range events {
+		last.next = event.entry
+		event.entry.prev = last
+		last = event.entry
+	}
+	return head
+}
+
+// lift 从链表中摘除调用事件及其返回事件，调用事件之后一定还有事件
+func lift(call *entry) {
+	call.prev.next = call.next
+	call.next.prev = call.prev
+	ret := call.match
+	ret.prev.next = ret.next
+	if ret.next != nil {
+		ret.next.prev = ret.prev
+	}
+}
+
+// unlift 按相反的顺序将 lift 摘除的事件放回原来的位置
+func unlift(call *entry) {
+	ret := call.match
+	ret.prev.next = ret
+	if ret.next != nil {
+		ret.next.prev = ret
+	}
+	call.prev.next = call
+	call.next.prev = call
+}
+
+// bitset 记录已经线性化的操作，每个字节保存 8 个操作，直接作为缓存的键
+type bitset []byte
+
+func (set bitset) set(i int) {
+	set[i/8] |= 1 << uint(i%8)
+}
+
+func (set bitset) clear(i int) {
+	set[i/8] &^= 1 << uint(i%8)
+}
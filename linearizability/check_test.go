@@ -0,0 +1,207 @@
+package linearizability
+
+import (
+	"fmt"
+	"goPBFT/kvstore"
+	"testing"
+	"time"
+)
+
+var start = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// op 返回在 call 和 ret 毫秒之间完成的操作，value 为 GET 读到的值，"-" 表示 NOT_FOUND
+func op(clientID string, input string, value string, call int, ret int) *Operation {
+	result := &kvstore.Result{Status: kvstore.StatusOK, Value: value}
+	if value == "-" {
+		result = &kvstore.Result{Status: kvstore.StatusNotFound}
+	}
+	return &Operation{
+		ClientID: clientID,
+		Input:    input,
+		Output:   result.String(),
+		Call:     start.Add(time.Duration(call) * time.Millisecond),
+		Return:   start.Add(time.Duration(ret) * time.Millisecond),
+		Done:     true,
+	}
+}
+
+// pending 返回在 call 毫秒调用但没有收到回复的操作
+func pending(clientID string, input string, call int) *Operation {
+	return &Operation{ClientID: clientID, Input: input, Call: start.Add(time.Duration(call) * time.Millisecond)}
+}
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		name         string
+		history      []*Operation
+		linearizable bool
+	}{
+		{
+			name:         "empty",
+			linearizable: true,
+		},
+		{
+			name: "sequential",
+			history: []*Operation{
+				op("c1", "PUT a 1", "", 0, 10),
+				op("c2", "GET a", "1", 20, 30),
+				op("c1", "DELETE a", "", 40, 50),
+				op("c2", "GET a", "-", 60, 70),
+			},
+			linearizable: true,
+		},
+		{
+			name: "concurrent read sees the old value",
+			history: []*Operation{
+				op("c1", "PUT a 1", "", 0, 30),
+				op("c2", "GET a", "-", 10, 20),
+			},
+			linearizable: true,
+		},
+		{
+			name: "concurrent read sees the new value",
+			history: []*Operation{
+				op("c1", "PUT a 1", "", 0, 30),
+				op("c2", "GET a", "1", 10, 20),
+			},
+			linearizable: true,
+		},
+		{
+			name: "stale read",
+			history: []*Operation{
+				op("c1", "PUT a 1", "", 0, 10),
+				op("c2", "GET a", "-", 20, 30),
+			},
+		},
+		{
+			name: "value never written",
+			history: []*Operation{
+				op("c1", "PUT a 1", "", 0, 10),
+				op("c2", "GET a", "2", 5, 30),
+			},
+		},
+		{
+			name: "reads go back in time",
+			history: []*Operation{
+				op("c1", "PUT a 1", "", 0, 100),
+				op("c2", "PUT a 2", "", 0, 100),
+				op("c3", "GET a", "2", 110, 120),
+				op("c3", "GET a", "1", 130, 140),
+			},
+		},
+		{
+			name: "keys are independent",
+			history: []*Operation{
+				op("c1", "PUT a 1", "", 0, 10),
+				op("c2", "PUT b 2", "", 0, 10),
+				op("c1", "GET b", "2", 20, 30),
+				op("c2", "GET a", "1", 20, 30),
+			},
+			linearizable: true,
+		},
+		{
+			name: "cas",
+			history: []*Operation{
+				op("c1", "PUT a 1", "", 0, 10),
+				op("c2", "CAS a 1 2", "", 20, 30),
+				op("c1", "GET a", "2", 40, 50),
+			},
+			linearizable: true,
+		},
+		{
+			name: "pending write takes effect",
+			history: []*Operation{
+				pending("c1", "PUT a 1", 0),
+				op("c2", "GET a", "-", 10, 20),
+				op("c2", "GET a", "1", 30, 40),
+			},
+			linearizable: true,
+		},
+		{
+			name: "pending write never takes effect",
+			history: []*Operation{
+				op("c1", "PUT a 1", "", 0, 10),
+				pending("c2", "PUT a 2", 20),
+				op("c1", "GET a", "1", 30, 40),
+			},
+			linearizable: true,
+		},
+		{
+			name: "pending write cannot take effect before its call",
+			history: []*Operation{
+				op("c1", "PUT a 1", "", 0, 10),
+				op("c2", "GET a", "2", 20, 30),
+				pending("c3", "PUT a 2", 40),
+			},
+		},
+		{
+			// 调用与另一个操作的返回时间相同时认为两者是并发的
+			name: "call at the return of a write",
+			history: []*Operation{
+				op("c1", "PUT a 1", "", 0, 10),
+				op("c2", "GET a", "-", 10, 20),
+			},
+			linearizable: true,
+		},
+		{
+			name: "return at the call of a write",
+			history: []*Operation{
+				op("c2", "GET a", "1", 0, 10),
+				op("c1", "PUT a 1", "", 10, 20),
+			},
+			linearizable: true,
+		},
+		{
+			name: "read returns just before the write",
+			history: []*Operation{
+				op("c2", "GET a", "1", 0, 9),
+				op("c1", "PUT a 1", "", 10, 20),
+			},
+		},
+	}
+
+	for _, test := range tests {
+		result := Check(KVModel{}, test.history, 0)
+		if result.Linearizable != test.linearizable || result.TimedOut {
+			t.Errorf("%s: Check = %+v, want linearizable %v", test.name, result, test.linearizable)
+			continue
+		}
+		if test.linearizable {
+			if err := result.Err(); err != nil {
+				t.Errorf("%s: Err = %v", test.name, err)
+			}
+			continue
+		}
+		if result.Err() == nil {
+			t.Errorf("%s: Err = nil for a history that is not linearizable", test.name)
+		}
+		if len(result.Longest) >= len(result.Partition) {
+			t.Errorf("%s: %d of %d operations are linearized", test.name, len(result.Longest), len(result.Partition))
+		}
+	}
+}
+
+func TestCheckTimeout(t *testing.T) {
+	// 所有操作互相并发，没有时限时可以完成搜索
+	history := make([]*Operation, 0)
+	for i := 0; i < 10; i++ {
+		history = append(history, op(fmt.Sprintf("c%d", i), fmt.Sprintf("PUT a %d", i), "", 0, 100))
+	}
+	history = append(history, op("c", "GET a", "10", 110, 120))
+
+	result := Check(KVModel{}, history, 0)
+	if result.Linearizable || result.TimedOut {
+		t.Fatalf("Check = %+v, want not linearizable", result)
+	}
+
+	result = Check(KVModel{}, history, time.Nanosecond)
+	if !result.TimedOut || result.Linearizable {
+		t.Fatalf("Check = %+v, want timed out", result)
+	}
+	if len(result.Partition) != len(history) {
+		t.Errorf("the partition has %d operations, want %d", len(result.Partition), len(history))
+	}
+	if result.Err() == nil {
+		t.Error("Err = nil for a check that timed out")
+	}
+}
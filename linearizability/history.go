@@ -0,0 +1,185 @@
+package linearizability
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 历史中事件的类型
+const (
+	// 客户端开始提交一个操作
+	EventInvoke = "invoke"
+	// 客户端收到 f+1 个相同的回复，Value 为 ReplyMsg.Result
+	EventComplete = "complete"
+)
+
+// Event 是客户端历史中的一个事件，同一个操作的 invoke 和 complete 事件的 ID 相同
+type Event struct {
+	Type     string    `json:"type"`
+	ID       int64     `json:"id"`
+	ClientID string    `json:"client"`
+	Value    string    `json:"value,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+// Operation 是一个操作的调用和返回。没有完成的操作（例如客户端超时或者崩溃）可能已经生效，也可能永远不会生效，
+// 检查时认为它在调用之后的任意时刻生效，并且结果可以是任意值。
+type Operation struct {
+	ClientID string
+	Input    string
+	Output   string
+	Call     time.Time
+	Return   time.Time
+	Done     bool
+}
+
+func (operation *Operation) String() string {
+	if !operation.Done {
+		return fmt.Sprintf("%s %q -> (no reply)", operation.ClientID, operation.Input)
+	}
+	return fmt.Sprintf("%s %q -> %s", operation.ClientID, operation.Input, operation.Output)
+}
+
+// Recorder 记录客户端提交的操作，可以同时被多个客户端使用。
+// path 不为空时事件同时逐行写入文件，进程崩溃之后已经写入的历史仍然可以检查。
+type Recorder struct {
+	mu     sync.Mutex
+	file   *os.File
+	events []*Event
+	nextID int64
+}
+
+// NewRecorder 创建一个记录器，path 为空时只保存在内存中
+func NewRecorder(path string) (*Recorder, error) {
+	recorder := &Recorder{events: make([]*Event, 0)}
+	if path == "" {
+		return recorder, nil
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	recorder.file = file
+	return recorder, nil
+}
+
+// Invoke 记录客户端开始提交 input，返回的 ID 用于记录操作的完成
+func (recorder *Recorder) Invoke(clientID string, input string) int64 {
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	recorder.nextID++
+	recorder.append(&Event{Type: EventInvoke, ID: recorder.nextID, ClientID: clientID, Value: input, Time: time.Now()})
+	return recorder.nextID
+}
+
+// Complete 记录操作 id 返回了 output
+func (recorder *Recorder) Complete(id int64, clientID string, output string) {
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	recorder.append(&Event{Type: EventComplete, ID: id, ClientID: clientID, Value: output, Time: time.Now()})
+}
+
+func (recorder *Recorder) append(event *Event) {
+	recorder.events = append(recorder.events, event)
+	if recorder.file == nil {
+		return
+	}
+	line, err := json.Marshal(event)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if _, err := recorder.file.Write(append(line, '\n')); err != nil {
+		fmt.Println(err)
+	}
+}
+
+// Events 返回到目前为止记录的事件
+func (recorder *Recorder) Events() []*Event {
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	events := make([]*Event, len(recorder.events))
+	copy(events, recorder.events)
+	return events
+}
+
+func (recorder *Recorder) Close() error {
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	if recorder.file == nil {
+		return nil
+	}
+	return recorder.file.Close()
+}
+
+// Load 读取 Recorder 写入的历史文件
+func Load(path string) ([]*Event, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	events, err := readEvents(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return events, nil
+}
+
+func readEvents(reader io.Reader) ([]*Event, error) {
+	events := make([]*Event, 0)
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1<<28)
+	for scanner.Scan() {
+		// 进程崩溃时最后一行可能只写入了一部分
+		event := &Event{}
+		if err := json.Unmarshal(scanner.Bytes(), event); err != nil {
+			continue
+		}
+		events = append(events, event)
+	}
+	return events, scanner.Err()
+}
+
+// Operations 将事件配对为操作，按调用的时间排序。没有 complete 事件的操作为未完成的操作。
+func Operations(events []*Event) ([]*Operation, error) {
+	operations := make([]*Operation, 0)
+	invoked := make(map[int64]*Operation)
+	for _, event := range events {
+		switch event.Type {
+		case EventInvoke:
+			if _, ok := invoked[event.ID]; ok {
+				return nil, fmt.Errorf("operation %d is invoked twice", event.ID)
+			}
+			operation := &Operation{ClientID: event.ClientID, Input: event.Value, Call: event.Time}
+			invoked[event.ID] = operation
+			operations = append(operations, operation)
+		case EventComplete:
+			operation, ok := invoked[event.ID]
+			if !ok {
+				return nil, fmt.Errorf("operation %d completes without being invoked", event.ID)
+			}
+			if operation.Done {
+				return nil, fmt.Errorf("operation %d completes twice", event.ID)
+			}
+			if event.Time.Before(operation.Call) {
+				return nil, fmt.Errorf("operation %d completes before it is invoked", event.ID)
+			}
+			operation.Output = event.Value
+			operation.Return = event.Time
+			operation.Done = true
+		default:
+			return nil, fmt.Errorf("unknown event type %q", event.Type)
+		}
+	}
+	sort.SliceStable(operations, func(i, j int) bool {
+		return operations[i].Call.Before(operations[j].Call)
+	})
+	return operations, nil
+}
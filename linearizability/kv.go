@@ -0,0 +1,126 @@
+package linearizability
+
+import (
+	"encoding/json"
+	"fmt"
+	"goPBFT/kvstore"
+	"math/rand"
+	"sort"
+)
+
+// KVModel 是 kvstore 的顺序规约，直接用 kvstore.Store 计算每个操作应当返回的结果，
+// 因此检查的是 ReplyMsg.Result 与单机顺序执行的结果是否一致。状态为 map[string]string。
+type KVModel struct{}
+
+// Partition 按键划分历史。RANGE 会读取多个键，历史中有 RANGE 时不划分。
+// 无法解析的命令不会修改状态，单独放在一个子历史中。
+func (model KVModel) Partition(history []*Operation) [][]*Operation {
+	keys := make([]string, 0)
+	partitions := make(map[string][]*Operation)
+	invalid := make([]*Operation, 0)
+	for _, operation := range history {
+		command, err := kvstore.ParseCommand(operation.Input)
+		if err != nil {
+			invalid = append(invalid, operation)
+			continue
+		}
+		if command.Op == kvstore.OpRange {
+			return [][]*Operation{history}
+		}
+		if _, ok := partitions[command.Key]; !ok {
+			keys = append(keys, command.Key)
+		}
+		partitions[command.Key] = append(partitions[command.Key], operation)
+	}
+
+	sort.Strings(keys)
+	result := make([][]*Operation, 0, len(keys)+1)
+	for _, key := range keys {
+		result = append(result, partitions[key])
+	}
+	if len(invalid) != 0 {
+		result = append(result, invalid)
+	}
+	return result
+}
+
+func (model KVModel) Init() interface{} {
+	return map[string]string{}
+}
+
+func (model KVModel) Step(state interface{}, operation *Operation) (bool, interface{}) {
+	data := state.(map[string]string)
+	var expected *kvstore.Result
+	command, err := kvstore.ParseCommand(operation.Input)
+	if err != nil {
+		expected = &kvstore.Result{Status: kvstore.StatusError, Error: err.Error()}
+	} else {
+		if !command.ReadOnly() {
+			data = copyData(data)
+		}
+		expected = (&kvstore.Store{Data: data}).Apply(command)
+	}
+	if !operation.Done {
+		return true, data
+	}
+
+	// 重新编码客户端收到的结果，避免空列表和字段顺序之类的差异
+	actual, err := kvstore.ParseResult(operation.Output)
+	if err != nil {
+		return false, data
+	}
+	return actual.String() == expected.String(), data
+}
+
+// Key 中 map 的键按字典序编码
+func (model KVModel) Key(state interface{}) string {
+	key, _ := json.Marshal(state)
+	return string(key)
+}
+
+func copyData(data map[string]string) map[string]string {
+	copied := make(map[string]string, len(data)+1)
+	for key, value := range data {
+		copied[key] = value
+	}
+	return copied
+}
+
+// KVWorkload 随机生成 GET、DELETE、PUT 和 CAS，键的数量越少冲突越多。
+// 每次写入的值都不相同，读到的值可以对应到唯一的写入。不能被多个 goroutine 同时使用。
+type KVWorkload struct {
+	random *rand.Rand
+	keys   int
+	// 每个 key 最近一次生成的写入的值，用作 CAS 的预期值
+	written map[string]string
+}
+
+func NewKVWorkload(random *rand.Rand, keys int) *KVWorkload {
+	if keys < 1 {
+		keys = 1
+	}
+	return &KVWorkload{
+		random:  random,
+		keys:    keys,
+		written: make(map[string]string),
+	}
+}
+
+// Next 生成客户端 clientID 的下一个操作
+func (workload *KVWorkload) Next(clientID string) string {
+	key := fmt.Sprintf("k%d", workload.random.Intn(workload.keys))
+	switch workload.random.Intn(6) {
+	case 0, 1:
+		return fmt.Sprintf("%s %s", kvstore.OpGet, key)
+	case 2:
+		return fmt.Sprintf("%s %s", kvstore.OpDelete, key)
+	}
+
+	value := fmt.Sprintf("%s-%d", clientID, workload.random.Int63())
+	expected, ok := workload.written[key]
+	workload.written[key] = value
+	if workload.random.Intn(3) == 0 && ok {
+		return fmt.Sprintf("%s %s %s %s", kvstore.OpCAS, key, expected, value)
+	}
+	return fmt.Sprintf("%s %s %s", kvstore.OpPut, key, value)
+}
@@ -1,12 +1,740 @@
-package main
-
-import (
-	"PBFT/network"
-	"os"
-)
-
-func main() {
-	nodeID := os.Args[1]
-	server := network.NewServer(nodeID)
-	server.Start()
-}
\ No newline at end of file
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"goPBFT/client"
+	"goPBFT/consensus"
+	"goPBFT/kvstore"
+	"goPBFT/linearizability"
+	"goPBFT/network"
+	"goPBFT/simulation"
+	"goPBFT/trace"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// usage 为 main 的命令行用法，每个命令都可以使用 configFlags 中的参数
+const usage = `usage:
+  go run main.go <NodeID> [flags]                              启动节点
+  go run main.go keygen [flags] [ClientID...]                  为节点列表中的每个节点以及给定的客户端生成密钥
+  go run main.go admin-keygen [flags] <AdminID...>             为管理员生成密钥，管理员可以提交重配置请求
+  go run main.go request [flags] <ClientID> <Operation>        以客户端的身份提交一个请求并输出结果
+  go run main.go reconfig [flags] <AdminID> add <NodeID> <Addr> | remove <NodeID> | rotate <NodeID>
+  go run main.go sim [flags]                                   在虚拟时间中运行确定性模拟，失败的种子可以重放
+  go run main.go trace-check [-ignore NodeID,...] <Dir|File...> 检查节点记录的轨迹是否满足 PBFT 的不变式
+  go run main.go workload [flags] <ClientID...>                多个客户端并发提交随机操作，记录历史并检查线性一致性
+  go run main.go history-check [-check-timeout d] <File>       检查 workload 记录的历史是否可以线性化
+  go run main.go faults [-admin AdminID] show | heal | partition <NodeID,...>... | link <From> <To> [latency=d] [jitter=d] [drop=p]
+                                                               查看或修改节点注入的故障，节点的 admin 地址在配置文件中给出`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Println(usage)
+		os.Exit(2)
+	}
+	command := os.Args[1]
+
+	fs := flag.NewFlagSet(command, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Println(usage)
+		fs.PrintDefaults()
+	}
+	loadConfig := configFlags(fs)
+	var options *simulationOptions
+	if command == "sim" {
+		options = simulationFlags(fs)
+	}
+	var ignore *string
+	if command == "trace-check" {
+		ignore = fs.String("ignore", "", "不参与检查的节点，例如已知的拜占庭节点，多个用逗号分隔")
+	}
+	var workload *workloadOptions
+	if command == "workload" {
+		workload = workloadFlags(fs)
+	}
+	var adminID *string
+	if command == "faults" {
+		adminID = fs.String("admin", "", "使用 TLS 时以该管理员的证书调用节点的管理接口")
+	}
+	var checkTimeout *time.Duration
+	if command == "workload" || command == "history-check" {
+		checkTimeout = fs.Duration("check-timeout", time.Minute, "检查线性一致性的时间上限，超时时结论未知")
+	}
+	fs.Parse(os.Args[2:])
+	args := fs.Args()
+
+	config, err := loadConfig()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	switch command {
+	case "keygen":
+		err = network.GenerateKeys(config.KeyDir, config.NodeIDs())
+		if err == nil {
+			err = network.GenerateClientKeys(config.KeyDir, args)
+		}
+		// 启用 TLS 时同时生成本地 CA 和每个身份的证书
+		if err == nil && config.TLS {
+			err = network.GenerateTLSCertificates(config, args)
+		}
+	case "admin-keygen":
+		err = network.GenerateAdminKeys(config.KeyDir, args)
+		if err == nil && config.TLS {
+			err = network.GenerateTLSCertificates(config, args)
+		}
+	case "request":
+		if len(args) != 2 {
+			fs.Usage()
+			os.Exit(2)
+		}
+		err = sendRequest(config, args[0], args[1])
+	case "reconfig":
+		// 新节点的密钥和轮换的新密钥在本地生成
+		if len(args) < 1 {
+			fs.Usage()
+			os.Exit(2)
+		}
+		var operation string
+		operation, err = reconfigOperation(config, args[1:])
+		if err == nil {
+			err = sendRequest(config, args[0], operation)
+		}
+	case "sim":
+		err = runSimulations(config, options)
+	case "trace-check":
+		if len(args) == 0 {
+			fs.Usage()
+			os.Exit(2)
+		}
+		err = checkTraces(args, *ignore)
+	case "workload":
+		if len(args) == 0 {
+			fs.Usage()
+			os.Exit(2)
+		}
+		err = runWorkload(config, args, workload, *checkTimeout)
+	case "history-check":
+		if len(args) != 1 {
+			fs.Usage()
+			os.Exit(2)
+		}
+		var events []*linearizability.Event
+		events, err = linearizability.Load(args[0])
+		if err == nil {
+			err = checkHistory(events, *checkTimeout)
+		}
+	case "faults":
+		if len(args) == 0 {
+			fs.Usage()
+			os.Exit(2)
+		}
+		err = runFaults(config, *adminID, args)
+	default:
+		config.NodeID = command
+		err = runNode(config)
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+// configFlags 在 fs 中注册配置文件以及覆盖其中各项的参数，返回的函数在解析参数之后读取配置。
+// 只有命令行中给出的参数会覆盖配置文件。
+func configFlags(fs *flag.FlagSet) func() (*network.Config, error) {
+	path := fs.String("config", "", "集群的 JSON 配置文件，为空时使用默认的 4 个本地节点")
+	listen := fs.String("listen", "", "本节点的监听地址，默认为节点列表中的地址")
+	authMode := fs.String("auth", "", "认证方式，signature 或 mac")
+	transport := fs.String("transport", "", "传输方式，http 或 tcp")
+	useTLS := fs.Bool("tls", false, "使用双向认证的 TLS")
+	keyDir := fs.String("keys", "", "密钥目录")
+	dataDir := fs.String("data", "", "数据目录，WAL 保存在其中的 wal 子目录")
+	traceDir := fs.String("trace", "", "记录轨迹的目录，用 trace-check 命令检查")
+	viewChangeTimeout := fs.Duration("view-change-timeout", 0, "备份节点等待请求被提交的时间")
+	stateTransferDelay := fs.Duration("state-transfer-delay", 0, "发现本节点落后之后等待多久再获取状态")
+	batchDelay := fs.Duration("batch-delay", 0, "第一个请求进入批次后最多等待的时间")
+	batchSize := fs.Int("batch-size", 0, "一个批次中最多的请求数量")
+	batchBytes := fs.Int("batch-bytes", 0, "一个批次中请求编码后的最大字节数")
+
+	return func() (*network.Config, error) {
+		config, err := network.LoadConfig(*path)
+		if err != nil {
+			return nil, err
+		}
+		fs.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "listen":
+				config.ListenAddr = *listen
+			case "auth":
+				config.AuthMode = *authMode
+			case "transport":
+				config.Transport = *transport
+			case "tls":
+				config.TLS = *useTLS
+			case "keys":
+				config.KeyDir = *keyDir
+			case "data":
+				config.DataDir = *dataDir
+			case "trace":
+				config.TraceDir = *traceDir
+			case "view-change-timeout":
+				config.ViewChangeTimeout = network.Duration(*viewChangeTimeout)
+			case "state-transfer-delay":
+				config.StateTransferDelay = network.Duration(*stateTransferDelay)
+			case "batch-delay":
+				config.BatchDelay = network.Duration(*batchDelay)
+			case "batch-size":
+				config.MaxBatchSize = *batchSize
+			case "batch-bytes":
+				config.MaxBatchBytes = *batchBytes
+			}
+		})
+		return config, nil
+	}
+}
+
+func runNode(config *network.Config) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	tlsConfig, err := config.LoadTLS(config.NodeID)
+	if err != nil {
+		return err
+	}
+	transport, err := network.NewTransport(config.Transport, config.Listen(), tlsConfig)
+	if err != nil {
+		return err
+	}
+	server, err := network.NewServer(config, kvstore.NewStore(), transport)
+	if err != nil {
+		transport.Close()
+		return err
+	}
+	server.Start()
+	return nil
+}
+
+func sendRequest(config *network.Config, clientID string, operation string) error {
+	privateKey, err := network.LoadClientKey(config.KeyDir, clientID)
+	if err != nil {
+		return err
+	}
+	keys, err := config.LoadPublicKeys()
+	if err != nil {
+		return err
+	}
+
+	tlsConfig, err := config.LoadTLS(clientID)
+	if err != nil {
+		return err
+	}
+	transport, err := network.NewTransport(config.Transport, "localhost:0", tlsConfig)
+	if err != nil {
+		return err
+	}
+	c := client.NewClient(clientID, transport, config.NodeTable(), keys, privateKey)
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+	result, err := c.Submit(ctx, operation)
+	if err != nil {
+		return err
+	}
+	fmt.Println(result)
+	return nil
+}
+
+// reconfigOperation 根据命令行参数构造重配置请求的操作
+func reconfigOperation(config *network.Config, args []string) (string, error) {
+	if len(args) < 2 {
+		return "", errors.New("usage: reconfig <AdminID> add <NodeID> <Addr> | remove <NodeID> | rotate <NodeID>")
+	}
+	nodeID := args[1]
+
+	switch strings.ToUpper(args[0]) {
+	case consensus.ReconfigAdd:
+		if len(args) != 3 {
+			return "", errors.New("usage: reconfig <AdminID> add <NodeID> <Addr>")
+		}
+		if err := network.GenerateNodeKeys(config.KeyDir, nodeID); err != nil {
+			return "", err
+		}
+		if config.TLS {
+			if err := network.GenerateNodeCertificate(config.KeyDir, nodeID, args[2]); err != nil {
+				return "", err
+			}
+		}
+		keys, err := network.LoadPublicKeys(config.KeyDir, []string{nodeID})
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s %s %s %s %x", consensus.ReconfigPrefix, consensus.ReconfigAdd, nodeID, args[2], keys.PublicKeys[nodeID]), nil
+	case consensus.ReconfigRemove:
+		return fmt.Sprintf("%s %s %s", consensus.ReconfigPrefix, consensus.ReconfigRemove, nodeID), nil
+	case consensus.ReconfigRotate:
+		publicKey, err := network.GenerateNextKey(config.KeyDir, nodeID)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s %s %s %x", consensus.ReconfigPrefix, consensus.ReconfigRotate, nodeID, publicKey), nil
+	}
+	return "", errors.New("unknown reconfiguration " + args[0])
+}
+
+// simulationOptions 为 sim 命令的参数
+type simulationOptions struct {
+	seed      *int64
+	runs      *int
+	nodes     *int
+	clients   *int
+	requests  *int
+	keys      *int
+	minDelay  *time.Duration
+	maxDelay  *time.Duration
+	drop      *float64
+	dup       *float64
+	crashes   *string
+	timeout   *time.Duration
+	byzantine *string
+	verbose   *bool
+}
+
+func simulationFlags(fs *flag.FlagSet) *simulationOptions {
+	return &simulationOptions{
+		seed:      fs.Int64("seed", 1, "第一个种子，之后的每次运行种子加一"),
+		runs:      fs.Int("runs", 1, "运行的次数"),
+		nodes:     fs.Int("nodes", 4, "节点数量"),
+		clients:   fs.Int("clients", 3, "客户端数量"),
+		requests:  fs.Int("requests", 20, "每个客户端提交的操作数量"),
+		keys:      fs.Int("key-space", 4, "操作使用的 key 的数量"),
+		minDelay:  fs.Duration("min-delay", time.Millisecond, "消息的最小延迟"),
+		maxDelay:  fs.Duration("max-delay", time.Millisecond*20, "消息的最大延迟"),
+		drop:      fs.Float64("drop", 0, "消息被丢弃的概率"),
+		dup:       fs.Float64("dup", 0, "消息被重复送达的概率"),
+		crashes:   fs.String("crash", "", "节点崩溃的时间，例如 Node0@2s:30s 表示在 2s 崩溃、30s 重启，多个用逗号分隔"),
+		timeout:   fs.Duration("timeout", time.Minute*10, "每次运行的虚拟时间上限"),
+		byzantine: fs.String("byzantine", "", "运行的拜占庭场景，多个用逗号分隔，all 表示所有场景"),
+		verbose:   fs.Bool("v", false, "输出节点的日志"),
+	}
+}
+
+// runSimulations 依次运行每个种子，遇到失败时重放该种子确认结果可以复现，并给出重放的命令。
+// 给出 -byzantine 时对每个拜占庭场景分别运行所有的种子。
+func runSimulations(config *network.Config, options *simulationOptions) error {
+	crashes, err := parseCrashes(*options.crashes)
+	if err != nil {
+		return err
+	}
+	scenarios := []*simulation.Scenario{nil}
+	if *options.byzantine != "" {
+		scenarios, err = simulation.FindScenarios(*options.byzantine)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, scenario := range scenarios {
+		for i := 0; i < *options.runs; i++ {
+			simConfig := &simulation.Config{
+				Seed:     *options.seed + int64(i),
+				Nodes:    *options.nodes,
+				Clients:  *options.clients,
+				Requests: *options.requests,
+				Keys:     *options.keys,
+				Faults: simulation.Faults{
+					MinDelay:      *options.minDelay,
+					MaxDelay:      *options.maxDelay,
+					DropRate:      *options.drop,
+					DuplicateRate: *options.dup,
+				},
+				Crashes: crashes,
+				Timeout: *options.timeout,
+				Node:    config,
+			}
+			name := "seed " + strconv.FormatInt(simConfig.Seed, 10)
+			if scenario != nil {
+				simConfig.Byzantine = scenario.Byzantine
+				if scenario.Nodes != 0 {
+					simConfig.Nodes = scenario.Nodes
+				}
+				name = scenario.Name + " " + name
+			}
+
+			result, err := simulate(simConfig, *options.verbose)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%s: %d operations, %v virtual time, %d events, fingerprint %s\n",
+				name, len(result.Operations), result.Elapsed, result.Events, result.Fingerprint[:16])
+			if result.Violation == nil {
+				continue
+			}
+
+			fmt.Printf("%s failed: %v\n", name, result.Violation)
+			replay, err := simulate(simConfig, *options.verbose)
+			if err != nil {
+				return err
+			}
+			if replay.Fingerprint == result.Fingerprint {
+				fmt.Println("the failure is reproducible, replay it with:")
+			} else {
+				fmt.Println("the replay diverged from the failed run, the simulation is not deterministic:")
+			}
+			fmt.Println("  go run main.go", strings.Join(replayArgs(result.Seed, scenario, os.Args[2:]), " "))
+			return errors.New("the simulation failed")
+		}
+	}
+	return nil
+}
+
+// simulate 运行一次模拟，verbose 为 false 时丢弃节点输出的日志
+func simulate(config *simulation.Config, verbose bool) (*simulation.Result, error) {
+	if verbose {
+		return simulation.Run(config)
+	}
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer devNull.Close()
+	stdout := os.Stdout
+	os.Stdout = devNull
+	defer func() { os.Stdout = stdout }()
+	return simulation.Run(config)
+}
+
+// replayArgs 将命令行参数中的 -seed、-runs 和 -byzantine 替换为只运行失败的种子和场景
+func replayArgs(seed int64, scenario *simulation.Scenario, args []string) []string {
+	replay := []string{"sim", "-seed", strconv.FormatInt(seed, 10)}
+	if scenario != nil {
+		replay = append(replay, "-byzantine", scenario.Name)
+	}
+	for i := 0; i < len(args); i++ {
+		name := strings.TrimLeft(strings.SplitN(args[i], "=", 2)[0], "-")
+		if name == "seed" || name == "runs" || name == "byzantine" {
+			if !strings.Contains(args[i], "=") {
+				i++
+			}
+			continue
+		}
+		replay = append(replay, args[i])
+	}
+	return replay
+}
+
+// parseCrashes 解析 -crash 参数，格式为 NodeID@崩溃时间[:重启时间]
+func parseCrashes(s string) ([]simulation.Crash, error) {
+	crashes := make([]simulation.Crash, 0)
+	if s == "" {
+		return crashes, nil
+	}
+	for _, item := range strings.Split(s, ",") {
+		parts := strings.SplitN(item, "@", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, errors.New("invalid crash " + item)
+		}
+		times := strings.SplitN(parts[1], ":", 2)
+		crash := simulation.Crash{NodeID: parts[0]}
+		at, err := time.ParseDuration(times[0])
+		if err != nil {
+			return nil, err
+		}
+		crash.At = at
+		if len(times) == 2 {
+			restart, err := time.ParseDuration(times[1])
+			if err != nil {
+				return nil, err
+			}
+			if restart <= at {
+				return nil, errors.New("node " + crash.NodeID + " must restart after it crashes")
+			}
+			crash.Restart = restart
+		}
+		crashes = append(crashes, crash)
+	}
+	return crashes, nil
+}
+
+// checkTraces 读取轨迹文件或者目录中所有节点的轨迹并检查
+func checkTraces(paths []string, ignore string) error {
+	events := make([]*trace.Event, 0)
+	for _, path := range paths {
+		var loaded []*trace.Event
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			loaded, err = trace.LoadDir(path)
+		} else {
+			loaded, err = trace.Load(path)
+		}
+		if err != nil {
+			return err
+		}
+		events = append(events, loaded...)
+	}
+
+	ignored := make([]string, 0)
+	if ignore != "" {
+		ignored = strings.Split(ignore, ",")
+	}
+	errs := trace.Check(events, ignored...)
+	for _, err := range errs {
+		fmt.Println(err)
+	}
+	if len(errs) != 0 {
+		return fmt.Errorf("%d violations in %d events", len(errs), len(events))
+	}
+	fmt.Printf("%d events, no violations\n", len(events))
+	return nil
+}
+
+// workloadOptions 为 workload 命令的参数
+type workloadOptions struct {
+	duration *time.Duration
+	keys     *int
+	timeout  *time.Duration
+	history  *string
+}
+
+func workloadFlags(fs *flag.FlagSet) *workloadOptions {
+	return &workloadOptions{
+		duration: fs.Duration("duration", time.Second*30, "提交操作的时间，期间可以杀死主节点或者制造分区"),
+		keys:     fs.Int("key-space", 4, "操作使用的 key 的数量，越少冲突越多"),
+		timeout:  fs.Duration("timeout", time.Second*10, "每个操作等待回复的时间，超时的操作在检查时可能生效也可能没有生效"),
+		history:  fs.String("history", "history.jsonl", "记录历史的文件，可以用 history-check 重新检查"),
+	}
+}
+
+// runWorkload 让每个客户端依次提交随机的操作，结束后检查记录的历史
+func runWorkload(config *network.Config, clientIDs []string, options *workloadOptions, checkTimeout time.Duration) error {
+	keys, err := config.LoadPublicKeys()
+	if err != nil {
+		return err
+	}
+	recorder, err := linearizability.NewRecorder(*options.history)
+	if err != nil {
+		return err
+	}
+	defer recorder.Close()
+
+	clients := make([]*client.Client, 0, len(clientIDs))
+	defer func() {
+		for _, c := range clients {
+			c.Close()
+		}
+	}()
+	for _, clientID := range clientIDs {
+		privateKey, err := network.LoadClientKey(config.KeyDir, clientID)
+		if err != nil {
+			return err
+		}
+		tlsConfig, err := config.LoadTLS(clientID)
+		if err != nil {
+			return err
+		}
+		transport, err := network.NewTransport(config.Transport, "localhost:0", tlsConfig)
+		if err != nil {
+			return err
+		}
+		c := client.NewClient(clientID, transport, config.NodeTable(), keys, privateKey)
+		c.History = recorder
+		clients = append(clients, c)
+	}
+
+	deadline := time.Now().Add(*options.duration)
+	var wg sync.WaitGroup
+	for i, c := range clients {
+		wg.Add(1)
+		go func(i int, c *client.Client) {
+			defer wg.Done()
+			workload := linearizability.NewKVWorkload(rand.New(rand.NewSource(time.Now().UnixNano()+int64(i))), *options.keys)
+			for time.Now().Before(deadline) {
+				ctx, cancel := context.WithTimeout(context.Background(), *options.timeout)
+				_, err := c.Submit(ctx, workload.Next(c.ClientID))
+				cancel()
+				if err != nil {
+					fmt.Printf("%s: %v\n", c.ClientID, err)
+				}
+			}
+		}(i, c)
+	}
+	wg.Wait()
+
+	return checkHistory(recorder.Events(), checkTimeout)
+}
+
+// checkHistory 检查 kvstore 的操作历史是否可以线性化
+func checkHistory(events []*linearizability.Event, timeout time.Duration) error {
+	history, err := linearizability.Operations(events)
+	if err != nil {
+		return err
+	}
+	completed := 0
+	for _, operation := range history {
+		if operation.Done {
+			completed++
+		}
+	}
+	fmt.Printf("%d operations, %d completed, %d without a reply\n", len(history), completed, len(history)-completed)
+
+	if err := linearizability.Check(linearizability.KVModel{}, history, timeout).Err(); err != nil {
+		return err
+	}
+	fmt.Println("the history is linearizable")
+	return nil
+}
+
+// runFaults 对配置文件中每个有 admin 地址的节点执行故障注入的命令：
+//   - show 输出每个节点当前的规则；heal 清除所有规则；
+//   - partition 将节点分为给出的几组，没有列出的节点为另外一组，替换原来的分区；
+//   - link 设置 From 和 To 之间双向的链路故障，* 表示所有节点，不给出故障时恢复这些链路。
+func runFaults(config *network.Config, adminID string, args []string) error {
+	nodeIDs := make([]string, 0)
+	for _, nodeID := range config.NodeIDs() {
+		if config.Nodes[nodeID].Admin != "" {
+			nodeIDs = append(nodeIDs, nodeID)
+		}
+	}
+	if len(nodeIDs) == 0 {
+		return errors.New("no node has an admin address in the config")
+	}
+	if config.TLS && adminID == "" {
+		return errors.New("the admin API uses TLS, give an administrator with -admin")
+	}
+	tlsConfig, err := config.LoadTLS(adminID)
+	if err != nil {
+		return err
+	}
+
+	// update 根据节点当前的规则计算新的规则
+	var update func(nodeID string, rules *network.FaultRules)
+	switch args[0] {
+	case "show", "heal":
+		if len(args) != 1 {
+			return errors.New("usage: faults " + args[0])
+		}
+	case "partition":
+		if len(args) < 2 {
+			return errors.New("usage: faults partition <NodeID,...>...")
+		}
+		partitions := make([][]string, 0, len(args)-1)
+		for _, group := range args[1:] {
+			partitions = append(partitions, strings.Split(group, ","))
+		}
+		if err := (&network.FaultRules{Partitions: partitions}).Validate(); err != nil {
+			return err
+		}
+		update = func(nodeID string, rules *network.FaultRules) {
+			rules.Partitions = partitions
+		}
+	case "link":
+		if len(args) < 3 {
+			return errors.New("usage: faults link <From> <To> [latency=d] [jitter=d] [drop=p]")
+		}
+		link, err := parseLinkFault(args[3:])
+		if err != nil {
+			return err
+		}
+		if link != nil {
+			if err := (&network.FaultRules{Links: map[string]*network.LinkFault{args[2]: link}}).Validate(); err != nil {
+				return err
+			}
+		}
+		from, to := args[1], args[2]
+		update = func(nodeID string, rules *network.FaultRules) {
+			if rules.Links == nil {
+				rules.Links = make(map[string]*network.LinkFault)
+			}
+			if from == network.AnyPeer || from == nodeID {
+				setLink(rules.Links, to, link)
+			}
+			if to == network.AnyPeer || to == nodeID {
+				setLink(rules.Links, from, link)
+			}
+		}
+	default:
+		return errors.New("unknown fault command " + args[0])
+	}
+
+	failed := 0
+	for _, nodeID := range nodeIDs {
+		addr := config.Nodes[nodeID].Admin
+		var rules *network.FaultRules
+		if args[0] == "heal" {
+			rules, err = network.RequestFaults(http.MethodDelete, addr, tlsConfig, nil)
+		} else {
+			rules, err = network.RequestFaults(http.MethodGet, addr, tlsConfig, nil)
+			if err == nil && update != nil {
+				update(nodeID, rules)
+				rules, err = network.RequestFaults(http.MethodPut, addr, tlsConfig, rules)
+			}
+		}
+		if err != nil {
+			fmt.Printf("%s: %v\n", nodeID, err)
+			failed++
+			continue
+		}
+		jsonRules, _ := json.Marshal(rules)
+		fmt.Printf("%s: %s\n", nodeID, jsonRules)
+	}
+	if failed != 0 {
+		return fmt.Errorf("%d of %d nodes failed", failed, len(nodeIDs))
+	}
+	return nil
+}
+
+// parseLinkFault 解析 latency=100ms jitter=20ms drop=0.1 形式的链路故障，没有参数时返回 nil
+func parseLinkFault(args []string) (*network.LinkFault, error) {
+	if len(args) == 0 {
+		return nil, nil
+	}
+	link := &network.LinkFault{}
+	for _, arg := range args {
+		parts := strings.SplitN(arg, "=", 2)
+		if len(parts) != 2 {
+			return nil, errors.New("invalid link fault " + arg)
+		}
+		var err error
+		switch parts[0] {
+		case "latency", "jitter":
+			var duration time.Duration
+			duration, err = time.ParseDuration(parts[1])
+			if parts[0] == "latency" {
+				link.Latency = network.Duration(duration)
+			} else {
+				link.Jitter = network.Duration(duration)
+			}
+		case "drop":
+			link.Drop, err = strconv.ParseFloat(parts[1], 64)
+		default:
+			err = errors.New("unknown link fault " + parts[0])
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return link, nil
+}
+
+// setLink 设置发往 peer 的链路故障，link 为 nil 时删除
+func setLink(links map[string]*network.LinkFault, peer string, link *network.LinkFault) {
+	if link == nil {
+		delete(links, peer)
+		return
+	}
+	links[peer] = link
+}
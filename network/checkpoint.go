@@ -0,0 +1,160 @@
+package network
+
+import (
+	"fmt"
+	"goPBFT/consensus"
+)
+
+// Checkpoint 在提交序列号为 sequenceID 的请求后生成检查点，并广播给其他节点
+func (node *Node) Checkpoint(sequenceID int64) {
+	// 保存检查点处分块的快照，其块数和 Merkle 根构成检查点的摘要。
+	// 检查点成为稳定检查点之后，快照用来压缩 WAL 以及向落后的节点传输状态。
+	snapshot, err := node.snapshot()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	chunks, err := consensus.ChunkSnapshot(snapshot)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	node.Snapshots[sequenceID] = chunks
+
+	checkpointMsg := &consensus.CheckpointMsg{
+		SequenceID: sequenceID,
+		Digest:     chunks.Digest(),
+		NodeID:     node.NodeID,
+	}
+
+	LogStage(fmt.Sprintf("Checkpoint (SequenceID:%d)", sequenceID), false)
+	node.Broadcast(checkpointMsg, "/checkpoint")
+
+	err = node.GetCheckpoint(checkpointMsg)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+func (node *Node) snapshot() (*consensus.Snapshot, error) {
+	app, err := node.App.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	// LastReply 在保存之后不会再被修改，复制 map 即可
+	replies := make(map[string]*consensus.LastReply, len(node.Replies.Replies))
+	for clientID, lastReply := range node.Replies.Replies {
+		replies[clientID] = lastReply
+	}
+	return &consensus.Snapshot{App: app, Replies: replies, Membership: node.Membership}, nil
+}
+
+// restore 将状态机、回复表和副本集合恢复到快照时的状态。检查点处没有尚未生效的重配置。
+func (node *Node) restore(snapshot *consensus.Snapshot) error {
+	if err := node.App.Restore(snapshot.App); err != nil {
+		return err
+	}
+	node.Replies = consensus.CreateReplyTable()
+	for clientID, lastReply := range snapshot.Replies {
+		node.Replies.Replies[clientID] = lastReply
+	}
+
+	node.PendingMembership = nil
+	node.ReconfigID = -1
+	if snapshot.Membership == nil {
+		return nil
+	}
+	return node.setMembership(snapshot.Membership)
+}
+
+// GetCheckpoint 收集 checkpoint 消息，收集到 2f+1 个相同的消息后检查点成为稳定检查点
+func (node *Node) GetCheckpoint(checkpointMsg *consensus.CheckpointMsg) error {
+	LogMsg(checkpointMsg)
+
+	if err := node.Keys.Verify(checkpointMsg.NodeID, checkpointMsg); err != nil {
+		return err
+	}
+	// 已经稳定的检查点不需要再收集
+	if checkpointMsg.SequenceID <= node.StableCheckpoint.SequenceID {
+		return nil
+	}
+
+	// 高水位之上的检查点不加入日志，f+1 个节点都已经到达高水位之上时从其他节点获取状态
+	if !consensus.InWaterMarks(node.StableCheckpoint.SequenceID, checkpointMsg.SequenceID) {
+		if sequenceID, ok := node.Checkpoints.AddAhead(checkpointMsg, node.Keys.Quorum()); ok {
+			node.requestStateTransfer(sequenceID)
+		}
+		return nil
+	}
+
+	stable := node.Checkpoints.Add(checkpointMsg, node.StableCheckpoint.SequenceID, node.Keys.Quorum())
+	if stable == nil {
+		return nil
+	}
+	return node.stabilize(stable)
+}
+
+// stabilize 更新稳定检查点（即低水位），并丢弃检查点之前的共识实例、prepared 证明、pre-prepare 消息、已提交的请求、快照、checkpoint 消息和 WAL 记录
+func (node *Node) stabilize(stable *consensus.StableCheckpoint) error {
+	if stable.SequenceID <= node.StableCheckpoint.SequenceID {
+		return nil
+	}
+	// 本节点还没有执行到该检查点，等执行到之后再丢弃日志；迟迟没有执行到时从其他节点获取状态
+	if stable.SequenceID > node.lastSequenceID() {
+		node.requestStateTransfer(stable.SequenceID)
+		return nil
+	}
+
+	// 截断已经执行的请求
+	commitMsgs := make([]*consensus.RequestMsg, 0)
+	for _, commitMsg := range node.CommitMsgs {
+		if commitMsg.SequenceID > stable.SequenceID {
+			commitMsgs = append(commitMsgs, commitMsg)
+		}
+	}
+	node.CommitMsgs = commitMsgs
+	node.StableCheckpoint = stable
+
+	for sequenceID := range node.PreparedCerts {
+		if sequenceID <= stable.SequenceID {
+			delete(node.PreparedCerts, sequenceID)
+		}
+	}
+	for sequenceID := range node.PrePrepareMsgs {
+		if sequenceID <= stable.SequenceID {
+			delete(node.PrePrepareMsgs, sequenceID)
+		}
+	}
+	for key := range node.States {
+		if key.SequenceID <= stable.SequenceID {
+			delete(node.States, key)
+		}
+	}
+	for sequenceID := range node.CommittedMsgs {
+		if sequenceID <= stable.SequenceID {
+			delete(node.CommittedMsgs, sequenceID)
+		}
+	}
+	for sequenceID := range node.Snapshots {
+		if sequenceID < stable.SequenceID {
+			delete(node.Snapshots, sequenceID)
+		}
+	}
+	node.Checkpoints.Discard(stable.SequenceID)
+
+	// 稳定检查点之前的 WAL 记录由快照代替，快照保存在单独的文件中
+	if snapshot, ok := node.Snapshots[stable.SequenceID]; ok {
+		if err := node.WAL.Compact(stable, snapshot); err != nil {
+			fmt.Println(err)
+		}
+	}
+
+	LogStage(fmt.Sprintf("Checkpoint (SequenceID:%d)", stable.SequenceID), true)
+
+	// 低水位提高之后，可以继续处理超出高水位的信息，主节点也可以继续为 buffer 中的请求分配序列号
+	errs := append(node.resolveFutureMsgs(), node.routeMsgWhenAlarmed()...)
+	for _, err := range errs {
+		fmt.Println(err)
+	}
+	return nil
+}
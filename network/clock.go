@@ -0,0 +1,30 @@
+package network
+
+import (
+	"time"
+)
+
+// Clock 是节点使用的时钟，节点中所有的计时器都通过它创建。
+// 默认为系统时钟，模拟器中替换为虚拟时钟，计时器的回调由模拟器在虚拟时间到达时调用。
+type Clock interface {
+	Now() time.Time
+	// AfterFunc 在 d 之后调用 f，d 为 0 时也不会在 AfterFunc 中直接调用
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer 是 Clock.AfterFunc 返回的计时器
+type Timer interface {
+	// Stop 取消计时器，计时器已经触发或者已经取消时返回 false
+	Stop() bool
+}
+
+// SystemClock 是使用系统时间的时钟，回调在新的 goroutine 中执行
+type SystemClock struct{}
+
+func (SystemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (SystemClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
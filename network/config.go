@@ -0,0 +1,282 @@
+package network
+
+import (
+	"crypto/ed25519"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"goPBFT/consensus"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Config 是节点的配置。集群中的节点共用同一个配置文件，NodeID 以及只属于本节点的设置由命令行参数指定。
+type Config struct {
+	NodeID string `json:"-"`
+	// 监听地址，为空时使用节点列表中的地址，通过重配置加入集群的节点需要指定。
+	// 集群共用的配置文件中通常不写，由 -listen 指定；写在只属于一个节点的配置文件中时与 -listen 相同
+	ListenAddr string `json:"listenAddr,omitempty"`
+
+	AuthMode string                 `json:"authMode"`
+	Nodes    map[string]*NodeConfig `json:"nodes"`
+	// 传输方式，http 或 tcp，集群中的节点和客户端必须相同
+	Transport string `json:"transport"`
+	// 是否使用双向认证的 TLS，证书保存在 KeyDir 的 TLSDir 子目录中
+	TLS bool `json:"tls"`
+	// 密钥目录，以及保存 WAL 的数据目录
+	KeyDir  string `json:"keyDir"`
+	DataDir string `json:"dataDir"`
+	// 保存轨迹的目录，每个节点写入其中的 <NodeID>.trace，为空时不记录轨迹
+	TraceDir string `json:"traceDir,omitempty"`
+
+	ViewChangeTimeout  Duration `json:"viewChangeTimeout"`
+	StateTransferDelay Duration `json:"stateTransferDelay"`
+	BatchDelay         Duration `json:"batchDelay"`
+	MaxBatchSize       int      `json:"maxBatchSize"`
+	MaxBatchBytes      int      `json:"maxBatchBytes"`
+}
+
+// NodeConfig 是节点列表中的一个节点，PublicKey 为十六进制编码的 Ed25519 公钥，为空时从 KeyDir 中读取
+type NodeConfig struct {
+	Addr      string `json:"addr"`
+	PublicKey string `json:"publicKey,omitempty"`
+	// 故障注入管理接口的地址，为空时节点不注入故障
+	Admin string `json:"admin,omitempty"`
+}
+
+// Duration 在配置文件中写作 "10s"、"500ms" 这样的字符串
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	duration, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(duration)
+	return nil
+}
+
+// DefaultConfig 返回默认的配置，即本地的 4 个节点
+func DefaultConfig() *Config {
+	config := &Config{}
+	config.setDefaults()
+	return config
+}
+
+// LoadConfig 读取 JSON 配置文件，文件中没有给出的项使用默认值；path 为空时返回默认的配置
+func LoadConfig(path string) (*Config, error) {
+	if path == "" {
+		return DefaultConfig(), nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	config := &Config{}
+	decoder := json.NewDecoder(file)
+	// 拼错的配置项直接报错，而不是悄悄地使用默认值
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(config); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	config.setDefaults()
+	return config, nil
+}
+
+func (config *Config) setDefaults() {
+	if config.AuthMode == "" {
+		config.AuthMode = consensus.SignatureMode
+	}
+	if config.Transport == "" {
+		config.Transport = HTTPTransportType
+	}
+	if len(config.Nodes) == 0 {
+		config.Nodes = make(map[string]*NodeConfig)
+		for nodeID, addr := range DefaultNodeTable() {
+			config.Nodes[nodeID] = &NodeConfig{Addr: addr}
+		}
+	}
+	if config.KeyDir == "" {
+		config.KeyDir = KeyDir
+	}
+	if config.DataDir == "" {
+		config.DataDir = "."
+	}
+	if config.ViewChangeTimeout == 0 {
+		config.ViewChangeTimeout = Duration(ViewChangeTimeout)
+	}
+	if config.StateTransferDelay == 0 {
+		config.StateTransferDelay = Duration(StateTransferDelay)
+	}
+	if config.BatchDelay == 0 {
+		config.BatchDelay = Duration(consensus.BatchDelay)
+	}
+	if config.MaxBatchSize == 0 {
+		config.MaxBatchSize = consensus.MaxBatchSize
+	}
+	if config.MaxBatchBytes == 0 {
+		config.MaxBatchBytes = consensus.MaxBatchBytes
+	}
+}
+
+// Validate 在节点启动之前检查配置，一次列出所有的错误
+func (config *Config) Validate() error {
+	problems := make([]string, 0)
+	if config.NodeID == "" {
+		problems = append(problems, "the node ID is empty")
+	}
+	if config.AuthMode != consensus.SignatureMode && config.AuthMode != consensus.MACMode {
+		problems = append(problems, "unknown authentication mode "+config.AuthMode)
+	}
+	if config.Transport != HTTPTransportType && config.Transport != TCPTransportType {
+		problems = append(problems, "unknown transport "+config.Transport)
+	}
+
+	addrs := make(map[string]string)
+	for _, nodeID := range config.NodeIDs() {
+		node := config.Nodes[nodeID]
+		if node == nil || node.Addr == "" {
+			problems = append(problems, "node "+nodeID+" has no address")
+			continue
+		}
+		if other, ok := addrs[node.Addr]; ok {
+			problems = append(problems, fmt.Sprintf("nodes %s and %s have the same address %s", other, nodeID, node.Addr))
+		}
+		addrs[node.Addr] = nodeID
+		if node.Admin != "" {
+			if other, ok := addrs[node.Admin]; ok {
+				problems = append(problems, fmt.Sprintf("the admin address of %s is already used by %s", nodeID, other))
+			}
+			if !config.TLS && !isLoopback(node.Admin) {
+				problems = append(problems, "the admin address of "+nodeID+" must be a loopback address without TLS")
+			}
+			addrs[node.Admin] = nodeID
+		}
+		if node.PublicKey != "" {
+			if _, err := decodePublicKey(node.PublicKey); err != nil {
+				problems = append(problems, "node "+nodeID+": "+err.Error())
+			}
+		}
+	}
+	if _, ok := config.Nodes[config.NodeID]; !ok && config.NodeID != "" && config.ListenAddr == "" {
+		problems = append(problems, "node "+config.NodeID+" is not in the node table and needs a listen address")
+	}
+
+	if config.ViewChangeTimeout <= 0 {
+		problems = append(problems, "viewChangeTimeout must be positive")
+	}
+	if config.StateTransferDelay <= 0 {
+		problems = append(problems, "stateTransferDelay must be positive")
+	}
+	if config.BatchDelay <= 0 {
+		problems = append(problems, "batchDelay must be positive")
+	}
+	if config.MaxBatchSize <= 0 {
+		problems = append(problems, "maxBatchSize must be positive")
+	}
+	if config.MaxBatchBytes <= 0 {
+		problems = append(problems, "maxBatchBytes must be positive")
+	}
+	// 一个批次需要放在一条消息中（两种传输都不接受超过 MaxFrameSize 的消息），还要为 pre-prepare 消息中的其他字段和 JSON 编码留出余量
+	if config.MaxBatchBytes > MaxFrameSize/2 {
+		problems = append(problems, fmt.Sprintf("maxBatchBytes must not exceed %d", MaxFrameSize/2))
+	}
+	if info, err := os.Stat(config.KeyDir); err != nil || !info.IsDir() {
+		problems = append(problems, "the key directory "+config.KeyDir+" does not exist")
+	}
+
+	if len(problems) != 0 {
+		return fmt.Errorf("invalid config: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// NodeIDs 返回按字典序排列的节点列表
+func (config *Config) NodeIDs() []string {
+	ids := make([]string, 0, len(config.Nodes))
+	for nodeID := range config.Nodes {
+		ids = append(ids, nodeID)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// NodeTable 返回每个节点的地址
+func (config *Config) NodeTable() map[string]string {
+	nodeTable := make(map[string]string, len(config.Nodes))
+	for nodeID, node := range config.Nodes {
+		nodeTable[nodeID] = node.Addr
+	}
+	return nodeTable
+}
+
+// Listen 返回本节点的监听地址
+func (config *Config) Listen() string {
+	if config.ListenAddr != "" {
+		return config.ListenAddr
+	}
+	if node, ok := config.Nodes[config.NodeID]; ok {
+		return node.Addr
+	}
+	return ""
+}
+
+// LoadTLS 读取 id 的 TLS 证书，没有启用 TLS 时返回 nil
+func (config *Config) LoadTLS(id string) (*tls.Config, error) {
+	if !config.TLS {
+		return nil, nil
+	}
+	return LoadTLSConfig(config.KeyDir, id)
+}
+
+// WALDir 返回保存 WAL 的目录
+func (config *Config) WALDir() string {
+	return filepath.Join(config.DataDir, WALDir)
+}
+
+// LoadPublicKeys 读取每个节点的公钥，配置文件中给出的公钥优先，其余的从 KeyDir 中读取
+func (config *Config) LoadPublicKeys() (*consensus.KeyRegistry, error) {
+	keys := consensus.CreateKeyRegistry("", consensus.SignatureMode)
+	for nodeID, node := range config.Nodes {
+		if node.PublicKey == "" {
+			publicKey, err := readKey(filepath.Join(config.KeyDir, nodeID+".pub"), ed25519.PublicKeySize)
+			if err != nil {
+				return nil, err
+			}
+			keys.PublicKeys[nodeID] = publicKey
+			continue
+		}
+		publicKey, err := decodePublicKey(node.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		keys.PublicKeys[nodeID] = publicKey
+	}
+	return keys, nil
+}
+
+func decodePublicKey(s string) (ed25519.PublicKey, error) {
+	key, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, errors.New("the public key has a wrong size")
+	}
+	return key, nil
+}
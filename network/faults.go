@@ -0,0 +1,305 @@
+package network
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// FaultPath 是故障注入管理接口的路径
+const FaultPath = "/faults"
+
+// AnyPeer 在 FaultRules.Links 中表示所有没有单独设置的链路，包括发给客户端的回复
+const AnyPeer = "*"
+
+// FaultRules 是注入的故障，只作用于本节点发出的消息
+type FaultRules struct {
+	// 分区：每组为一些 NodeID，没有列出的节点组成另外一组，不同组的节点之间的消息全部丢弃。
+	// 客户端不属于任何一组，不受分区的影响。
+	Partitions [][]string `json:"partitions,omitempty"`
+	// 每条链路的故障，键为接收者的 NodeID 或者 AnyPeer
+	Links map[string]*LinkFault `json:"links,omitempty"`
+}
+
+// LinkFault 是一条链路上的故障，每条消息的延迟在 [Latency-Jitter, Latency+Jitter] 中均匀分布
+type LinkFault struct {
+	Latency Duration `json:"latency,omitempty"`
+	Jitter  Duration `json:"jitter,omitempty"`
+	// 丢弃消息的概率
+	Drop float64 `json:"drop,omitempty"`
+}
+
+// Validate 检查规则，每个节点最多属于一个分区
+func (rules *FaultRules) Validate() error {
+	groups := make(map[string]int)
+	for i, group := range rules.Partitions {
+		for _, nodeID := range group {
+			if other, ok := groups[nodeID]; ok && other != i {
+				return errors.New("node " + nodeID + " is in more than one partition")
+			}
+			groups[nodeID] = i
+		}
+	}
+	for peer, link := range rules.Links {
+		if link == nil {
+			return errors.New("the link to " + peer + " has no fault")
+		}
+		if link.Latency < 0 || link.Jitter < 0 {
+			return errors.New("the latency and jitter of the link to " + peer + " must not be negative")
+		}
+		if link.Drop < 0 || link.Drop > 1 {
+			return errors.New("the drop rate of the link to " + peer + " must be between 0 and 1")
+		}
+	}
+	return nil
+}
+
+// partition 返回节点所在的组，没有列出的节点为 -1
+func (rules *FaultRules) partition(nodeID string) int {
+	for i, group := range rules.Partitions {
+		for _, member := range group {
+			if member == nodeID {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// FaultTransport 在 Transport 的发送路径上注入故障，用于在本地集群上演练分区和主节点失效。
+// 收到的消息不受影响，因此对称的分区需要在所有节点上设置同样的规则，只在一部分节点上设置即为单向的分区。
+type FaultTransport struct {
+	Transport
+	nodeID string
+	// 地址对应的 NodeID，不在其中的地址（例如客户端）不属于任何分区
+	peers map[string]string
+
+	mu     sync.Mutex
+	rules  *FaultRules
+	random *rand.Rand
+}
+
+// NewFaultTransport 包装 transport，nodeTable 为节点列表中每个节点的地址，开始时没有任何故障
+func NewFaultTransport(transport Transport, nodeID string, nodeTable map[string]string) *FaultTransport {
+	faultTransport := &FaultTransport{
+		Transport: transport,
+		nodeID:    nodeID,
+		rules:     &FaultRules{},
+		random:    rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	faultTransport.SetNodeTable(nodeTable)
+	return faultTransport
+}
+
+// SetNodeTable 在副本集合变化之后更新地址对应的节点，加入的节点同样受分区和链路规则的影响
+func (transport *FaultTransport) SetNodeTable(nodeTable map[string]string) {
+	peers := make(map[string]string, len(nodeTable))
+	for peerID, addr := range nodeTable {
+		peers[addr] = peerID
+	}
+	transport.mu.Lock()
+	defer transport.mu.Unlock()
+	transport.peers = peers
+}
+
+// Send 丢弃被分区或者随机丢弃的消息，其余的消息在链路的延迟之后发送
+func (transport *FaultTransport) Send(addr string, msg *Message) {
+	delay, ok := transport.fault(addr)
+	if !ok {
+		return
+	}
+	if delay <= 0 {
+		transport.Transport.Send(addr, msg)
+		return
+	}
+	time.AfterFunc(delay, func() {
+		transport.Transport.Send(addr, msg)
+	})
+}
+
+// Broadcast 对每个接收者分别注入故障
+func (transport *FaultTransport) Broadcast(addrs []string, msg *Message) {
+	broadcast(transport, addrs, msg)
+}
+
+// fault 决定发给 addr 的消息是否送出以及延迟多久
+func (transport *FaultTransport) fault(addr string) (time.Duration, bool) {
+	transport.mu.Lock()
+	defer transport.mu.Unlock()
+	rules := transport.rules
+
+	peer, isNode := transport.peers[addr]
+	if isNode && rules.partition(transport.nodeID) != rules.partition(peer) {
+		return 0, false
+	}
+	link, ok := rules.Links[peer]
+	if !isNode || !ok {
+		link = rules.Links[AnyPeer]
+	}
+	if link == nil {
+		return 0, true
+	}
+	if link.Drop > 0 && transport.random.Float64() < link.Drop {
+		return 0, false
+	}
+	delay := time.Duration(link.Latency)
+	if link.Jitter > 0 {
+		delay += time.Duration(transport.random.Int63n(2*int64(link.Jitter)+1)) - time.Duration(link.Jitter)
+	}
+	return delay, true
+}
+
+// Rules 返回当前的规则
+func (transport *FaultTransport) Rules() *FaultRules {
+	transport.mu.Lock()
+	defer transport.mu.Unlock()
+	return transport.rules
+}
+
+// SetRules 替换所有的规则，nil 表示恢复所有的链路
+func (transport *FaultTransport) SetRules(rules *FaultRules) error {
+	if rules == nil {
+		rules = &FaultRules{}
+	}
+	if err := rules.Validate(); err != nil {
+		return err
+	}
+	transport.mu.Lock()
+	defer transport.mu.Unlock()
+	transport.rules = rules
+	fmt.Printf("[Faults] partitions %v, %d link rules\n", rules.Partitions, len(rules.Links))
+	return nil
+}
+
+// ServeAdmin 在 addr 上提供故障注入的管理接口：
+//
+//	GET    /faults  返回当前的规则
+//	PUT    /faults  替换规则，请求体为 FaultRules 的 JSON 编码
+//	DELETE /faults  清除所有规则
+//
+// tlsConfig 不为空时使用双向认证的 TLS，并且只接受在 keyDir 中注册的管理员；不使用 TLS 时没有认证，只能监听本机地址。
+func (transport *FaultTransport) ServeAdmin(addr string, tlsConfig *tls.Config, keyDir string) (*http.Server, error) {
+	if tlsConfig == nil && !isLoopback(addr) {
+		return nil, errors.New("the admin address " + addr + " is not a loopback address and needs TLS")
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(FaultPath, func(w http.ResponseWriter, r *http.Request) {
+		if tlsConfig != nil {
+			if err := checkAdmin(keyDir, peerIdentity(r.TLS)); err != nil {
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			}
+		}
+		transport.serveAdmin(w, r)
+	})
+	server := &http.Server{Handler: mux, ErrorLog: log.New(io.Discard, "", 0)}
+	go server.Serve(listener)
+	return server, nil
+}
+
+func (transport *FaultTransport) serveAdmin(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		rules := &FaultRules{}
+		if err := json.NewDecoder(r.Body).Decode(rules); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := transport.SetRules(rules); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	case http.MethodDelete:
+		transport.SetRules(nil)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(transport.Rules())
+}
+
+// isLoopback 判断 addr 是否只监听本机，主机为空时监听所有的地址
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// checkAdmin 检查证书中的身份是否为注册的管理员，即 AdminKeyDir 中有它的公钥
+func checkAdmin(keyDir string, identity *PeerIdentity) error {
+	if identity == nil {
+		return errors.New("no client certificate")
+	}
+	if _, err := os.Stat(filepath.Join(keyDir, AdminKeyDir, filepath.Base(identity.ID)+".pub")); err != nil {
+		return errors.New(identity.ID + " is not an administrator")
+	}
+	return nil
+}
+
+// RequestFaults 调用节点的故障注入管理接口，method 为 GET、PUT 或 DELETE，只有 PUT 需要 rules，返回节点当前的规则。
+// tlsConfig 为管理员的 TLS 配置，不使用 TLS 时为 nil。
+func RequestFaults(method string, addr string, tlsConfig *tls.Config, rules *FaultRules) (*FaultRules, error) {
+	scheme := "http"
+	client := &http.Client{Timeout: HTTPRequestTimeout}
+	if tlsConfig != nil {
+		scheme = "https"
+		client.Transport = &http.Transport{TLSClientConfig: dialTLSConfig(tlsConfig, addr)}
+	}
+
+	var body []byte
+	if rules != nil {
+		var err error
+		if body, err = json.Marshal(rules); err != nil {
+			return nil, err
+		}
+	}
+	req, err := http.NewRequest(method, scheme+"://"+addr+FaultPath, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	payload, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(string(bytes.TrimSpace(payload)))
+	}
+
+	current := &FaultRules{}
+	if err := json.Unmarshal(payload, current); err != nil {
+		return nil, err
+	}
+	return current, nil
+}
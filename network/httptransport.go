@@ -0,0 +1,133 @@
+package network
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	HTTPMaxIdleConns    = 1024             // 所有地址总共保留的空闲连接
+	HTTPMaxConnsPerHost = 64               // 每个地址最多同时使用的连接，超出的请求等待空闲的连接
+	HTTPRequestTimeout  = time.Second * 10 // 一个请求的超时时间，对方不响应时释放连接
+)
+
+// HTTPTransport 将每条消息作为一个 POST 请求发送到 http://<addr><Path>，使用 TLS 时为 https，
+// 使用自己的 ServeMux，因此同一个进程中可以有多个节点。
+type HTTPTransport struct {
+	addr      string
+	scheme    string
+	client    *http.Client
+	mux       *http.ServeMux
+	server    *http.Server
+	inbox     chan *Message
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewHTTPTransport 在 addr 上开始接收消息，addr 的端口为 0 时由系统分配。tlsConfig 为空时不使用 TLS。
+func NewHTTPTransport(addr string, tlsConfig *tls.Config) (*HTTPTransport, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// 默认每个地址只保留 2 个空闲连接，负载高时其余的连接用完即关闭，
+	// 大量处于 TIME_WAIT 的连接会耗尽文件描述符
+	httpTransport := &http.Transport{
+		MaxIdleConns:        HTTPMaxIdleConns,
+		MaxConnsPerHost:     HTTPMaxConnsPerHost,
+		MaxIdleConnsPerHost: HTTPMaxConnsPerHost,
+		IdleConnTimeout:     PeerIdleTimeout,
+	}
+	scheme := "http"
+	if tlsConfig != nil {
+		// 服务端的证书按请求地址中的主机名检查
+		httpTransport.TLSClientConfig = tlsConfig.Clone()
+		listener = tls.NewListener(listener, tlsConfig)
+		scheme = "https"
+	}
+
+	transport := &HTTPTransport{
+		addr:   listener.Addr().String(),
+		scheme: scheme,
+		client: &http.Client{Transport: httpTransport, Timeout: HTTPRequestTimeout},
+		mux:    http.NewServeMux(),
+		inbox:  make(chan *Message, ReceiveBufferSize),
+		done:   make(chan struct{}),
+	}
+	// 所有的消息都由 receive 处理，其他的路由可以通过 HandleFunc 单独注册
+	transport.mux.HandleFunc("/", transport.receive)
+	transport.server = &http.Server{
+		Handler:     transport.mux,
+		IdleTimeout: PeerIdleTimeout,
+		// 和发送失败一样，连接和握手的错误不输出，被拒绝的连接由对方处理
+		ErrorLog: log.New(io.Discard, "", 0),
+	}
+	go transport.server.Serve(listener)
+
+	return transport, nil
+}
+
+func (transport *HTTPTransport) Addr() string {
+	return transport.addr
+}
+
+func (transport *HTTPTransport) Send(addr string, msg *Message) {
+	go func() {
+		resp, err := transport.client.Post(transport.scheme+"://"+addr+msg.Path, "application/json", bytes.NewReader(msg.Payload))
+		if err != nil {
+			return
+		}
+		// 读完并关闭响应，连接才能被复用
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+}
+
+func (transport *HTTPTransport) Broadcast(addrs []string, msg *Message) {
+	broadcast(transport, addrs, msg)
+}
+
+func (transport *HTTPTransport) Receive() <-chan *Message {
+	return transport.inbox
+}
+
+// HandleFunc 注册不经过 Receive 的路由，例如只读查询
+func (transport *HTTPTransport) HandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	transport.mux.HandleFunc(pattern, handler)
+}
+
+func (transport *HTTPTransport) Close() error {
+	transport.closeOnce.Do(func() {
+		close(transport.done)
+	})
+	return transport.server.Close()
+}
+
+func (transport *HTTPTransport) receive(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// 与 TCP 传输相同，消息不超过 MaxFrameSize，防止对方用过大的请求耗尽内存
+	payload, err := io.ReadAll(http.MaxBytesReader(w, r.Body, MaxFrameSize))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "message too large", http.StatusRequestEntityTooLarge)
+		}
+		return
+	}
+
+	select {
+	case transport.inbox <- &Message{Path: r.URL.Path, Payload: payload, Peer: peerIdentity(r.TLS)}:
+	case <-transport.done:
+	}
+}
@@ -0,0 +1,283 @@
+package network
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"goPBFT/consensus"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// KeyDir 是保存节点密钥的目录，<NodeID>.key 为私钥，<NodeID>.pub 为公钥，
+// <NodeID>-<NodeID>.mac 为两个节点（按字典序）之间的会话密钥。
+// 每个节点只需要自己的私钥、所有节点的公钥以及与自己相关的会话密钥。
+const KeyDir = "keys"
+
+// ClientKeyDir 是 KeyDir 中保存客户端密钥的子目录，其中的每一个 <ClientID>.pub 都是一个已注册的客户端
+const ClientKeyDir = "clients"
+
+// AdminKeyDir 是 KeyDir 中保存管理员密钥的子目录，管理员是可以提交重配置请求的客户端
+const AdminKeyDir = "admins"
+
+// NextKeySuffix 是轮换密钥时新密钥对的后缀，<NodeID>.next.key 在重配置生效时替换 <NodeID>.key
+const NextKeySuffix = ".next"
+
+// SessionKeySize 是 HMAC-SHA256 会话密钥的长度
+const SessionKeySize = 32
+
+// GenerateKeys 为每一个节点生成 Ed25519 密钥对，并为每两个节点生成会话密钥，已经存在的密钥不会被覆盖
+func GenerateKeys(dir string, nodeIDs []string) error {
+	return GenerateKeysFrom(dir, nodeIDs, rand.Reader)
+}
+
+// GenerateKeysFrom 和 GenerateKeys 相同，但从 random 中读取随机数，模拟器用它生成可以重现的密钥
+func GenerateKeysFrom(dir string, nodeIDs []string, random io.Reader) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	for _, nodeID := range nodeIDs {
+		if err := generateKeyPair(dir, nodeID, random); err != nil {
+			return err
+		}
+	}
+
+	for i, nodeID := range nodeIDs {
+		for _, peerID := range nodeIDs[i+1:] {
+			sessionPath := sessionKeyPath(dir, nodeID, peerID)
+			if _, err := os.Stat(sessionPath); err == nil {
+				continue
+			}
+
+			sessionKey := make([]byte, SessionKeySize)
+			if _, err := io.ReadFull(random, sessionKey); err != nil {
+				return err
+			}
+			err := os.WriteFile(sessionPath, []byte(hex.EncodeToString(sessionKey)), 0600)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// GenerateClientKeys 为每一个客户端生成 Ed25519 密钥对，公钥放入 ClientKeyDir 即完成注册
+func GenerateClientKeys(dir string, clientIDs []string) error {
+	return GenerateClientKeysFrom(dir, clientIDs, rand.Reader)
+}
+
+// GenerateClientKeysFrom 和 GenerateClientKeys 相同，但从 random 中读取随机数
+func GenerateClientKeysFrom(dir string, clientIDs []string, random io.Reader) error {
+	clientDir := filepath.Join(dir, ClientKeyDir)
+	if err := os.MkdirAll(clientDir, 0700); err != nil {
+		return err
+	}
+
+	for _, clientID := range clientIDs {
+		if err := generateKeyPair(clientDir, clientID, random); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GenerateAdminKeys 为每一个管理员生成 Ed25519 密钥对，公钥放入 AdminKeyDir 即完成注册
+func GenerateAdminKeys(dir string, adminIDs []string) error {
+	adminDir := filepath.Join(dir, AdminKeyDir)
+	if err := os.MkdirAll(adminDir, 0700); err != nil {
+		return err
+	}
+
+	for _, adminID := range adminIDs {
+		if err := generateKeyPair(adminDir, adminID, rand.Reader); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GenerateNodeKeys 为将要加入集群的节点生成密钥对，以及它与 dir 中每一个已有节点之间的会话密钥
+func GenerateNodeKeys(dir string, nodeID string) error {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.key"))
+	if err != nil {
+		return err
+	}
+	nodeIDs := []string{nodeID}
+	for _, path := range paths {
+		id := strings.TrimSuffix(filepath.Base(path), ".key")
+		// 跳过轮换密钥时生成的 <NodeID>.next.key
+		if id != nodeID && !strings.Contains(id, ".") {
+			nodeIDs = append(nodeIDs, id)
+		}
+	}
+	return GenerateKeys(dir, nodeIDs)
+}
+
+// GenerateNextKey 为节点生成用于轮换的新密钥对并返回新的公钥，已经存在时直接返回
+func GenerateNextKey(dir string, nodeID string) (ed25519.PublicKey, error) {
+	if err := generateKeyPair(dir, nodeID+NextKeySuffix, rand.Reader); err != nil {
+		return nil, err
+	}
+	return readKey(filepath.Join(dir, nodeID+NextKeySuffix+".pub"), ed25519.PublicKeySize)
+}
+
+// PromoteNextKey 在密钥轮换生效时读取节点的新私钥，并用新密钥对替换原来的密钥对
+func PromoteNextKey(dir string, nodeID string) (ed25519.PrivateKey, error) {
+	next := filepath.Join(dir, nodeID+NextKeySuffix)
+	privateKey, err := readKey(next+".key", ed25519.PrivateKeySize)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Rename(next+".pub", filepath.Join(dir, nodeID+".pub")); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(next+".key", filepath.Join(dir, nodeID+".key")); err != nil {
+		return nil, err
+	}
+	return privateKey, nil
+}
+
+// LoadClientKey 读取客户端的私钥，管理员的私钥在 AdminKeyDir 中
+func LoadClientKey(dir string, clientID string) (ed25519.PrivateKey, error) {
+	privateKey, err := readKey(filepath.Join(dir, ClientKeyDir, clientID+".key"), ed25519.PrivateKeySize)
+	if os.IsNotExist(err) {
+		return readKey(filepath.Join(dir, AdminKeyDir, clientID+".key"), ed25519.PrivateKeySize)
+	}
+	return privateKey, err
+}
+
+// LoadKeys 读取本节点的私钥、节点列表中每个节点的公钥以及所有已注册客户端和管理员的公钥，MACMode 中还需要读取会话密钥
+func LoadKeys(config *Config) (*consensus.KeyRegistry, ed25519.PrivateKey, error) {
+	dir, nodeID, mode := config.KeyDir, config.NodeID, config.AuthMode
+	if mode != consensus.SignatureMode && mode != consensus.MACMode {
+		return nil, nil, errors.New("unknown authentication mode " + mode)
+	}
+
+	privateKey, err := readKey(filepath.Join(dir, nodeID+".key"), ed25519.PrivateKeySize)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keys, err := config.LoadPublicKeys()
+	if err != nil {
+		return nil, nil, err
+	}
+	keys.NodeID = nodeID
+	keys.Mode = mode
+
+	// 没有 ClientKeyDir 时不接受任何客户端的请求
+	clientPaths, err := filepath.Glob(filepath.Join(dir, ClientKeyDir, "*.pub"))
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, path := range clientPaths {
+		publicKey, err := readKey(path, ed25519.PublicKeySize)
+		if err != nil {
+			return nil, nil, err
+		}
+		keys.ClientKeys[strings.TrimSuffix(filepath.Base(path), ".pub")] = publicKey
+	}
+
+	// 管理员同样是客户端，另外还可以提交重配置请求
+	adminPaths, err := filepath.Glob(filepath.Join(dir, AdminKeyDir, "*.pub"))
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, path := range adminPaths {
+		publicKey, err := readKey(path, ed25519.PublicKeySize)
+		if err != nil {
+			return nil, nil, err
+		}
+		adminID := strings.TrimSuffix(filepath.Base(path), ".pub")
+		keys.ClientKeys[adminID] = publicKey
+		keys.Admins[adminID] = true
+	}
+
+	if mode != consensus.MACMode {
+		return keys, privateKey, nil
+	}
+
+	for _, id := range config.NodeIDs() {
+		if err := loadSessionKey(dir, keys, id); err != nil {
+			return nil, nil, err
+		}
+	}
+	return keys, privateKey, nil
+}
+
+// loadSessionKey 读取本节点与 peerID 之间的会话密钥，新的节点加入集群时同样需要读取
+func loadSessionKey(dir string, keys *consensus.KeyRegistry, peerID string) error {
+	if peerID == keys.NodeID {
+		// 自己的投票同样需要认证码，该密钥只在本节点内使用
+		sessionKey := make([]byte, SessionKeySize)
+		if _, err := rand.Read(sessionKey); err != nil {
+			return err
+		}
+		keys.SessionKeys[peerID] = sessionKey
+		return nil
+	}
+	sessionKey, err := readKey(sessionKeyPath(dir, keys.NodeID, peerID), SessionKeySize)
+	if err != nil {
+		return err
+	}
+	keys.SessionKeys[peerID] = sessionKey
+	return nil
+}
+
+// generateKeyPair 生成 <id>.key 和 <id>.pub，已经存在的密钥不会被覆盖
+func generateKeyPair(dir string, id string, random io.Reader) error {
+	privatePath := filepath.Join(dir, id+".key")
+	if _, err := os.Stat(privatePath); err == nil {
+		return nil
+	}
+
+	publicKey, privateKey, err := ed25519.GenerateKey(random)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(privatePath, []byte(hex.EncodeToString(privateKey)), 0600)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, id+".pub"), []byte(hex.EncodeToString(publicKey)), 0644)
+}
+
+// LoadPublicKeys 读取 nodeIDs 中每个节点的公钥，客户端用它来检查回复的签名
+func LoadPublicKeys(dir string, nodeIDs []string) (*consensus.KeyRegistry, error) {
+	keys := consensus.CreateKeyRegistry("", consensus.SignatureMode)
+	for _, id := range nodeIDs {
+		publicKey, err := readKey(filepath.Join(dir, id+".pub"), ed25519.PublicKeySize)
+		if err != nil {
+			return nil, err
+		}
+		keys.PublicKeys[id] = publicKey
+	}
+	return keys, nil
+}
+
+func sessionKeyPath(dir string, nodeID string, peerID string) string {
+	if peerID < nodeID {
+		nodeID, peerID = peerID, nodeID
+	}
+	return filepath.Join(dir, nodeID+"-"+peerID+".mac")
+}
+
+func readKey(path string, size int) ([]byte, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(content)))
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != size {
+		return nil, errors.New("the key in " + path + " has a wrong size")
+	}
+	return key, nil
+}
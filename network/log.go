@@ -1,32 +1,51 @@
-package network
-
-import (
-	"goPBFT/consensus"
-	"fmt"
-)
-
-func LogMsg(msg interface{}) {
-	switch msg.(type) {
-	case *consensus.RequestMsg:
-		reqMsg := msg.(*consensus.RequestMsg)
-		fmt.Printf("[REQUEST] ClientID: %s, Timestamp: %d, Operation: %s\n", reqMsg.ClinetID, reqMsg.Timestamp, reqMsg.Operation)
-	case *consensus.PrePrepareMsg:
-		prePrepareMsg := msg.(*consensus.PrePrepareMsg)
-		fmt.Printf("[PREPREPARE] ClientID: %s, Operation: %s, SequenceID: %d\n", prePrepareMsg.RequestMsg.ClinetID, prePrepareMsg.RequestMsg.Operation, prePrepareMsg.SequenceID)
-	case *consensus.VoteMsg:
-		voteMsg := msg.(*consensus.VoteMsg)
-		if voteMsg.MsgType == consensus.PrepareMsg {
-			fmt.Printf("[PREPARE] NodeID: %s\n", voteMsg.NodeID)
-		} else if voteMsg.MsgType == consensus.CommitMsg {
-			fmt.Printf("[COMMIT] NodeID: %s\n", voteMsg.NodeID)
-		}
-	}
-}
-
-func LogStage(stage string, isDone bool) {
-	if isDone {
-		fmt.Printf("[STAGE-DONE] %s\n", stage)
-	} else {
-		fmt.Printf("[STAGE-BEGIN] %s\n", stage)
-	}
-}
\ No newline at end of file
+package network
+
+import (
+	"fmt"
+	"goPBFT/consensus"
+)
+
+func LogMsg(msg interface{}) {
+	switch msg.(type) {
+	case *consensus.RequestMsg:
+		reqMsg := msg.(*consensus.RequestMsg)
+		fmt.Printf("[REQUEST] ClientID: %s, Timestamp: %d, Operation: %s\n", reqMsg.ClinetID, reqMsg.Timestamp, reqMsg.Operation)
+	case *consensus.PrePrepareMsg:
+		prePrepareMsg := msg.(*consensus.PrePrepareMsg)
+		fmt.Printf("[PREPREPARE] SequenceID: %d, Requests: %d\n", prePrepareMsg.SequenceID, len(prePrepareMsg.RequestMsgs))
+	case *consensus.VoteMsg:
+		voteMsg := msg.(*consensus.VoteMsg)
+		if voteMsg.MsgType == consensus.PrepareMsg {
+			fmt.Printf("[PREPARE] NodeID: %s\n", voteMsg.NodeID)
+		} else if voteMsg.MsgType == consensus.CommitMsg {
+			fmt.Printf("[COMMIT] NodeID: %s\n", voteMsg.NodeID)
+		}
+	case *consensus.ViewChangeMsg:
+		viewChangeMsg := msg.(*consensus.ViewChangeMsg)
+		fmt.Printf("[VIEW-CHANGE] NodeID: %s, NewViewID: %d, Prepared: %d\n", viewChangeMsg.NodeID, viewChangeMsg.NewViewID, len(viewChangeMsg.PreparedCerts))
+	case *consensus.CheckpointMsg:
+		checkpointMsg := msg.(*consensus.CheckpointMsg)
+		fmt.Printf("[CHECKPOINT] NodeID: %s, SequenceID: %d\n", checkpointMsg.NodeID, checkpointMsg.SequenceID)
+	case *consensus.FetchStateMsg:
+		fetchStateMsg := msg.(*consensus.FetchStateMsg)
+		fmt.Printf("[FETCH-STATE] NodeID: %s, SequenceID: %d\n", fetchStateMsg.NodeID, fetchStateMsg.SequenceID)
+	case *consensus.StateMsg:
+		stateMsg := msg.(*consensus.StateMsg)
+		checkpointID := int64(-1)
+		if stateMsg.Checkpoint != nil {
+			checkpointID = stateMsg.Checkpoint.SequenceID
+		}
+		fmt.Printf("[STATE] NodeID: %s, Checkpoint: %d, Chunks: %d, Committed: %d\n", stateMsg.NodeID, checkpointID, stateMsg.SnapshotChunks, len(stateMsg.CommittedMsgs))
+	case *consensus.NewViewMsg:
+		newViewMsg := msg.(*consensus.NewViewMsg)
+		fmt.Printf("[NEW-VIEW] NodeID: %s, ViewID: %d, PrePrepare: %d\n", newViewMsg.NodeID, newViewMsg.ViewID, len(newViewMsg.PrePrepareMsgs))
+	}
+}
+
+func LogStage(stage string, isDone bool) {
+	if isDone {
+		fmt.Printf("[STAGE-DONE] %s\n", stage)
+	} else {
+		fmt.Printf("[STAGE-BEGIN] %s\n", stage)
+	}
+}
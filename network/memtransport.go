@@ -0,0 +1,92 @@
+package network
+
+import (
+	"errors"
+	"sync"
+)
+
+// MemoryNetwork 在同一个进程中通过 channel 连接多个 MemoryTransport，用于在一个进程中运行整个集群
+type MemoryNetwork struct {
+	mu        sync.RWMutex
+	endpoints map[string]*MemoryTransport
+}
+
+// MemoryTransport 是 MemoryNetwork 上的一个地址，消息不经过序列化以外的任何编码
+type MemoryTransport struct {
+	addr      string
+	network   *MemoryNetwork
+	inbox     chan *Message
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func NewMemoryNetwork() *MemoryNetwork {
+	return &MemoryNetwork{endpoints: make(map[string]*MemoryTransport)}
+}
+
+// Listen 在 addr 上开始接收消息，addr 可以是任意不重复的字符串
+func (network *MemoryNetwork) Listen(addr string) (*MemoryTransport, error) {
+	network.mu.Lock()
+	defer network.mu.Unlock()
+	if _, ok := network.endpoints[addr]; ok {
+		return nil, errors.New("the address " + addr + " is already in use")
+	}
+
+	transport := &MemoryTransport{
+		addr:    addr,
+		network: network,
+		inbox:   make(chan *Message, ReceiveBufferSize),
+		done:    make(chan struct{}),
+	}
+	network.endpoints[addr] = transport
+	return transport, nil
+}
+
+func (network *MemoryNetwork) endpoint(addr string) *MemoryTransport {
+	network.mu.RLock()
+	defer network.mu.RUnlock()
+	return network.endpoints[addr]
+}
+
+func (transport *MemoryTransport) Addr() string {
+	return transport.addr
+}
+
+func (transport *MemoryTransport) Send(addr string, msg *Message) {
+	to := transport.network.endpoint(addr)
+	// 和网络一样，发给不存在的地址的消息直接丢弃
+	if to == nil {
+		return
+	}
+	// 复制 Payload，接收方不会和发送方共享同一块内存
+	payload := make([]byte, len(msg.Payload))
+	copy(payload, msg.Payload)
+	go to.deliver(&Message{Path: msg.Path, Payload: payload})
+}
+
+func (transport *MemoryTransport) Broadcast(addrs []string, msg *Message) {
+	broadcast(transport, addrs, msg)
+}
+
+func (transport *MemoryTransport) Receive() <-chan *Message {
+	return transport.inbox
+}
+
+func (transport *MemoryTransport) Close() error {
+	transport.closeOnce.Do(func() {
+		transport.network.mu.Lock()
+		if transport.network.endpoints[transport.addr] == transport {
+			delete(transport.network.endpoints, transport.addr)
+		}
+		transport.network.mu.Unlock()
+		close(transport.done)
+	})
+	return nil
+}
+
+func (transport *MemoryTransport) deliver(msg *Message) {
+	select {
+	case transport.inbox <- msg:
+	case <-transport.done:
+	}
+}
@@ -1,517 +1,809 @@
-package network
-
-import (
-	"goPBFT/consensus"
-	"encoding/json"
-	"fmt"
-	"errors"
-	"time"
-)
-
-// 首先对节点进行定义
-type Node struct {
-	NodeID        string
-	NodeTable     map[string]string
-	View          *View
-	CurrentState  *consensus.State
-	CommitMsgs    []*consensus.RequestMsg
-	MsgBuffer     *MsgBuffer
-	MsgEntrance   chan interface{}
-	MsgDelivery   chan interface{}
-	Alarm         chan bool
-}
-// View 定义
-type View struct {
-	ID      int64
-	Primary string
-}
-
-type MsgBuffer struct {
-	ReqMsgs []*consensus.RequestMsg
-	PrePrepareMsgs []*consensus.PrePrepareMsg
-	PrepareMsgs []*consensus.VoteMsg
-	CommitMsgs []*consensus.VoteMsg
-}
-
-func NewNode(nodeID string) *Node {
-	const viewID = 10000000000 // temporary.
-
-	node := &Node {
-		nodeID,
-		map[string]string{
-			"Apple": "localhost:1111",
-			"Ball": "localhost:1112",
-			"Candy": "localhost:1113",
-			"Dog": "localhost:1114",
-		},
-		&View{
-			viewID,
-			Primary: "Apple",
-		},
-		nil,
-		make([]*consensus.RequestMsg, 0),
-		&MsgBuffer{
-			make([]*consensus.RequestMsg, 0),
-			make([]*consensus.PrePrepareMsg, 0),
-			make([]*consensus.VoteMsg, 0),
-			make([]*consensus.VoteMsg, 0),
-		},
-
-		// channels
-		make(chan interface{}),
-		make(chan interface{}),
-		make(chan bool),
-
-	}
-
-	//  Start message dispatcher
-	go node.dispatchMsg()
-
-	// start alarm trigger
-	go node.alarmToDispatcher()
-
-	// start message resolver
-	go node.resolveMsg()
-
-	return node
-}
-
-
-func (node *Node) dispatchMsg() {
-	for {
-		select {
-		case msg := <-node.MsgEntrance:
-			err := node.routeMsg(msg)
-			if err != nil {
-				fmt.Println(err)
-			}
-		case <- node.Alarm:
-			err := node.routeMsgWhenAlarmed()
-			if err != nil {
-				fmt.Println(err)
-			}
-		}
-	}
-}
-
-func (node *Node) routeMsg(msg interface{}) []error {
-	switch msg.(type) {
-	// 当信息状态为*请求信息*时
-	case *consensus.RequestMsg:
-		// 当当前节点状态为 nil 时，需要新建一个信息列表，并将信息拷贝进该切片中
-		if node.CurrentState == nil {
-			// Copy buffered messages first.
-			msgs := make([]*consensus.RequestMsg, len(node.MsgBuffer.ReqMsgs))
-			copy(msgs, node.MsgBuffer.ReqMsgs)
-
-			// copy 之后添加新的信息
-			// Append a newly arrived message.
-			msgs = append(msgs, msg.(*consensus.RequestMsg))
-
-			// 将 buffer 清空
-			// Empty the buffer.
-			node.MsgBuffer.ReqMsgs = make([]*consensus.RequestMsg, 0)
-
-			// 开始发送消息
-			// Send messages.
-			node.MsgDelivery <- msgs
-		} else {
-			// 否则直接添加进 buffer 中
-			node.MsgBuffer.ReqMsgs = append(node.MsgBuffer.ReqMsgs, msg.(*consensus.RequestMsg))
-		}
-	// 当信息状态为*预准备信息*时， 处理方法与前面一直，只不过是放到 PrePrepareMsg 信息列表中
-	case *consensus.PrePrepareMsg:
-		if node.CurrentState == nil {
-			// Copy buffered messages first.
-			msgs := make([]*consensus.PrePrepareMsg, len(node.MsgBuffer.PrePrepareMsgs))
-			copy(msgs, node.MsgBuffer.PrePrepareMsgs)
-
-			// Append a newly arrived message.
-			msgs = append(msgs, msg.(*consensus.PrePrepareMsg))
-
-			// Empty the buffer.
-			node.MsgBuffer.PrePrepareMsgs = make([]*consensus.PrePrepareMsg, 0)
-
-			// Send messages.
-			node.MsgDelivery <- msgs
-		} else {
-			node.MsgBuffer.PrePrepareMsgs = append(node.MsgBuffer.PrePrepareMsgs, msg.(*consensus.PrePrepareMsg))
-		}
-	// 当信息状态为*投票信息*时
-	case *consensus.VoteMsg:
-		// 处理 prepare 阶段的投票信息
-		if msg.(*consensus.VoteMsg).MsgType == consensus.PrepareMsg {
-			// 当当前状态为空或当前阶段不是*预准备结束阶段*，就直接插入信息到 preparemsgs 中
-			if node.CurrentState == nil || node.CurrentState.CurrentStage != consensus.PrePrepared {
-				node.MsgBuffer.PrepareMsgs = append(node.MsgBuffer.PrepareMsgs, msg.(*consensus.VoteMsg))
-			} else {
-				// 否则，新建slice，接收信息，清空buffer，发送信息
-				// Copy buffered messages first.
-				msgs := make([]*consensus.VoteMsg, len(node.MsgBuffer.PrepareMsgs))
-				copy(msgs, node.MsgBuffer.PrepareMsgs)
-
-				// Append a newly arrived message.
-				msgs = append(msgs, msg.(*consensus.VoteMsg))
-
-				// Empty the buffer.
-				node.MsgBuffer.PrepareMsgs = make([]*consensus.VoteMsg, 0)
-
-				// Send messages.
-				node.MsgDelivery <- msgs
-			}
-		// 处理 commit 阶段的投票信息
-		} else if msg.(*consensus.VoteMsg).MsgType == consensus.CommitMsg {
-			// 当当前状态为空或当前阶段不是*准备结束阶段*，就直接插入信息到 preparemsgs 中
-			if node.CurrentState == nil || node.CurrentState.CurrentStage != consensus.Prepared {
-				node.MsgBuffer.CommitMsgs = append(node.MsgBuffer.CommitMsgs, msg.(*consensus.VoteMsg))
-			} else {
-				// 否则，新建slice，接收信息，清空buffer，发送信息
-				// Copy buffered messages first.
-				msgs := make([]*consensus.VoteMsg, len(node.MsgBuffer.CommitMsgs))
-				copy(msgs, node.MsgBuffer.CommitMsgs)
-
-				// Append a newly arrived message.
-				msgs = append(msgs, msg.(*consensus.VoteMsg))
-
-				// Empty the buffer.
-				node.MsgBuffer.CommitMsgs = make([]*consensus.VoteMsg, 0)
-
-				// Send messages.
-				node.MsgDelivery <- msgs
-			}
-		}
-	}
-
-	return nil
-}
-
-func (node *Node) routeMsgWhenAlarmed() []error {
-	if node.CurrentState == nil {
-		// 当 buffer 中有 ReqMsgs 时
-		// Check ReqMsgs, send them.
-		if len(node.MsgBuffer.ReqMsgs) != 0 {
-			msgs := make([]*consensus.RequestMsg, len(node.MsgBuffer.ReqMsgs))
-			copy(msgs, node.MsgBuffer.ReqMsgs)
-			// 发送信息
-			node.MsgDelivery <- msgs
-		}
-		// 当 buffer 中有 PrePrepareMsgs 时
-		// Check PrePrepareMsgs, send them.
-		if len(node.MsgBuffer.PrePrepareMsgs) != 0 {
-			msgs := make([]*consensus.PrePrepareMsg, len(node.MsgBuffer.PrePrepareMsgs))
-			copy(msgs, node.MsgBuffer.PrePrepareMsgs)
-			// 发送信息
-			node.MsgDelivery <- msgs
-		}
-	} else {
-		// 否则，以同样的方式处理 preparemsgs 和 commitmsgs
-		switch node.CurrentState.CurrentStage {
-		case consensus.PrePrepared:
-			// Check PrepareMsgs, send them.
-			if len(node.MsgBuffer.PrepareMsgs) != 0 {
-				msgs := make([]*consensus.VoteMsg, len(node.MsgBuffer.PrepareMsgs))
-				copy(msgs, node.MsgBuffer.PrepareMsgs)
-
-				node.MsgDelivery <- msgs
-			}
-		case consensus.Prepared:
-			// Check CommitMsgs, send them.
-			if len(node.MsgBuffer.CommitMsgs) != 0 {
-				msgs := make([]*consensus.VoteMsg, len(node.MsgBuffer.CommitMsgs))
-				copy(msgs, node.MsgBuffer.CommitMsgs)
-
-				node.MsgDelivery <- msgs
-			}
-		}
-	}
-
-	return nil
-}
-
-func (node *Node) alarmToDispatcher() {
-	for {
-		time.Sleep(ResolvingTimeDuration)
-		node.Alarm <- true
-	}
-}
-
-func (node *Node) resolveMsg() {
-	// 处理的是刚才在 buffer 中保存的信息
-	for {
-		msgs := <- node.MsgDelivery
-		switch msgs.(type) {
-		// 处理 requestMsg
-		case []*consensus.RequestMsg:
-			errs := node.resolveRequestMsg(msgs.([]*consensus.RequestMsg))
-			if len(errs) != 0 {
-				for _, err := range errs {
-					fmt.Println(err)
-				}
-				// TODO: send err to ErrorChannel
-			}
-		case []*consensus.PrePrepareMsg:
-			// 处理 prepreparemsg
-			errs := node.resolvePrePrepareMsg(msgs.([]*consensus.PrePrepareMsg))
-			if len(errs) != 0 {
-				for _, err := range errs {
-					fmt.Println(err)
-				}
-				// TODO: send err to ErrorChannel
-			}
-		case []*consensus.VoteMsg:
-			voteMsgs := msgs.([]*consensus.VoteMsg)
-			if len(voteMsgs) == 0 {
-				break
-			}
-			// 处理投票信息中的 prepareMsg
-			if voteMsgs[0].MsgType == consensus.PrepareMsg {
-				errs := node.resolvePrepareMsg(voteMsgs)
-				if len(errs) != 0 {
-					for _, err := range errs {
-						fmt.Println(err)
-					}
-					// TODO: send err to ErrorChannel
-				}
-			} else if voteMsgs[0].MsgType == consensus.CommitMsg {
-				// 处理投票信息中的 commitMsg
-				errs := node.resolveCommitMsg(voteMsgs)
-				if len(errs) != 0 {
-					for _, err := range errs {
-						fmt.Println(err)
-					}
-					// TODO: send err to ErrorChannel
-				}
-			}
-		}
-	}
-}
-
-func (node *Node) resolveRequestMsg(msgs []*consensus.RequestMsg) []error {
-	errs := make([]error, 0)
-
-	for _, reqMsg := range msgs {
-		err := node.GetReq(reqMsg)
-		if err != nil {
-			errs = append(errs, err)
-		}
-	}
-	if len(errs) != 0 {
-		return errs
-	}
-	return nil
-}
-
-// GetReq can be called when the node's CurrentState is nil.
-// Consensus start procedure for the Primary.
-func (node *Node) GetReq(reqMsg *consensus.RequestMsg) error {
-	LogMsg(reqMsg)
-
-	// 为共识创建一个新状态
-	err := node.createStateForNewConsensus()
-	if err != nil {
-		return err
-	}
-
-	// 开始执行共识
-	prePrepareMsg, err := node.CurrentState.StartConsensus(reqMsg)
-	if err != nil {
-		return nil
-	}
-
-	LogStage(fmt.Sprintf("Consensus Process (ViewID:%d)", node.CurrentState.ViewID), false)
-
-	// 发送 getPrePrepare 信息
-	if prePrepareMsg != nil {
-		node.Broadcast(prePrepareMsg, "/preprepare")
-		LogStage("Pre-prepare", true)
-	}
-	return nil
-}
-
-func (node *Node) resolvePrePrepareMsg(msgs []*consensus.PrePrepareMsg) []error {
-	errs := make([]error, 0)
-
-	for _, reqMsg := range msgs {
-		err := node.GetPrePrepare(reqMsg)
-		if err != nil {
-			errs = append(errs, err)
-		}
-	}
-	if len(errs) != 0 {
-		return errs
-	}
-	return nil
-}
-
-// GetPrePrepare can be called when the node's CurrentState is nil.
-// Consensus start procedure for normal participants.
-func (node *Node) GetPrePrepare(prePrepareMsg *consensus.PrePrepareMsg) error {
-	LogMsg(prePrepareMsg)
-	// Create a new state for the new consensus.
-	err := node.createStateForNewConsensus()
-	if err != nil {
-		return err
-	}
-
-	prePareMsg, err := node.CurrentState.PrePrepare(prePrepareMsg)
-	if err != nil {
-		return err
-	}
-
-	if prePareMsg != nil {
-		// Attach node ID to the message
-		prePareMsg.NodeID = node.NodeID
-
-		LogStage("Pre-prepare", true)
-		node.Broadcast(prePareMsg, "/prepare")
-		LogStage("Prepare", false)
-	}
-	return nil
-}
-
-// 两个是属于同一个类的，因此该函数与后面一个函数参数类型是一样的
-func (node *Node) resolvePrepareMsg(msgs []*consensus.VoteMsg) []error {
-	errs := make([]error, 0)
-
-	// Resolve messages
-	for _, prepareMsg := range msgs {
-		err := node.GetPrepare(prepareMsg)
-		if err != nil {
-			errs = append(errs, err)
-		}
-	}
-
-	if len(errs) != 0 {
-		return errs
-	}
-
-	return nil
-}
-
-func (node *Node) GetPrepare(prepareMsg *consensus.VoteMsg) error {
-	LogMsg(prepareMsg)
-
-	commitMsg, err := node.CurrentState.Prepare(prepareMsg)
-	if err != nil {
-		return err
-	}
-
-	if commitMsg != nil {
-		// Attach node ID to the message
-		commitMsg.NodeID = node.NodeID
-
-		LogStage("Prepare", true)
-		node.Broadcast(commitMsg, "/commit")
-		LogStage("Commit", false)
-	}
-
-	return nil
-}
-
-func (node *Node) resolveCommitMsg(msgs []*consensus.VoteMsg) []error {
-	errs := make([]error, 0)
-
-	// Resolve messages
-	for _, commitMsg := range msgs {
-		err := node.GetCommit(commitMsg)
-		if err != nil {
-			errs = append(errs, err)
-		}
-	}
-
-	if len(errs) != 0 {
-		return errs
-	}
-
-	return nil
-}
-
-func (node *Node) GetCommit(prepareMsg *consensus.VoteMsg) error {
-	LogMsg(prepareMsg)
-	replyMsg, committedMsg, err := node.CurrentState.Commit(prepareMsg)
-	if err != nil {
-		return err
-	}
-
-	if replyMsg != nil {
-		if committedMsg == nil {
-			return errors.New("committed message is nil, even though the reply message is not nil")
-		}
-
-		// Attach node ID to the message
-		replyMsg.NodeID = node.NodeID
-
-		// Save the last version of committed messages to node.
-		node.CommitMsgs = append(node.CommitMsgs, committedMsg)
-
-		LogStage("Commit", true)
-		node.Reply(replyMsg)
-		LogStage("Reply", true)
-	}
-
-	return nil
-}
-
-func (node *Node) GetReply(msg *consensus.ReplyMsg) {
-	fmt.Printf("Result: %s by %s\n", msg.Result, msg.NodeID)
-}
-
-func (node *Node) createStateForNewConsensus() error {
-	// 先检查是否有存在的共识机制
-	if node.CurrentState != nil {
-		return errors.New("another consensus is ongoing")
-	}
-
-	// 获取最后一个序列ID
-	var lastSequenceID int64
-	if len(node.CommitMsgs) == 0 {
-		lastSequenceID = -1
-	} else {
-		lastSequenceID = node.CommitMsgs[len(node.CommitMsgs)-1].SequenceID
-	}
-
-	// 创建一个新的共识
-	node.CurrentState = consensus.CreateState(node.View.ID, lastSequenceID)
-	LogStage("Create the replica status", true)
-
-	return nil
-}
-
-func (node *Node) Reply(msg *consensus.ReplyMsg) error {
-	for _, value := range node.CommitMsgs {
-		fmt.Printf("Committed value: %s, %d, %s, %d", value.ClinetID, value.Timestamp, value.Operation, value.SequenceID)
-	}
-	fmt.Print("\n")
-
-	jsonMsg, err := json.Marshal(msg)
-	if err != nil {
-		return nil
-	}
-	send(node.NodeTable[node.View.Primary]+"/reply", jsonMsg)
-
-	return nil
-}
-
-func (node *Node) Broadcast(msg interface{}, path string) map[string]error {
-	errorMap := make(map[string]error)
-
-	for nodeID, url := range node.NodeTable {
-		if nodeID == node.NodeID {
-			continue
-		}
-
-		jsonMsg, err := json.Marshal(msg)
-		if err != nil {
-			errorMap[nodeID] = err
-			continue
-		}
-
-		send(url + path, jsonMsg)
-	}
-
-	if len(errorMap) == 0 {
-		return nil
-	} else {
-		return errorMap
-	}
-}
\ No newline at end of file
+package network
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"goPBFT/consensus"
+	"goPBFT/trace"
+	"time"
+)
+
+// 首先对节点进行定义
+type Node struct {
+	Config      *Config
+	NodeID      string
+	NodeTable   map[string]string
+	Keys        *consensus.KeyRegistry
+	PrivateKey  ed25519.PrivateKey
+	View        *View
+	States      map[consensus.InstanceKey]*consensus.State
+	CommitMsgs  []*consensus.RequestMsg
+	MsgBuffer   *MsgBuffer
+	MsgEntrance chan interface{}
+	Alarm       chan bool
+	// 节点只通过 Transport 发送消息，收到的消息由 Server 交给 MsgEntrance
+	Transport Transport
+	// 所有的计时器都由 Clock 创建。dispatching 为 true 时计时器产生的信息经过 MsgEntrance，
+	// 否则由驱动节点的调用者（如模拟器）在时钟回调中直接处理
+	Clock       Clock
+	dispatching bool
+
+	// 主节点最后分配的序列号
+	SequenceID int64
+	// 主节点等待打包的批次的计时器
+	BatchTimer Timer
+	// 已经提交的批次，以及最后执行的序列号。
+	// 执行之后的批次保留到稳定检查点，用于状态传输。
+	CommittedMsgs      map[int64]*CommittedMsg
+	ExecutedSequenceID int64
+
+	// 视图切换相关
+	ViewChangeID    int64
+	ViewChangeMsgs  map[int64]map[string]*consensus.ViewChangeMsg
+	PreparedCerts   map[int64]*consensus.PreparedCert
+	PrePrepareMsgs  map[int64]*consensus.PrePrepareMsg
+	PendingReqs     map[string]*consensus.RequestMsg
+	ViewChangeTimer Timer
+
+	// 被复制的状态机，以及每个客户端的最后一个回复
+	App     consensus.Application
+	Replies *consensus.ReplyTable
+
+	// 检查点相关
+	StableCheckpoint *consensus.StableCheckpoint
+	Checkpoints      *consensus.CheckpointLog
+	Snapshots        map[int64]*consensus.SnapshotChunks
+
+	// 状态传输相关，StateTransferID 为已知的、本节点还没有执行到的最高稳定检查点
+	StateTransferID    int64
+	StateTransferTimer Timer
+	StateMsgs          map[string]*consensus.StateMsg
+	SnapshotFetch      *snapshotFetch
+
+	// 预写日志，重启时从中恢复共识状态
+	WAL *WAL
+
+	// 副本集合，NodeTable 和 Keys 中的公钥都由它决定。
+	// 已经执行的重配置保存在 PendingMembership 中，执行到 ReconfigID 处的检查点之后生效。
+	Membership        *consensus.Membership
+	PendingMembership *consensus.Membership
+	ReconfigID        int64
+
+	// 记录收发的消息以及提交、执行等事件的轨迹，没有开启轨迹时为空
+	Trace *trace.Recorder
+}
+
+// View 定义
+type View struct {
+	ID      int64
+	Primary string
+}
+
+// MsgBuffer 保存主节点等待打包或暂时无法分配序列号的请求，以及序列号超出高水位的共识信息
+type MsgBuffer struct {
+	ReqMsgs    []*consensus.RequestMsg
+	FutureMsgs []interface{}
+	// ReqMsgs 编码后的总字节数
+	ReqBytes int
+}
+
+// CommittedMsg 是已经提交的批次，ViewID 为提交时的视图
+type CommittedMsg struct {
+	ViewID        int64
+	PrePrepareMsg *consensus.PrePrepareMsg
+}
+
+// queryMsg 是交给 dispatchMsg 执行的只读请求，结果通过 Result 返回
+type queryMsg struct {
+	Operation string
+	Result    chan queryResult
+}
+
+type queryResult struct {
+	Result string
+	Err    error
+}
+
+// viewChangeAlarm 在请求计时器超时后投递给 dispatchMsg，ViewID 为计时器开启时所等待的视图
+type viewChangeAlarm struct {
+	ViewID int64
+}
+
+// batchAlarm 在批次等待 Config.BatchDelay 之后投递给 dispatchMsg
+type batchAlarm struct{}
+
+const (
+	ResolvingTimeDuration = time.Millisecond * 1000 // 定时处理 buffer 中信息的间隔
+	ViewChangeTimeout     = time.Second * 10        // 备份节点等待请求被提交的默认时间，可以在配置文件中修改
+	MaxFutureMsgs         = 4096                    // 超出高水位的信息最多缓存的数量
+)
+
+var (
+	errStaleSequence      = errors.New("the sequence number is below the low water mark")
+	errAboveHighWaterMark = errors.New("the sequence number is above the high water mark")
+	errAwaitReconfig      = errors.New("the sequence number is beyond a pending reconfiguration")
+)
+
+// DefaultNodeTable 返回没有配置文件时默认的节点列表
+func DefaultNodeTable() map[string]string {
+	return map[string]string{
+		"Apple": "localhost:1111",
+		"Ball":  "localhost:1112",
+		"Candy": "localhost:1113",
+		"Dog":   "localhost:1114",
+	}
+}
+
+// config 需要先经过 Validate 检查，其中的认证方式和节点列表在集群中所有节点必须相同
+func NewNode(config *Config, app consensus.Application, transport Transport) (*Node, error) {
+	node, err := CreateNode(config, app, transport, SystemClock{})
+	if err != nil {
+		return nil, err
+	}
+	node.Start()
+	return node, nil
+}
+
+// CreateNode 创建节点并从 WAL 中恢复，但不启动任何 goroutine。
+// 调用者通过 Step 和 Resolve 依次交给节点处理信息，并保证它们不会和 clock 的回调同时执行。
+func CreateNode(config *Config, app consensus.Application, transport Transport, clock Clock) (*Node, error) {
+	nodeID := config.NodeID
+	node := &Node{
+		Config:     config,
+		NodeID:     nodeID,
+		NodeTable:  config.NodeTable(),
+		States:     make(map[consensus.InstanceKey]*consensus.State),
+		CommitMsgs: make([]*consensus.RequestMsg, 0),
+		MsgBuffer: &MsgBuffer{
+			make([]*consensus.RequestMsg, 0),
+			make([]interface{}, 0),
+			0,
+		},
+
+		// channels
+		MsgEntrance: make(chan interface{}),
+		Alarm:       make(chan bool),
+		Transport:   transport,
+		Clock:       clock,
+
+		SequenceID:         -1,
+		CommittedMsgs:      make(map[int64]*CommittedMsg),
+		ExecutedSequenceID: -1,
+
+		ViewChangeMsgs: make(map[int64]map[string]*consensus.ViewChangeMsg),
+		PreparedCerts:  make(map[int64]*consensus.PreparedCert),
+		PrePrepareMsgs: make(map[int64]*consensus.PrePrepareMsg),
+		PendingReqs:    make(map[string]*consensus.RequestMsg),
+
+		App:     app,
+		Replies: consensus.CreateReplyTable(),
+
+		StableCheckpoint: consensus.GenesisCheckpoint(),
+		Checkpoints:      consensus.CreateCheckpointLog(),
+		Snapshots:        make(map[int64]*consensus.SnapshotChunks),
+		StateTransferID:  -1,
+		ReconfigID:       -1,
+	}
+
+	// 视图从 0 开始，主节点由 p = v mod |R| 决定
+	node.View = &View{
+		ID:      0,
+		Primary: node.primaryOf(0),
+	}
+	node.ViewChangeID = node.View.ID
+
+	// 读取本节点的私钥以及所有节点的公钥
+	keys, privateKey, err := LoadKeys(config)
+	if err != nil {
+		return nil, err
+	}
+	node.Keys = keys
+	node.PrivateKey = privateKey
+	node.Membership = consensus.NewMembership(node.NodeTable, keys.PublicKeys)
+
+	// 轨迹在恢复之前打开，从 WAL 中恢复时的执行同样被记录
+	if config.TraceDir != "" {
+		recorder, err := trace.Open(config.TraceDir, nodeID)
+		if err != nil {
+			return nil, err
+		}
+		node.Trace = recorder
+	}
+	node.record(&trace.Event{Type: trace.EventStart})
+
+	// 从 WAL 中恢复重启之前的共识状态
+	wal, records, err := OpenWAL(config.WALDir(), nodeID)
+	if err != nil {
+		return nil, err
+	}
+	node.WAL = wal
+	if err := node.replay(records); err != nil {
+		return nil, err
+	}
+	node.record(&trace.Event{Type: trace.EventView, View: node.View.ID})
+
+	return node, nil
+}
+
+// Start 启动 dispatchMsg，之后所有信息都必须经过 MsgEntrance
+func (node *Node) Start() {
+	node.dispatching = true
+
+	//  Start message dispatcher
+	go node.dispatchMsg()
+
+	// start alarm trigger
+	go node.alarmToDispatcher()
+}
+
+// dispatchMsg 是节点唯一修改共识状态的 goroutine，所有信息都在这里依次处理
+func (node *Node) dispatchMsg() {
+	for {
+		select {
+		case msg := <-node.MsgEntrance:
+			node.Step(msg)
+		case <-node.Alarm:
+			node.Resolve()
+		}
+	}
+}
+
+// Step 处理一条信息
+func (node *Node) Step(msg interface{}) {
+	node.record(trace.MessageEvent(trace.EventReceive, trace.Sender(msg), msg))
+	errs := node.routeMsg(msg)
+	for _, err := range errs {
+		fmt.Println(err)
+	}
+}
+
+// Resolve 处理 buffer 中等待分配序列号的请求，由 alarmToDispatcher 每隔 ResolvingTimeDuration 触发一次
+func (node *Node) Resolve() {
+	errs := node.routeMsgWhenAlarmed()
+	for _, err := range errs {
+		fmt.Println(err)
+	}
+}
+
+// post 将计时器产生的信息交给节点处理
+func (node *Node) post(msg interface{}) {
+	if node.dispatching {
+		node.MsgEntrance <- msg
+		return
+	}
+	node.Step(msg)
+}
+
+func (node *Node) routeMsg(msg interface{}) []error {
+	var err error
+
+	switch msg.(type) {
+	// 当信息状态为*请求信息*时
+	case *consensus.RequestMsg:
+		err = node.GetReq(msg.(*consensus.RequestMsg))
+	// 当信息状态为*预准备信息*时
+	case *consensus.PrePrepareMsg:
+		err = node.GetPrePrepare(msg.(*consensus.PrePrepareMsg))
+	// 当信息状态为*投票信息*时
+	case *consensus.VoteMsg:
+		voteMsg := msg.(*consensus.VoteMsg)
+		if voteMsg.MsgType == consensus.PrepareMsg {
+			// 处理 prepare 阶段的投票信息
+			err = node.GetPrepare(voteMsg)
+		} else if voteMsg.MsgType == consensus.CommitMsg {
+			// 处理 commit 阶段的投票信息
+			err = node.GetCommit(voteMsg)
+		}
+	// 处理视图切换信息
+	case *consensus.ViewChangeMsg:
+		err = node.GetViewChange(msg.(*consensus.ViewChangeMsg))
+	case *consensus.NewViewMsg:
+		err = node.GetNewView(msg.(*consensus.NewViewMsg))
+	case *viewChangeAlarm:
+		err = node.resolveViewChangeAlarm(msg.(*viewChangeAlarm))
+	case *batchAlarm:
+		node.BatchTimer = nil
+		err = node.proposeBatches()
+	// 处理只读请求
+	case *queryMsg:
+		node.resolveQuery(msg.(*queryMsg))
+	// 处理检查点信息
+	case *consensus.CheckpointMsg:
+		err = node.GetCheckpoint(msg.(*consensus.CheckpointMsg))
+	// 处理状态传输信息
+	case *consensus.FetchStateMsg:
+		err = node.GetFetchState(msg.(*consensus.FetchStateMsg))
+	case *consensus.StateMsg:
+		err = node.GetState(msg.(*consensus.StateMsg))
+	case *consensus.FetchChunkMsg:
+		err = node.GetFetchChunk(msg.(*consensus.FetchChunkMsg))
+	case *consensus.ChunkMsg:
+		err = node.GetChunk(msg.(*consensus.ChunkMsg))
+	case *stateTransferAlarm:
+		err = node.resolveStateTransferAlarm()
+	}
+
+	switch err {
+	case nil, errStaleSequence:
+		// 低水位之前的信息已经没有用了
+		return nil
+	case errAboveHighWaterMark, errAwaitReconfig:
+		// 本节点的稳定检查点落后于其他节点，或者还没有切换到新的副本集合，先缓存起来，低水位提高或重配置生效后再处理
+		if len(node.MsgBuffer.FutureMsgs) < MaxFutureMsgs {
+			node.MsgBuffer.FutureMsgs = append(node.MsgBuffer.FutureMsgs, msg)
+		}
+		return nil
+	default:
+		return []error{err}
+	}
+}
+
+// resolveFutureMsgs 在低水位提高之后重新处理缓存的信息
+func (node *Node) resolveFutureMsgs() []error {
+	msgs := node.MsgBuffer.FutureMsgs
+	node.MsgBuffer.FutureMsgs = make([]interface{}, 0)
+
+	errs := make([]error, 0)
+	for _, msg := range msgs {
+		errs = append(errs, node.routeMsg(msg)...)
+	}
+	return errs
+}
+
+// routeMsgWhenAlarmed 定时处理 buffer 中等待分配序列号的请求
+func (node *Node) routeMsgWhenAlarmed() []error {
+	if len(node.MsgBuffer.ReqMsgs) == 0 {
+		return nil
+	}
+
+	msgs := make([]*consensus.RequestMsg, len(node.MsgBuffer.ReqMsgs))
+	copy(msgs, node.MsgBuffer.ReqMsgs)
+	// 将 buffer 清空，依然无法处理的请求会重新放回 buffer
+	node.MsgBuffer.ReqMsgs = make([]*consensus.RequestMsg, 0)
+	node.MsgBuffer.ReqBytes = 0
+
+	errs := node.resolveRequestMsg(msgs)
+	if err := node.proposeBatches(); err != nil {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+func (node *Node) alarmToDispatcher() {
+	for {
+		time.Sleep(ResolvingTimeDuration)
+		node.Alarm <- true
+	}
+}
+
+func (node *Node) resolveRequestMsg(msgs []*consensus.RequestMsg) []error {
+	errs := make([]error, 0)
+
+	for _, reqMsg := range msgs {
+		err := node.GetReq(reqMsg)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) != 0 {
+		return errs
+	}
+	return nil
+}
+
+// GetReq 由主节点为请求分配序列号并开始共识，备份节点则将请求转发给主节点
+func (node *Node) GetReq(reqMsg *consensus.RequestMsg) error {
+	LogMsg(reqMsg)
+
+	// 拒绝未注册的客户端以及签名错误的请求
+	if err := node.Keys.VerifyRequest(reqMsg); err != nil {
+		return err
+	}
+
+	// 已经执行过的请求不再重新排序，如果是该客户端的最后一个请求则重新发送回复
+	if node.Replies.Executed(reqMsg) {
+		if lastReply, ok := node.Replies.Get(reqMsg); ok {
+			return node.Reply(&consensus.ReplyMsg{
+				ViewID:    node.View.ID,
+				Timestamp: reqMsg.Timestamp,
+				ClientID:  reqMsg.ClinetID,
+				NodeID:    node.NodeID,
+				Result:    lastReply.Result,
+			}, reqMsg.ReplyAddr)
+		}
+		return nil
+	}
+
+	// 备份节点将请求转发给主节点，并开启计时器等待请求被执行
+	if node.View.Primary != node.NodeID {
+		node.addPending(reqMsg)
+		return node.send(node.NodeTable[node.View.Primary], "/req", reqMsg)
+	}
+
+	// 主节点先将请求放入 buffer，批次满了或者等待 BatchDelay 之后再分配序列号
+	for _, buffered := range node.MsgBuffer.ReqMsgs {
+		if pendingKey(buffered) == pendingKey(reqMsg) {
+			return nil
+		}
+	}
+	node.MsgBuffer.ReqMsgs = append(node.MsgBuffer.ReqMsgs, reqMsg)
+	node.MsgBuffer.ReqBytes += consensus.RequestSize(reqMsg)
+
+	if len(node.MsgBuffer.ReqMsgs) >= node.Config.MaxBatchSize || node.MsgBuffer.ReqBytes >= node.Config.MaxBatchBytes {
+		return node.proposeBatches()
+	}
+	if node.BatchTimer == nil {
+		node.BatchTimer = node.Clock.AfterFunc(time.Duration(node.Config.BatchDelay), func() {
+			node.post(&batchAlarm{})
+		})
+	}
+	return nil
+}
+
+// proposeBatches 将 buffer 中的请求打包，为每个批次分配序列号并开始共识。
+// 视图切换期间或序列号超出高水位时，请求继续留在 buffer 中。
+func (node *Node) proposeBatches() error {
+	if node.BatchTimer != nil {
+		node.BatchTimer.Stop()
+		node.BatchTimer = nil
+	}
+
+	for len(node.MsgBuffer.ReqMsgs) != 0 {
+		sequenceID := node.SequenceID + 1
+		if node.View.Primary != node.NodeID || node.viewChanging() || !consensus.InWaterMarks(node.StableCheckpoint.SequenceID, sequenceID) {
+			return nil
+		}
+		// 重配置生效之前不能为边界之后的序列号分配请求
+		if node.beyondReconfig(sequenceID) {
+			return nil
+		}
+
+		// 为共识创建一个新状态
+		state, err := node.createStateForNewConsensus(node.View.ID, sequenceID)
+		if err != nil {
+			return err
+		}
+
+		// 开始执行共识
+		prePrepareMsg, err := state.StartConsensus(node.nextBatch())
+		if err != nil {
+			return err
+		}
+		node.SequenceID = sequenceID
+
+		LogStage(fmt.Sprintf("Consensus Process (ViewID:%d, SequenceID:%d)", state.ViewID, state.SequenceID), false)
+
+		// 发送 getPrePrepare 信息
+		prePrepareMsg.NodeID = node.NodeID
+		node.PrePrepareMsgs[sequenceID] = prePrepareMsg
+		node.Broadcast(prePrepareMsg, "/preprepare")
+		LogStage("Pre-prepare", true)
+	}
+	return nil
+}
+
+// nextBatch 从 buffer 的头部取出一个批次，批次中至少有一个请求，且不超过请求数量和字节数的上限
+func (node *Node) nextBatch() []*consensus.RequestMsg {
+	size, bytes := 0, 0
+	for size < len(node.MsgBuffer.ReqMsgs) && size < node.Config.MaxBatchSize {
+		reqBytes := consensus.RequestSize(node.MsgBuffer.ReqMsgs[size])
+		if size > 0 && bytes+reqBytes > node.Config.MaxBatchBytes {
+			break
+		}
+		bytes += reqBytes
+		size++
+	}
+
+	batch := make([]*consensus.RequestMsg, size)
+	copy(batch, node.MsgBuffer.ReqMsgs)
+	node.MsgBuffer.ReqMsgs = node.MsgBuffer.ReqMsgs[size:]
+	node.MsgBuffer.ReqBytes -= bytes
+	return batch
+}
+
+// GetPrePrepare 由备份节点调用，接受主节点分配的序列号并广播 prepare 消息
+func (node *Node) GetPrePrepare(prePrepareMsg *consensus.PrePrepareMsg) error {
+	LogMsg(prePrepareMsg)
+
+	if node.View.Primary == node.NodeID {
+		return errors.New("the primary does not accept pre-prepare messages")
+	}
+
+	return node.acceptPrePrepare(prePrepareMsg)
+}
+
+// acceptPrePrepare 将 pre-prepare 消息记录到对应的共识实例中，备份节点还需要广播 prepare 消息
+func (node *Node) acceptPrePrepare(prePrepareMsg *consensus.PrePrepareMsg) error {
+	// 重配置边界之后的主节点由新的副本集合决定，因此先检查序列号
+	state, err := node.createStateForNewConsensus(prePrepareMsg.ViewID, prePrepareMsg.SequenceID)
+	if err != nil {
+		return err
+	}
+	if prePrepareMsg.NodeID != node.primaryOf(prePrepareMsg.ViewID) {
+		return errors.New("pre-prepare message is not sent by the primary")
+	}
+
+	prePareMsg, err := state.PrePrepare(prePrepareMsg)
+	if err != nil {
+		return err
+	}
+	if err := node.WAL.Append(&walRecord{Type: walPrePrepare, PrePrepareMsg: prePrepareMsg}); err != nil {
+		return err
+	}
+	node.PrePrepareMsgs[prePrepareMsg.SequenceID] = prePrepareMsg
+
+	// 主节点不发送 prepare 消息
+	if prePareMsg == nil || node.View.Primary == node.NodeID {
+		return nil
+	}
+
+	// Attach node ID to the message
+	prePareMsg.NodeID = node.NodeID
+
+	// 在请求被提交之前，主节点都有可能失效
+	for _, reqMsg := range prePrepareMsg.RequestMsgs {
+		node.addPending(reqMsg)
+	}
+
+	LogStage("Pre-prepare", true)
+	node.Broadcast(prePareMsg, "/prepare")
+	LogStage("Prepare", false)
+
+	// 自己的 prepare 消息同样计入投票
+	return node.GetPrepare(prePareMsg)
+}
+
+func (node *Node) GetPrepare(prepareMsg *consensus.VoteMsg) error {
+	LogMsg(prepareMsg)
+
+	state, err := node.createStateForNewConsensus(prepareMsg.ViewID, prepareMsg.SequenceID)
+	if err != nil {
+		return err
+	}
+
+	// 主节点不参与 prepare 阶段的投票
+	if prepareMsg.NodeID == node.primaryOf(prepareMsg.ViewID) {
+		return errors.New("prepare message is sent by the primary")
+	}
+
+	commitMsg, err := state.Prepare(prepareMsg)
+	if err != nil {
+		return err
+	}
+
+	if commitMsg != nil {
+		// Attach node ID to the message
+		commitMsg.NodeID = node.NodeID
+
+		// 保存 prepared 证明，视图切换时需要将其发送给新的主节点
+		preparedCert := state.PreparedCert()
+		if err := node.WAL.Append(&walRecord{Type: walPrepared, PreparedCert: preparedCert}); err != nil {
+			return err
+		}
+		node.PreparedCerts[commitMsg.SequenceID] = preparedCert
+
+		LogStage("Prepare", true)
+		node.Broadcast(commitMsg, "/commit")
+		LogStage("Commit", false)
+
+		// 自己的 commit 消息同样计入投票
+		return node.GetCommit(commitMsg)
+	}
+
+	return nil
+}
+
+func (node *Node) GetCommit(commitMsg *consensus.VoteMsg) error {
+	LogMsg(commitMsg)
+
+	state, err := node.createStateForNewConsensus(commitMsg.ViewID, commitMsg.SequenceID)
+	if err != nil {
+		return err
+	}
+
+	prePrepareMsg, err := state.Commit(commitMsg)
+	if err != nil {
+		return err
+	}
+
+	if prePrepareMsg != nil {
+		LogStage(fmt.Sprintf("Commit (SequenceID:%d)", state.SequenceID), true)
+		node.recordCommit(state)
+
+		// 新视图中重新提议的批次可能已经在之前的视图中执行过了，不能重复执行
+		if state.SequenceID > node.lastSequenceID() {
+			err := node.WAL.Append(&walRecord{Type: walCommitted, ViewID: state.ViewID, PrePrepareMsg: prePrepareMsg})
+			if err != nil {
+				return err
+			}
+			node.CommittedMsgs[state.SequenceID] = &CommittedMsg{state.ViewID, prePrepareMsg}
+		} else {
+			for _, reqMsg := range prePrepareMsg.RequestMsgs {
+				node.removePending(reqMsg)
+			}
+		}
+		node.execute()
+	}
+
+	return nil
+}
+
+// execute 按照序列号的顺序执行已经提交的请求
+func (node *Node) execute() {
+	for {
+		sequenceID := node.lastSequenceID() + 1
+		committedMsg, ok := node.CommittedMsgs[sequenceID]
+		if !ok {
+			return
+		}
+		node.ExecutedSequenceID = sequenceID
+
+		// 按照批次中的顺序执行请求，空批次不需要执行，也不需要回复。
+		// 同一个请求可能被不同的节点转发多次而分配到多个序列号，只有第一次会被执行。
+		for _, reqMsg := range committedMsg.PrePrepareMsg.RequestMsgs {
+			// Save the last version of committed messages to node.
+			node.CommitMsgs = append(node.CommitMsgs, reqMsg)
+			node.removePending(reqMsg)
+
+			if !node.Replies.Executed(reqMsg) {
+				// 重配置请求修改副本集合，其他请求交给状态机执行
+				var result string
+				if consensus.IsReconfig(reqMsg) {
+					result = node.reconfigure(reqMsg, sequenceID)
+				} else {
+					result = node.App.Execute(reqMsg)
+				}
+				node.Replies.Save(reqMsg, result)
+			}
+			if lastReply, ok := node.Replies.Get(reqMsg); ok {
+				node.Reply(&consensus.ReplyMsg{
+					ViewID:    committedMsg.ViewID,
+					Timestamp: reqMsg.Timestamp,
+					ClientID:  reqMsg.ClinetID,
+					NodeID:    node.NodeID,
+					Result:    lastReply.Result,
+				}, reqMsg.ReplyAddr)
+			}
+		}
+		if !committedMsg.PrePrepareMsg.IsNull() {
+			LogStage("Reply", true)
+		}
+		node.recordExecute(sequenceID, committedMsg)
+
+		// 新的副本集合在检查点之前生效，因此检查点的快照中已经是新的副本集合。
+		// 等待重配置生效的共识信息在生成快照之后再处理，以免在快照之前执行之后的批次。
+		reconfigured := sequenceID == node.ReconfigID
+		if reconfigured {
+			node.applyMembership()
+		}
+		if consensus.IsCheckpoint(sequenceID) {
+			node.Checkpoint(sequenceID)
+		}
+		if reconfigured {
+			for _, err := range node.resolveFutureMsgs() {
+				fmt.Println(err)
+			}
+		}
+	}
+}
+
+// Query 在本地状态机上执行只读操作，由 dispatchMsg 执行以避免与 Execute 并发
+func (node *Node) Query(operation string) (string, error) {
+	query := &queryMsg{operation, make(chan queryResult, 1)}
+	node.MsgEntrance <- query
+	result := <-query.Result
+	return result.Result, result.Err
+}
+
+func (node *Node) resolveQuery(query *queryMsg) {
+	result, err := node.App.Query(query.Operation)
+	query.Result <- queryResult{result, err}
+}
+
+func (node *Node) GetReply(msg *consensus.ReplyMsg) {
+	if err := node.Keys.Verify(msg.NodeID, msg); err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Printf("Result: %s by %s\n", msg.Result, msg.NodeID)
+}
+
+// createStateForNewConsensus 获取 (viewID, sequenceID) 对应的共识实例，不存在时新建一个
+func (node *Node) createStateForNewConsensus(viewID int64, sequenceID int64) (*consensus.State, error) {
+	// 视图切换期间只接受视图切换相关的信息
+	if node.viewChanging() || viewID != node.View.ID {
+		return nil, errors.New("the message does not belong to the current view")
+	}
+	// 只处理高低水位之间的序列号
+	if sequenceID <= node.StableCheckpoint.SequenceID {
+		return nil, errStaleSequence
+	}
+	if !consensus.InWaterMarks(node.StableCheckpoint.SequenceID, sequenceID) {
+		return nil, errAboveHighWaterMark
+	}
+	if node.beyondReconfig(sequenceID) {
+		return nil, errAwaitReconfig
+	}
+
+	key := consensus.InstanceKey{ViewID: viewID, SequenceID: sequenceID}
+	if state, ok := node.States[key]; ok {
+		return state, nil
+	}
+
+	// 创建一个新的共识
+	state := consensus.CreateState(viewID, sequenceID, node.Keys)
+	node.States[key] = state
+	LogStage(fmt.Sprintf("Create the replica status (SequenceID:%d)", sequenceID), true)
+
+	return state, nil
+}
+
+// lastSequenceID 获取最后一个执行的序列ID，空批次同样占用一个序列号
+func (node *Node) lastSequenceID() int64 {
+	return node.ExecutedSequenceID
+}
+
+// Reply 将回复发送给客户端的 replyAddr，replyAddr 为空时发送给主节点
+func (node *Node) Reply(msg *consensus.ReplyMsg, replyAddr string) error {
+	if err := consensus.Sign(node.PrivateKey, msg); err != nil {
+		return err
+	}
+	if replyAddr == "" {
+		replyAddr = node.NodeTable[node.View.Primary]
+	}
+	return node.send(replyAddr, "/reply", msg)
+}
+
+// send 将消息编码之后发送给 addr
+func (node *Node) send(addr string, path string, msg interface{}) error {
+	jsonMsg, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	node.record(trace.MessageEvent(trace.EventSend, addr, msg))
+	node.Transport.Send(addr, &Message{Path: path, Payload: jsonMsg})
+	return nil
+}
+
+func (node *Node) Broadcast(msg interface{}, path string) map[string]error {
+	errorMap := make(map[string]error)
+
+	// 所有共识消息在发送之前都需要签名，自己保存的消息也同样带有签名。
+	// MACMode 中投票消息改为携带每个接收者的认证码。
+	if voteMsg, ok := msg.(*consensus.VoteMsg); ok && node.Keys.Mode == consensus.MACMode {
+		if err := node.Keys.AddAuthenticators(voteMsg); err != nil {
+			errorMap[node.NodeID] = err
+			return errorMap
+		}
+	} else if signedMsg, ok := msg.(consensus.SignedMsg); ok {
+		if err := consensus.Sign(node.PrivateKey, signedMsg); err != nil {
+			errorMap[node.NodeID] = err
+			return errorMap
+		}
+	}
+	// 签名之后、发送之前写入 WAL
+	if err := node.persistSent(msg); err != nil {
+		errorMap[node.NodeID] = err
+		return errorMap
+	}
+
+	jsonMsg, err := json.Marshal(msg)
+	if err != nil {
+		errorMap[node.NodeID] = err
+		return errorMap
+	}
+	// 按副本集合的顺序发送，同样的输入总是产生同样顺序的消息
+	addrs := make([]string, 0, len(node.NodeTable))
+	for _, nodeID := range node.replicaIDs() {
+		if nodeID == node.NodeID {
+			continue
+		}
+		addrs = append(addrs, node.NodeTable[nodeID])
+		node.record(trace.MessageEvent(trace.EventSend, node.NodeTable[nodeID], msg))
+	}
+	node.Transport.Broadcast(addrs, &Message{Path: path, Payload: jsonMsg})
+
+	return nil
+}
@@ -1,97 +1,137 @@
-package network
-
-import (
-	"PBFT/consensus"
-	"bytes"
-	"encoding/json"
-	"fmt"
-	"net/http"
-)
-
-type Server struct {
-	url string
-	node *Node
-}
-
-func NewServer(nodeID string) *Server {
-	node := NewNode(nodeID)
-	server := &Server{node.NodeTable[nodeID], node}
-	server.setRoute()
-	return server
-}
-
-func (server *Server) setRoute() {
-	http.HandleFunc("/req", server.getReq)
-	http.HandleFunc("/preprepare", server.getPrePrepare)
-	http.HandleFunc("/prepare", server.getPrepare)
-	http.HandleFunc("/commit", server.getCommit)
-	http.HandleFunc("/reply", server.getReply)
-}
-
-func (server *Server) getReq(w http.ResponseWriter, r *http.Request) {
-	var msg consensus.RequestMsg
-	err := json.NewDecoder(r.Body).Decode(&msg)
-	if err != nil {
-		fmt.Println(err)
-		return
-	}
-
-	server.node.MsgEntrance <- &msg
-}
-
-func (server *Server) getPrePrepare(w http.ResponseWriter, r *http.Request) {
-	var msg consensus.PrePrepareMsg
-	err := json.NewDecoder(r.Body).Decode(&msg)
-	if err != nil {
-		fmt.Println(err)
-		return
-	}
-
-	server.node.MsgEntrance <- &msg
-}
-
-func (server *Server) getPrepare(w http.ResponseWriter, r *http.Request) {
-	var msg consensus.VoteMsg
-	err := json.NewDecoder(r.Body).Decode(&msg)
-	if err != nil {
-		fmt.Println(err)
-		return
-	}
-
-	server.node.MsgEntrance <- &msg
-}
-
-func (server *Server) getCommit(w http.ResponseWriter, r *http.Request) {
-	var msg consensus.VoteMsg
-	err := json.NewDecoder(r.Body).Decode(&msg)
-	if err != nil {
-		fmt.Println(err)
-		return
-	}
-
-	server.node.MsgEntrance <- &msg
-}
-
-func (server *Server) getReply(w http.ResponseWriter, r *http.Request) {
-	var msg consensus.ReplyMsg
-	err := json.NewDecoder(r.Body).Decode(&msg)
-	if err != nil {
-		fmt.Println(err)
-		return
-	}
-
-	server.node.GetReply(&msg)
-}
-
-func send(url string, msg []byte) {
-	buff := bytes.NewBuffer(msg)
-	http.Post("http://" + url, "application/json", buff)
-}
-
-func (server *Server) Start() {
-	fmt.Printf("Server will be started at %s...\n", server.url)
-	if err := http.ListenAndServe(server.url, nil); err != nil {
-		fmt.Println(err)
-		return
-	}
-}
\ No newline at end of file
+package network
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"goPBFT/consensus"
+	"net/http"
+	"sync"
+)
+
+type Server struct {
+	node      *Node
+	transport Transport
+	// 故障注入的管理接口，节点配置中没有 admin 地址时为空
+	admin     *http.Server
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// routes 为每个路径创建对应类型的消息，收到的消息解码后交给节点
+var routes = map[string]func() interface{}{
+	"/req":        func() interface{} { return &consensus.RequestMsg{} },
+	"/preprepare": func() interface{} { return &consensus.PrePrepareMsg{} },
+	"/prepare":    func() interface{} { return &consensus.VoteMsg{} },
+	"/commit":     func() interface{} { return &consensus.VoteMsg{} },
+	"/reply":      func() interface{} { return &consensus.ReplyMsg{} },
+	"/viewchange": func() interface{} { return &consensus.ViewChangeMsg{} },
+	"/newview":    func() interface{} { return &consensus.NewViewMsg{} },
+	"/checkpoint": func() interface{} { return &consensus.CheckpointMsg{} },
+	"/fetchstate": func() interface{} { return &consensus.FetchStateMsg{} },
+	"/state":      func() interface{} { return &consensus.StateMsg{} },
+	"/fetchchunk": func() interface{} { return &consensus.FetchChunkMsg{} },
+	"/chunk":      func() interface{} { return &consensus.ChunkMsg{} },
+}
+
+// NewServer 创建节点，节点通过 transport 收发所有的消息。
+// 节点配置中有 admin 地址时，发送的消息经过 FaultTransport，并在该地址上提供故障注入的管理接口。
+func NewServer(config *Config, app consensus.Application, transport Transport) (*Server, error) {
+	server := &Server{transport: transport, done: make(chan struct{})}
+	httpTransport, isHTTP := transport.(*HTTPTransport)
+
+	if nodeConfig, ok := config.Nodes[config.NodeID]; ok && nodeConfig.Admin != "" {
+		tlsConfig, err := config.LoadTLS(config.NodeID)
+		if err != nil {
+			return nil, err
+		}
+		faultTransport := NewFaultTransport(transport, config.NodeID, config.NodeTable())
+		server.admin, err = faultTransport.ServeAdmin(nodeConfig.Admin, tlsConfig, config.KeyDir)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Printf("Fault injection admin API is at %s\n", nodeConfig.Admin)
+		transport = faultTransport
+		server.transport = faultTransport
+	}
+
+	node, err := NewNode(config, app, transport)
+	if err != nil {
+		if server.admin != nil {
+			server.admin.Close()
+		}
+		return nil, err
+	}
+	server.node = node
+	// 只读查询需要同步返回结果，只有 HTTP 传输支持
+	if isHTTP {
+		httpTransport.HandleFunc("/query", server.getQuery)
+	}
+	return server, nil
+}
+
+// getQuery 直接在本节点的状态机上执行只读操作，结果不经过共识
+func (server *Server) getQuery(w http.ResponseWriter, r *http.Request) {
+	operation := r.URL.Query().Get("operation")
+
+	result, err := server.node.Query(operation)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fmt.Fprint(w, result)
+}
+
+// Start 处理收到的消息，直到 Stop 被调用
+func (server *Server) Start() {
+	fmt.Printf("Server will be started at %s...\n", server.transport.Addr())
+	for {
+		select {
+		case msg := <-server.transport.Receive():
+			server.handle(msg)
+		case <-server.done:
+			return
+		}
+	}
+}
+
+// Stop 停止处理消息并关闭 transport，用于在同一个进程中运行多个节点时停止其中一个
+func (server *Server) Stop() error {
+	server.closeOnce.Do(func() {
+		close(server.done)
+		if server.admin != nil {
+			server.admin.Close()
+		}
+	})
+	return server.transport.Close()
+}
+
+func (server *Server) handle(msg *Message) {
+	decoded, err := DecodeMessage(msg)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	if replyMsg, ok := decoded.(*consensus.ReplyMsg); ok {
+		server.node.GetReply(replyMsg)
+		return
+	}
+	server.node.MsgEntrance <- decoded
+}
+
+// DecodeMessage 按 Path 解码收到的消息，并检查消息中声明的发送者
+func DecodeMessage(msg *Message) (interface{}, error) {
+	newMsg, ok := routes[msg.Path]
+	if !ok {
+		return nil, errors.New("unknown message path " + msg.Path)
+	}
+	decoded := newMsg()
+	if err := json.Unmarshal(msg.Payload, decoded); err != nil {
+		return nil, err
+	}
+	if err := CheckPeer(msg.Peer, decoded); err != nil {
+		return nil, err
+	}
+	return decoded, nil
+}
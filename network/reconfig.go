@@ -0,0 +1,130 @@
+package network
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"goPBFT/consensus"
+)
+
+// reconfigure 执行重配置请求，返回给管理员的结果。新的副本集合暂时保存在 PendingMembership 中，
+// 执行到 consensus.ReconfigBoundary 处的检查点时才生效，同一个区间内的多个重配置依次叠加。
+func (node *Node) reconfigure(reqMsg *consensus.RequestMsg, sequenceID int64) string {
+	if !node.Keys.Admins[reqMsg.ClinetID] {
+		return "ERROR: " + reqMsg.ClinetID + " is not allowed to reconfigure the cluster"
+	}
+	reconfig, err := consensus.ParseReconfig(reqMsg.Operation)
+	if err != nil {
+		return "ERROR: " + err.Error()
+	}
+
+	membership := node.PendingMembership
+	if membership == nil {
+		membership = node.Membership
+	}
+	next, err := membership.Apply(reconfig)
+	if err != nil {
+		return "ERROR: " + err.Error()
+	}
+	node.PendingMembership = next
+	node.ReconfigID = consensus.ReconfigBoundary(sequenceID)
+
+	LogStage(fmt.Sprintf("Reconfiguration (%s %s, SequenceID:%d)", reconfig.Op, reconfig.NodeID, node.ReconfigID), false)
+	return fmt.Sprintf("OK (SequenceID:%d)", node.ReconfigID)
+}
+
+// applyMembership 在执行到重配置的边界之后切换到新的副本集合
+func (node *Node) applyMembership() {
+	membership := node.PendingMembership
+	membership.Epoch = node.Membership.Epoch + 1
+	sequenceID := node.ReconfigID
+	node.PendingMembership = nil
+	node.ReconfigID = -1
+
+	if err := node.setMembership(membership); err != nil {
+		fmt.Println(err)
+	}
+	// 新的主节点从边界之后继续分配序列号
+	if node.SequenceID < sequenceID {
+		node.SequenceID = sequenceID
+	}
+	LogStage(fmt.Sprintf("Reconfiguration (Epoch:%d, Replicas:%d, Primary:%s)", membership.Epoch, len(membership.Replicas), node.View.Primary), true)
+}
+
+// setMembership 根据副本集合更新节点列表、公钥、会话密钥和当前视图的主节点，f 和法定人数随之改变
+func (node *Node) setMembership(membership *consensus.Membership) error {
+	node.Membership = membership
+	node.NodeTable = membership.NodeTable()
+	// 故障注入按地址找到接收消息的节点
+	if faultTransport, ok := node.Transport.(*FaultTransport); ok {
+		faultTransport.SetNodeTable(node.NodeTable)
+	}
+
+	publicKeys := make(map[string]ed25519.PublicKey, len(membership.Replicas))
+	for nodeID, replica := range membership.Replicas {
+		publicKeys[nodeID] = replica.PublicKey
+	}
+	node.Keys.PublicKeys = publicKeys
+	if node.View != nil {
+		node.View.Primary = node.primaryOf(node.View.ID)
+	}
+
+	replica, ok := membership.Replicas[node.NodeID]
+	if !ok {
+		LogStage(fmt.Sprintf("Reconfiguration (%s is not a replica)", node.NodeID), true)
+		return nil
+	}
+
+	if node.Keys.Mode == consensus.MACMode {
+		for nodeID := range membership.Replicas {
+			if _, ok := node.Keys.SessionKeys[nodeID]; ok {
+				continue
+			}
+			if err := loadSessionKey(node.Config.KeyDir, node.Keys, nodeID); err != nil {
+				return err
+			}
+		}
+	}
+
+	// 本节点的密钥已经轮换，改用新的私钥签名
+	if bytes.Equal(node.PrivateKey.Public().(ed25519.PublicKey), replica.PublicKey) {
+		return nil
+	}
+	privateKey, err := PromoteNextKey(node.Config.KeyDir, node.NodeID)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(privateKey.Public().(ed25519.PublicKey), replica.PublicKey) {
+		return errors.New("the rotated key of " + node.NodeID + " does not match the reconfiguration")
+	}
+	node.PrivateKey = privateKey
+	return nil
+}
+
+// reconfigBarrier 返回还没有生效的重配置的边界，没有时返回 -1。
+// 已经执行、或者已经接受 pre-prepare 但还没有执行的重配置生效之前，边界之后的序列号需要等待新的副本集合。
+func (node *Node) reconfigBarrier() int64 {
+	barrier := node.ReconfigID
+	for sequenceID, prePrepareMsg := range node.PrePrepareMsgs {
+		if sequenceID <= node.lastSequenceID() {
+			continue
+		}
+		for _, reqMsg := range prePrepareMsg.RequestMsgs {
+			if !consensus.IsReconfig(reqMsg) {
+				continue
+			}
+			if boundary := consensus.ReconfigBoundary(sequenceID); barrier == -1 || boundary < barrier {
+				barrier = boundary
+			}
+			break
+		}
+	}
+	return barrier
+}
+
+// beyondReconfig 判断序列号是否需要等待重配置生效之后才能处理
+func (node *Node) beyondReconfig(sequenceID int64) bool {
+	barrier := node.reconfigBarrier()
+	return barrier != -1 && sequenceID > barrier
+}
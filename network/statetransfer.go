@@ -0,0 +1,374 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"goPBFT/consensus"
+	"goPBFT/trace"
+	"sort"
+	"time"
+)
+
+const (
+	StateTransferDelay = time.Second * 1 // 发现本节点落后之后默认等待的时间，之后仍然落后时才向其他节点获取状态
+	MaxChunkRequests   = 16              // 同时等待的快照分块请求的数量
+)
+
+// stateTransferAlarm 在状态传输的计时器超时后投递给 dispatchMsg
+type stateTransferAlarm struct{}
+
+// snapshotFetch 是正在下载的快照，分块的请求分散到所有提供了该检查点的节点。
+// 检查点、Merkle 根和块数共同确定了快照的分块方式，只有给出相同分块方式的节点才会加入下载。
+type snapshotFetch struct {
+	Checkpoint *consensus.StableCheckpoint
+	Root       string
+	Peers      []string
+	// 发送过错误分块的节点，不再向它们请求，重新开始下载时也不再使用
+	Evicted  map[string]bool
+	Chunks   [][]byte
+	Received int
+	// 已经发出、还没有收到回复的分块请求
+	Requested map[int]bool
+	// 每次计时器超时后加一，使重新发出的请求落到其他节点上
+	Round int
+	// 上一次计时器超时之后是否收到过分块
+	Progress bool
+}
+
+// requestStateTransfer 记录本节点还没有执行到的稳定检查点，并开启状态传输的计时器
+func (node *Node) requestStateTransfer(sequenceID int64) {
+	if sequenceID > node.StateTransferID {
+		node.StateTransferID = sequenceID
+	}
+	node.startStateTransferTimer()
+}
+
+func (node *Node) startStateTransferTimer() {
+	if node.StateTransferTimer != nil {
+		return
+	}
+	node.StateTransferTimer = node.Clock.AfterFunc(time.Duration(node.Config.StateTransferDelay), func() {
+		node.post(&stateTransferAlarm{})
+	})
+}
+
+// resolveStateTransferAlarm 在本节点仍然落后时向所有节点广播 fetch-state 消息，回复可能丢失，因此继续计时直到追上。
+// 追上之后仍然收集一个计时周期内的回复，用于确认之后的批次以及当前的视图。
+func (node *Node) resolveStateTransferAlarm() error {
+	node.StateTransferTimer = nil
+	if node.StateTransferID <= node.lastSequenceID() {
+		if node.StateMsgs != nil {
+			LogStage(fmt.Sprintf("State Transfer (SequenceID:%d)", node.lastSequenceID()), true)
+		}
+		node.StateMsgs = nil
+		node.SnapshotFetch = nil
+		return nil
+	}
+
+	// 快照的下载没有进展时放弃，其他节点可能已经丢弃了该检查点的快照；否则重新请求还没有收到的分块
+	if fetch := node.SnapshotFetch; fetch != nil {
+		if !fetch.Progress {
+			node.SnapshotFetch = nil
+		} else {
+			fetch.Progress = false
+			fetch.Round++
+			fetch.Requested = make(map[int]bool)
+			node.requestChunks()
+		}
+	}
+
+	LogStage(fmt.Sprintf("State Transfer (SequenceID:%d)", node.lastSequenceID()), false)
+	node.StateMsgs = make(map[string]*consensus.StateMsg)
+	fetchStateMsg := &consensus.FetchStateMsg{
+		SequenceID: node.lastSequenceID(),
+		NodeID:     node.NodeID,
+	}
+	node.Broadcast(fetchStateMsg, "/fetchstate")
+
+	node.startStateTransferTimer()
+	return nil
+}
+
+// GetFetchState 将 fetch-state 消息中的序列号之后的稳定检查点、快照和已经执行的批次发送给落后的节点
+func (node *Node) GetFetchState(fetchStateMsg *consensus.FetchStateMsg) error {
+	LogMsg(fetchStateMsg)
+
+	if err := node.Keys.Verify(fetchStateMsg.NodeID, fetchStateMsg); err != nil {
+		return err
+	}
+	if fetchStateMsg.NodeID == node.NodeID || node.lastSequenceID() <= fetchStateMsg.SequenceID {
+		return nil
+	}
+
+	stateMsg := &consensus.StateMsg{
+		ViewID:        node.View.ID,
+		CommittedMsgs: make([]*consensus.PrePrepareMsg, 0),
+		NodeID:        node.NodeID,
+	}
+	sequenceID := fetchStateMsg.SequenceID
+	if node.StableCheckpoint.SequenceID > sequenceID {
+		chunks, ok := node.Snapshots[node.StableCheckpoint.SequenceID]
+		if !ok {
+			return errors.New("the snapshot of the stable checkpoint is missing")
+		}
+		stateMsg.Checkpoint = node.StableCheckpoint
+		stateMsg.SnapshotChunks = len(chunks.Chunks)
+		stateMsg.SnapshotRoot = chunks.Root()
+		sequenceID = node.StableCheckpoint.SequenceID
+	}
+	for sequenceID++; sequenceID <= node.lastSequenceID(); sequenceID++ {
+		committedMsg, ok := node.CommittedMsgs[sequenceID]
+		if !ok {
+			break
+		}
+		stateMsg.CommittedMsgs = append(stateMsg.CommittedMsgs, committedMsg.PrePrepareMsg)
+	}
+
+	if err := consensus.Sign(node.PrivateKey, stateMsg); err != nil {
+		return err
+	}
+	return node.send(node.NodeTable[fetchStateMsg.NodeID], "/state", stateMsg)
+}
+
+// GetState 处理其他节点回复的状态。
+// 稳定检查点由 2f+1 个 checkpoint 消息证明，快照的 Merkle 根由检查点的摘要证明，每一块都可以由 Merkle 根单独检查，因此可以同时从多个节点下载；
+// 之后的批次需要 f+1 个节点的回复一致。
+func (node *Node) GetState(stateMsg *consensus.StateMsg) error {
+	LogMsg(stateMsg)
+
+	// 本节点没有在获取状态
+	if node.StateMsgs == nil {
+		return nil
+	}
+	if err := consensus.VerifyState(stateMsg, node.Keys); err != nil {
+		return err
+	}
+	node.StateMsgs[stateMsg.NodeID] = stateMsg
+
+	if stateMsg.Checkpoint != nil && stateMsg.Checkpoint.SequenceID > node.lastSequenceID() {
+		node.fetchSnapshot(stateMsg)
+	}
+	return node.applyStateMsgs()
+}
+
+// applyStateMsgs 根据收到的回复进入更高的视图，并执行 f+1 个节点回复一致的批次
+func (node *Node) applyStateMsgs() error {
+	stateMsgs := make([]*consensus.StateMsg, 0, len(node.StateMsgs))
+	for _, msg := range node.StateMsgs {
+		stateMsgs = append(stateMsgs, msg)
+	}
+
+	// 本节点错过了更高视图的 new-view 消息
+	if viewID := consensus.StateView(stateMsgs, node.Keys.Quorum()); viewID > node.View.ID {
+		node.setView(viewID)
+		LogStage(fmt.Sprintf("View Change (ViewID:%d, Primary:%s)", node.View.ID, node.View.Primary), true)
+	}
+
+	for _, prePrepareMsg := range consensus.SelectBatches(node.lastSequenceID(), stateMsgs, node.Keys.Quorum()) {
+		err := node.WAL.Append(&walRecord{Type: walCommitted, ViewID: prePrepareMsg.ViewID, PrePrepareMsg: prePrepareMsg})
+		if err != nil {
+			return err
+		}
+		node.CommittedMsgs[prePrepareMsg.SequenceID] = &CommittedMsg{prePrepareMsg.ViewID, prePrepareMsg}
+		node.recordStateCommit(prePrepareMsg)
+	}
+	node.execute()
+	return nil
+}
+
+// fetchSnapshot 开始下载回复中的检查点处的快照。正在下载的快照不会被更新的检查点打断，
+// 提供了同一个检查点和分块方式的节点加入下载。块数和 Merkle 根已经由 VerifyState 用检查点的摘要检查过。
+func (node *Node) fetchSnapshot(stateMsg *consensus.StateMsg) {
+	checkpoint := stateMsg.Checkpoint
+	fetch := node.SnapshotFetch
+	if fetch == nil {
+		node.SnapshotFetch = &snapshotFetch{
+			Checkpoint: checkpoint,
+			Root:       stateMsg.SnapshotRoot,
+			Peers:      []string{stateMsg.NodeID},
+			Evicted:    make(map[string]bool),
+			Chunks:     make([][]byte, stateMsg.SnapshotChunks),
+			Requested:  make(map[int]bool),
+			Progress:   true,
+		}
+		LogStage(fmt.Sprintf("Fetch Snapshot (SequenceID:%d, Chunks:%d)", checkpoint.SequenceID, stateMsg.SnapshotChunks), false)
+	} else if checkpoint.SequenceID == fetch.Checkpoint.SequenceID && checkpoint.Digest == fetch.Checkpoint.Digest &&
+		stateMsg.SnapshotRoot == fetch.Root && stateMsg.SnapshotChunks == len(fetch.Chunks) {
+		if fetch.Evicted[stateMsg.NodeID] {
+			return
+		}
+		for _, peer := range fetch.Peers {
+			if peer == stateMsg.NodeID {
+				return
+			}
+		}
+		fetch.Peers = append(fetch.Peers, stateMsg.NodeID)
+	} else {
+		return
+	}
+	node.requestChunks()
+}
+
+// restartFetch 在所有提供快照的节点都发送了错误的分块之后放弃下载，从其他节点已经收到的回复中重新开始，
+// evicted 中的节点不再参与。没有可用的回复时等待下一次 fetch-state 的回复。
+func (node *Node) restartFetch(evicted map[string]bool) {
+	node.SnapshotFetch = nil
+	nodeIDs := make([]string, 0, len(node.StateMsgs))
+	for nodeID := range node.StateMsgs {
+		nodeIDs = append(nodeIDs, nodeID)
+	}
+	sort.Strings(nodeIDs)
+
+	for _, nodeID := range nodeIDs {
+		stateMsg := node.StateMsgs[nodeID]
+		if evicted[nodeID] || stateMsg.Checkpoint == nil || stateMsg.Checkpoint.SequenceID <= node.lastSequenceID() {
+			continue
+		}
+		node.fetchSnapshot(stateMsg)
+	}
+	if node.SnapshotFetch != nil {
+		node.SnapshotFetch.Evicted = evicted
+	}
+}
+
+// requestChunks 请求还没有收到的分块，同时等待的请求不超过 MaxChunkRequests 个，不同的分块向不同的节点请求
+func (node *Node) requestChunks() {
+	fetch := node.SnapshotFetch
+	for index := range fetch.Chunks {
+		if len(fetch.Requested) >= MaxChunkRequests {
+			return
+		}
+		if fetch.Chunks[index] != nil || fetch.Requested[index] {
+			continue
+		}
+
+		fetchChunkMsg := &consensus.FetchChunkMsg{
+			SequenceID: fetch.Checkpoint.SequenceID,
+			Index:      index,
+			NodeID:     node.NodeID,
+		}
+		if err := consensus.Sign(node.PrivateKey, fetchChunkMsg); err != nil {
+			fmt.Println(err)
+			return
+		}
+		peer := fetch.Peers[(index+fetch.Round)%len(fetch.Peers)]
+		if err := node.send(node.NodeTable[peer], "/fetchchunk", fetchChunkMsg); err != nil {
+			fmt.Println(err)
+			return
+		}
+		fetch.Requested[index] = true
+	}
+}
+
+// GetFetchChunk 将快照的一块及其 Merkle 路径发送给请求的节点
+func (node *Node) GetFetchChunk(fetchChunkMsg *consensus.FetchChunkMsg) error {
+	if err := node.Keys.Verify(fetchChunkMsg.NodeID, fetchChunkMsg); err != nil {
+		return err
+	}
+	// 快照可能已经随着稳定检查点的更新被丢弃
+	chunks, ok := node.Snapshots[fetchChunkMsg.SequenceID]
+	if !ok || fetchChunkMsg.Index < 0 || fetchChunkMsg.Index >= len(chunks.Chunks) {
+		return nil
+	}
+
+	chunkMsg := &consensus.ChunkMsg{
+		SequenceID: fetchChunkMsg.SequenceID,
+		Index:      fetchChunkMsg.Index,
+		Count:      len(chunks.Chunks),
+		Data:       chunks.Chunks[fetchChunkMsg.Index],
+		Proof:      chunks.Proof(fetchChunkMsg.Index),
+		NodeID:     node.NodeID,
+	}
+	if err := consensus.Sign(node.PrivateKey, chunkMsg); err != nil {
+		return err
+	}
+	return node.send(node.NodeTable[fetchChunkMsg.NodeID], "/chunk", chunkMsg)
+}
+
+// GetChunk 检查收到的分块是否属于正在下载的检查点，收齐所有分块之后安装快照
+func (node *Node) GetChunk(chunkMsg *consensus.ChunkMsg) error {
+	// 未签名的分块可能是其他节点冒充发送者伪造的，不能据此排除诚实的节点
+	if err := node.Keys.Verify(chunkMsg.NodeID, chunkMsg); err != nil {
+		return err
+	}
+	fetch := node.SnapshotFetch
+	if fetch == nil || chunkMsg.SequenceID != fetch.Checkpoint.SequenceID {
+		return nil
+	}
+	if chunkMsg.Index < 0 || chunkMsg.Index >= len(fetch.Chunks) || fetch.Chunks[chunkMsg.Index] != nil {
+		return nil
+	}
+	delete(fetch.Requested, chunkMsg.Index)
+
+	if !consensus.VerifyChunk(fetch.Root, chunkMsg.Index, len(fetch.Chunks), chunkMsg.Data, chunkMsg.Proof) {
+		// 不再向该节点请求分块，没有剩下的节点时重新开始下载
+		fetch.Evicted[chunkMsg.NodeID] = true
+		for i, peer := range fetch.Peers {
+			if peer == chunkMsg.NodeID {
+				fetch.Peers = append(fetch.Peers[:i], fetch.Peers[i+1:]...)
+				break
+			}
+		}
+		if len(fetch.Peers) == 0 {
+			node.restartFetch(fetch.Evicted)
+		} else {
+			node.requestChunks()
+		}
+		return errors.New("snapshot chunk from " + chunkMsg.NodeID + " is corrupted")
+	}
+
+	fetch.Chunks[chunkMsg.Index] = chunkMsg.Data
+	fetch.Received++
+	fetch.Progress = true
+	if fetch.Received < len(fetch.Chunks) {
+		node.requestChunks()
+		return nil
+	}
+
+	node.SnapshotFetch = nil
+	LogStage(fmt.Sprintf("Fetch Snapshot (SequenceID:%d, Chunks:%d)", fetch.Checkpoint.SequenceID, len(fetch.Chunks)), true)
+	if fetch.Checkpoint.SequenceID > node.lastSequenceID() {
+		if err := node.installCheckpoint(fetch.Checkpoint, consensus.NewSnapshotChunks(fetch.Chunks)); err != nil {
+			return err
+		}
+	}
+	return node.applyStateMsgs()
+}
+
+// installCheckpoint 用下载的快照恢复到稳定检查点
+func (node *Node) installCheckpoint(checkpoint *consensus.StableCheckpoint, chunks *consensus.SnapshotChunks) error {
+	if chunks.Digest() != checkpoint.Digest {
+		return errors.New("the snapshot does not match the digest of the checkpoint")
+	}
+	snapshot, err := chunks.Snapshot()
+	if err != nil {
+		return err
+	}
+	if err := node.restore(snapshot); err != nil {
+		return err
+	}
+
+	node.ExecutedSequenceID = checkpoint.SequenceID
+	node.record(&trace.Event{Type: trace.EventRestore, Sequence: checkpoint.SequenceID, Digest: checkpoint.Digest})
+	node.CommitMsgs = make([]*consensus.RequestMsg, 0)
+	if node.SequenceID < checkpoint.SequenceID {
+		node.SequenceID = checkpoint.SequenceID
+	}
+	for sequenceID := range node.CommittedMsgs {
+		if sequenceID <= checkpoint.SequenceID {
+			delete(node.CommittedMsgs, sequenceID)
+		}
+	}
+	node.Snapshots[checkpoint.SequenceID] = chunks
+
+	// 快照中已经执行的请求不需要再等待
+	for _, reqMsg := range node.PendingReqs {
+		if node.Replies.Executed(reqMsg) {
+			node.removePending(reqMsg)
+		}
+	}
+	LogStage(fmt.Sprintf("Install Checkpoint (SequenceID:%d)", checkpoint.SequenceID), true)
+
+	// 丢弃检查点之前的日志，并压缩 WAL
+	return node.stabilize(checkpoint)
+}
@@ -0,0 +1,343 @@
+package network
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// TCP 传输中每条消息是一个帧：
+//
+//	| 4 字节长度 n | 2 字节路径长度 m | m 字节路径 | n-2-m 字节 Payload |
+//
+// 长度均为大端序，n 不包括长度字段本身。
+// 最大的消息是一个批次或者快照的一块（默认各 1 MB，编码之后不到 1.5 MB），以及带有若干个 prepared 证明的 view-change 消息，
+// MaxFrameSize 为它们留出余量，同时限制了错误的对方让本节点分配的内存。
+const (
+	MaxFrameSize     = 8 << 20               // 一个帧的最大长度，超过时关闭连接
+	TCPDialTimeout   = time.Second * 1       // 建立连接的超时时间
+	TCPWriteTimeout  = time.Second * 5       // 写入一个帧的超时时间，对方长时间不读取时断开连接
+	PeerQueueSize    = 1024                  // 每个对方地址等待发送的帧的最大数量，队列满时丢弃新的消息
+	PeerIdleTimeout  = time.Minute * 1       // 对方地址在这段时间内没有消息时关闭连接，例如已经退出的客户端
+	MinReconnectWait = time.Millisecond * 50 // 连接失败之后第一次重连前等待的时间
+	MaxReconnectWait = time.Second * 2       // 每次失败后等待时间加倍，最多等待的时间
+)
+
+// TCPTransport 为每个对方地址保持一个长连接，所有类型的消息都按帧写入同一个连接。
+// 每个对方地址有自己的发送队列和发送 goroutine，慢的节点只会让自己的队列变满，不会阻塞 Broadcast。
+type TCPTransport struct {
+	addr      string
+	listener  net.Listener
+	tlsConfig *tls.Config
+	inbox     chan *Message
+	done      chan struct{}
+
+	mu    sync.Mutex
+	peers map[string]*tcpPeer
+	// 对方建立的连接，关闭时需要一起关闭
+	accepted map[net.Conn]bool
+	closed   bool
+}
+
+// tcpPeer 是发往同一个地址的发送队列，连接只由 run 使用
+type tcpPeer struct {
+	addr      string
+	transport *TCPTransport
+	queue     chan []byte
+
+	conn   net.Conn
+	writer *bufio.Writer
+	// 连接失败之后，在 retryAt 之前发送的帧直接丢弃，等待时间每次失败后加倍
+	retryAt time.Time
+	wait    time.Duration
+}
+
+// NewTCPTransport 在 addr 上开始接收消息，addr 的端口为 0 时由系统分配。tlsConfig 为空时不使用 TLS。
+func NewTCPTransport(addr string, tlsConfig *tls.Config) (*TCPTransport, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+
+	transport := &TCPTransport{
+		addr:      listener.Addr().String(),
+		tlsConfig: tlsConfig,
+		listener:  listener,
+		inbox:     make(chan *Message, ReceiveBufferSize),
+		done:      make(chan struct{}),
+		peers:     make(map[string]*tcpPeer),
+		accepted:  make(map[net.Conn]bool),
+	}
+	go transport.accept()
+	return transport, nil
+}
+
+func (transport *TCPTransport) Addr() string {
+	return transport.addr
+}
+
+// Send 将帧放入 addr 的发送队列，队列已满时丢弃该消息
+func (transport *TCPTransport) Send(addr string, msg *Message) {
+	frame, err := encodeFrame(msg)
+	if err != nil {
+		return
+	}
+
+	transport.mu.Lock()
+	defer transport.mu.Unlock()
+	if transport.closed {
+		return
+	}
+	peer, ok := transport.peers[addr]
+	if !ok {
+		peer = &tcpPeer{
+			addr:      addr,
+			transport: transport,
+			queue:     make(chan []byte, PeerQueueSize),
+		}
+		transport.peers[addr] = peer
+		go peer.run()
+	}
+	select {
+	case peer.queue <- frame:
+	default:
+	}
+}
+
+func (transport *TCPTransport) Broadcast(addrs []string, msg *Message) {
+	broadcast(transport, addrs, msg)
+}
+
+func (transport *TCPTransport) Receive() <-chan *Message {
+	return transport.inbox
+}
+
+// Close 停止接收消息，关闭所有的连接，发送队列中的消息被丢弃
+func (transport *TCPTransport) Close() error {
+	transport.mu.Lock()
+	if transport.closed {
+		transport.mu.Unlock()
+		return nil
+	}
+	transport.closed = true
+	close(transport.done)
+	for conn := range transport.accepted {
+		conn.Close()
+	}
+	transport.mu.Unlock()
+
+	return transport.listener.Close()
+}
+
+// removeIdle 在 peer 的队列为空时将其移除。Send 持有同一个锁，因此不会有消息留在被移除的队列中。
+func (transport *TCPTransport) removeIdle(peer *tcpPeer) bool {
+	transport.mu.Lock()
+	defer transport.mu.Unlock()
+	if len(peer.queue) != 0 {
+		return false
+	}
+	delete(transport.peers, peer.addr)
+	return true
+}
+
+// run 依次发送队列中的帧，直到 transport 被关闭或者长时间没有消息
+func (peer *tcpPeer) run() {
+	defer peer.disconnect()
+
+	idle := time.NewTimer(PeerIdleTimeout)
+	defer idle.Stop()
+	for {
+		select {
+		case frame := <-peer.queue:
+			peer.write(frame)
+			if !idle.Stop() {
+				<-idle.C
+			}
+			idle.Reset(PeerIdleTimeout)
+		case <-idle.C:
+			if peer.transport.removeIdle(peer) {
+				return
+			}
+			idle.Reset(PeerIdleTimeout)
+		case <-peer.transport.done:
+			return
+		}
+	}
+}
+
+// write 写入一个帧，队列中没有更多的帧时再将缓冲区写入连接。
+// 缓存的连接可能已经被对方关闭，写入失败时重新建立一次连接。
+func (peer *tcpPeer) write(frame []byte) {
+	for i := 0; i < 2; i++ {
+		if !peer.connect() {
+			return
+		}
+		peer.conn.SetWriteDeadline(time.Now().Add(TCPWriteTimeout))
+		_, err := peer.writer.Write(frame)
+		if err == nil && len(peer.queue) == 0 {
+			err = peer.writer.Flush()
+		}
+		if err == nil {
+			return
+		}
+		peer.disconnect()
+	}
+}
+
+// connect 在没有连接时建立连接，上一次失败之后的等待时间还没有过去时直接返回 false
+func (peer *tcpPeer) connect() bool {
+	if peer.conn != nil {
+		return true
+	}
+	if time.Now().Before(peer.retryAt) {
+		return false
+	}
+
+	conn, err := peer.transport.dial(peer.addr)
+	if err != nil {
+		if peer.wait == 0 {
+			peer.wait = MinReconnectWait
+		} else if peer.wait < MaxReconnectWait {
+			peer.wait *= 2
+			if peer.wait > MaxReconnectWait {
+				peer.wait = MaxReconnectWait
+			}
+		}
+		peer.retryAt = time.Now().Add(peer.wait)
+		return false
+	}
+	peer.conn = conn
+	peer.writer = bufio.NewWriter(conn)
+	peer.wait = 0
+	return true
+}
+
+func (transport *TCPTransport) dial(addr string) (net.Conn, error) {
+	if transport.tlsConfig == nil {
+		return net.DialTimeout("tcp", addr, TCPDialTimeout)
+	}
+	dialer := &net.Dialer{Timeout: TCPDialTimeout}
+	return tls.DialWithDialer(dialer, "tcp", addr, dialTLSConfig(transport.tlsConfig, addr))
+}
+
+func (peer *tcpPeer) disconnect() {
+	if peer.conn != nil {
+		peer.conn.Close()
+		peer.conn = nil
+		peer.writer = nil
+	}
+}
+
+func (transport *TCPTransport) accept() {
+	for {
+		conn, err := transport.listener.Accept()
+		if err != nil {
+			return
+		}
+		transport.mu.Lock()
+		if transport.closed {
+			transport.mu.Unlock()
+			conn.Close()
+			return
+		}
+		transport.accepted[conn] = true
+		transport.mu.Unlock()
+
+		go transport.read(conn)
+	}
+}
+
+// read 从对方建立的连接中依次读出每个帧，直到连接断开或者收到错误的帧
+func (transport *TCPTransport) read(conn net.Conn) {
+	defer func() {
+		conn.Close()
+		transport.mu.Lock()
+		delete(transport.accepted, conn)
+		transport.mu.Unlock()
+	}()
+
+	// 使用 TLS 时先完成握手，之后这个连接上的每条消息都来自证书中的身份
+	var peer *PeerIdentity
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		tlsConn.SetDeadline(time.Now().Add(TCPDialTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			return
+		}
+		tlsConn.SetDeadline(time.Time{})
+		state := tlsConn.ConnectionState()
+		peer = peerIdentity(&state)
+	}
+
+	reader := bufio.NewReader(conn)
+	for {
+		// 对方在 PeerIdleTimeout 内没有发送消息时关闭连接，例如已经退出的客户端；
+		// 帧的第一个字节到达之后，整个帧需要在发送方写入一个帧的超时时间内到达
+		conn.SetReadDeadline(time.Now().Add(PeerIdleTimeout))
+		if _, err := reader.Peek(1); err != nil {
+			return
+		}
+		conn.SetReadDeadline(time.Now().Add(TCPWriteTimeout))
+		msg, err := decodeFrame(reader)
+		if err != nil {
+			return
+		}
+		msg.Peer = peer
+		select {
+		case transport.inbox <- msg:
+		case <-transport.done:
+			return
+		}
+	}
+}
+
+func encodeFrame(msg *Message) ([]byte, error) {
+	if len(msg.Path) > 0xffff {
+		return nil, errors.New("the path of the message is too long")
+	}
+	size := 2 + len(msg.Path) + len(msg.Payload)
+	if size > MaxFrameSize {
+		return nil, errors.New("the message is too large")
+	}
+
+	frame := make([]byte, 4+size)
+	binary.BigEndian.PutUint32(frame[0:4], uint32(size))
+	binary.BigEndian.PutUint16(frame[4:6], uint16(len(msg.Path)))
+	copy(frame[6:], msg.Path)
+	copy(frame[6+len(msg.Path):], msg.Payload)
+	return frame, nil
+}
+
+func decodeFrame(reader io.Reader) (*Message, error) {
+	var header [6]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header[0:4])
+	pathSize := binary.BigEndian.Uint16(header[4:6])
+	if size > MaxFrameSize || uint32(pathSize)+2 > size {
+		return nil, errors.New("malformed frame")
+	}
+
+	// 按实际收到的数据逐步分配内存，而不是按对方声明的长度一次分配
+	path := make([]byte, pathSize)
+	if _, err := io.ReadFull(reader, path); err != nil {
+		return nil, err
+	}
+	payloadSize := int64(size) - 2 - int64(pathSize)
+	payload, err := io.ReadAll(io.LimitReader(reader, payloadSize))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(payload)) != payloadSize {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return &Message{Path: string(path), Payload: payload}, nil
+}
@@ -0,0 +1,190 @@
+package network
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newLoopbackTransport(t *testing.T, addr string) *TCPTransport {
+	transport, err := NewTCPTransport(addr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { transport.Close() })
+	return transport
+}
+
+// receive 等待 transport 收到下一条消息，超时返回 nil
+func receive(transport Transport, timeout time.Duration) *Message {
+	select {
+	case msg := <-transport.Receive():
+		return msg
+	case <-time.After(timeout):
+		return nil
+	}
+}
+
+func header(size uint32, pathSize uint16) []byte {
+	frame := make([]byte, 6)
+	binary.BigEndian.PutUint32(frame[0:4], size)
+	binary.BigEndian.PutUint16(frame[4:6], pathSize)
+	return frame
+}
+
+func TestFrame(t *testing.T) {
+	tests := []struct {
+		name    string
+		path    string
+		payload []byte
+		err     bool
+	}{
+		{"empty", "", nil, false},
+		{"message", "/prepare", []byte(`{"viewID":1}`), false},
+		{"largest frame", "/chunk", bytes.Repeat([]byte("x"), MaxFrameSize-2-len("/chunk")), false},
+		{"frame too large", "/chunk", bytes.Repeat([]byte("x"), MaxFrameSize-1-len("/chunk")), true},
+		{"path too long", strings.Repeat("p", 0x10000), nil, true},
+	}
+
+	for _, test := range tests {
+		frame, err := encodeFrame(&Message{Path: test.path, Payload: test.payload})
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: encodeFrame succeeds", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: encodeFrame = %v", test.name, err)
+			continue
+		}
+		msg, err := decodeFrame(bytes.NewReader(frame))
+		if err != nil {
+			t.Errorf("%s: decodeFrame = %v", test.name, err)
+			continue
+		}
+		if msg.Path != test.path || !bytes.Equal(msg.Payload, test.payload) {
+			t.Errorf("%s: decoded %q with %d bytes", test.name, msg.Path, len(msg.Payload))
+		}
+	}
+}
+
+func TestDecodeMalformedFrame(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame []byte
+		err   error
+	}{
+		{"truncated header", []byte{0, 0, 0}, io.ErrUnexpectedEOF},
+		{"larger than MaxFrameSize", header(MaxFrameSize+1, 1), nil},
+		{"path longer than the frame", header(4, 3), nil},
+		{"truncated path", append(header(8, 4), "/pr"...), io.ErrUnexpectedEOF},
+		// 声明的长度远大于实际的数据，只分配实际收到的部分
+		{"truncated payload", append(header(MaxFrameSize, 2), "/p{}"...), io.ErrUnexpectedEOF},
+	}
+
+	for _, test := range tests {
+		_, err := decodeFrame(bytes.NewReader(test.frame))
+		if err == nil {
+			t.Errorf("%s: decodeFrame succeeds", test.name)
+			continue
+		}
+		if test.err != nil && !errors.Is(err, test.err) {
+			t.Errorf("%s: decodeFrame = %v, want %v", test.name, err, test.err)
+		}
+	}
+}
+
+func TestTCPTransportLoopback(t *testing.T) {
+	sender := newLoopbackTransport(t, "127.0.0.1:0")
+	receiver := newLoopbackTransport(t, "127.0.0.1:0")
+
+	// 同一个连接上的帧按发送的顺序到达
+	messages := []*Message{
+		{Path: "/prepare", Payload: []byte(`{"sequenceID":1}`)},
+		{Path: "/commit", Payload: []byte(`{"sequenceID":1}`)},
+		{Path: "/chunk", Payload: bytes.Repeat([]byte("x"), 1<<20)},
+		{Path: "/reply", Payload: []byte(`{}`)},
+	}
+	for _, msg := range messages {
+		sender.Send(receiver.Addr(), msg)
+	}
+	for _, expected := range messages {
+		msg := receive(receiver, time.Second*5)
+		if msg == nil {
+			t.Fatalf("%s is not received", expected.Path)
+		}
+		if msg.Path != expected.Path || !bytes.Equal(msg.Payload, expected.Payload) {
+			t.Fatalf("received %s with %d bytes, want %s with %d bytes", msg.Path, len(msg.Payload), expected.Path, len(expected.Payload))
+		}
+		if msg.Peer != nil {
+			t.Errorf("the peer of %s is %+v without TLS", msg.Path, msg.Peer)
+		}
+	}
+}
+
+func TestTCPTransportRejectsLargeFrame(t *testing.T) {
+	receiver := newLoopbackTransport(t, "127.0.0.1:0")
+
+	conn, err := net.Dial("tcp", receiver.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write(append(header(MaxFrameSize+1, 6), "/chunk"...)); err != nil {
+		t.Fatal(err)
+	}
+
+	// 接收方不等待帧的内容，直接关闭连接
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Read = %v, want the connection to be closed", err)
+	}
+	if msg := receive(receiver, time.Millisecond*100); msg != nil {
+		t.Errorf("received %s from an oversized frame", msg.Path)
+	}
+
+	// 其他连接不受影响
+	sender := newLoopbackTransport(t, "127.0.0.1:0")
+	sender.Send(receiver.Addr(), &Message{Path: "/prepare", Payload: []byte(`{}`)})
+	if msg := receive(receiver, time.Second*5); msg == nil || msg.Path != "/prepare" {
+		t.Errorf("received %+v after rejecting a frame, want /prepare", msg)
+	}
+}
+
+func TestTCPTransportReconnect(t *testing.T) {
+	sender := newLoopbackTransport(t, "127.0.0.1:0")
+	receiver, err := NewTCPTransport("127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := receiver.Addr()
+
+	sender.Send(addr, &Message{Path: "/prepare", Payload: []byte("1")})
+	if msg := receive(receiver, time.Second*5); msg == nil {
+		t.Fatal("the first message is not received")
+	}
+
+	// 对方关闭之后，缓存的连接写入失败或者连接失败，这期间的消息被丢弃
+	receiver.Close()
+	for i := 0; i < 3; i++ {
+		sender.Send(addr, &Message{Path: "/prepare", Payload: []byte("lost")})
+		time.Sleep(MinReconnectWait)
+	}
+
+	// 对方在同一个地址上重启之后，发送方在重连的等待时间过去之后重新建立连接
+	restarted := newLoopbackTransport(t, addr)
+	deadline := time.Now().Add(MaxReconnectWait * 3)
+	for time.Now().Before(deadline) {
+		sender.Send(addr, &Message{Path: "/commit", Payload: []byte("2")})
+		if msg := receive(restarted, time.Millisecond*50); msg != nil && msg.Path == "/commit" {
+			return
+		}
+	}
+	t.Fatal("the sender does not reconnect to the restarted peer")
+}
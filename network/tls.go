@@ -0,0 +1,262 @@
+package network
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"goPBFT/consensus"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// TLSDir 是 KeyDir 中保存 TLS 证书的子目录，ca.crt 和 ca.key 为本地 CA，
+// <ID>.crt 和 <ID>.key 为节点或客户端的证书和私钥。
+// 证书的 CommonName 为 NodeID 或 ClientID，OrganizationalUnit 为身份的角色。
+const TLSDir = "tls"
+
+const (
+	ReplicaRole = "replica"
+	ClientRole  = "client"
+)
+
+const (
+	CAName       = "ca"
+	CertValidity = time.Hour * 24 * 365 * 10 // 生成的证书的有效期
+)
+
+// PeerIdentity 是 TLS 连接中对方证书所证明的身份
+type PeerIdentity struct {
+	ID      string
+	Replica bool
+}
+
+// LoadTLSConfig 读取 id 的证书以及 CA，返回双向认证的 TLS 配置：
+// 对方必须出示由同一个 CA 签发的证书，否则连接在握手时被拒绝。
+func LoadTLSConfig(dir string, id string) (*tls.Config, error) {
+	tlsDir := filepath.Join(dir, TLSDir)
+	cert, err := tls.LoadX509KeyPair(filepath.Join(tlsDir, id+".crt"), filepath.Join(tlsDir, id+".key"))
+	if err != nil {
+		return nil, err
+	}
+	caPEM, err := os.ReadFile(filepath.Join(tlsDir, CAName+".crt"))
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, errors.New("no certificate in " + filepath.Join(tlsDir, CAName+".crt"))
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// dialTLSConfig 返回连接 addr 时使用的配置，服务端的证书需要包含 addr 中的主机名或 IP
+func dialTLSConfig(config *tls.Config, addr string) *tls.Config {
+	dialConfig := config.Clone()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		dialConfig.ServerName = host
+	}
+	return dialConfig
+}
+
+// peerIdentity 从已经验证的证书链中取出对方的身份，没有证书时返回 nil
+func peerIdentity(state *tls.ConnectionState) *PeerIdentity {
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return nil
+	}
+	cert := state.PeerCertificates[0]
+	identity := &PeerIdentity{ID: cert.Subject.CommonName}
+	for _, unit := range cert.Subject.OrganizationalUnit {
+		if unit == ReplicaRole {
+			identity.Replica = true
+		}
+	}
+	return identity
+}
+
+// CheckPeer 检查消息中声明的发送者是否就是证书中的身份，peer 为空（不使用 TLS）时不检查。
+// 共识消息只能由同名的节点发送；请求可以由客户端本人发送，也可以由转发请求的节点发送。
+func CheckPeer(peer *PeerIdentity, msg interface{}) error {
+	if peer == nil {
+		return nil
+	}
+
+	var claimed string
+	switch msg := msg.(type) {
+	case *consensus.RequestMsg:
+		if peer.Replica || peer.ID == msg.ClinetID {
+			return nil
+		}
+		return errors.New("the request of " + msg.ClinetID + " is sent by " + peer.ID)
+	case *consensus.PrePrepareMsg:
+		claimed = msg.NodeID
+	case *consensus.VoteMsg:
+		claimed = msg.NodeID
+	case *consensus.ReplyMsg:
+		claimed = msg.NodeID
+	case *consensus.ViewChangeMsg:
+		claimed = msg.NodeID
+	case *consensus.NewViewMsg:
+		claimed = msg.NodeID
+	case *consensus.CheckpointMsg:
+		claimed = msg.NodeID
+	case *consensus.FetchStateMsg:
+		claimed = msg.NodeID
+	case *consensus.StateMsg:
+		claimed = msg.NodeID
+	case *consensus.FetchChunkMsg:
+		claimed = msg.NodeID
+	case *consensus.ChunkMsg:
+		claimed = msg.NodeID
+	default:
+		return errors.New("unknown message type")
+	}
+	if !peer.Replica || peer.ID != claimed {
+		return errors.New("the message of " + claimed + " is sent by " + peer.ID)
+	}
+	return nil
+}
+
+// GenerateCA 生成本地 CA，用于测试集群，已经存在的 CA 不会被覆盖
+func GenerateCA(dir string) error {
+	tlsDir := filepath.Join(dir, TLSDir)
+	if err := os.MkdirAll(tlsDir, 0700); err != nil {
+		return err
+	}
+	if _, err := os.Stat(filepath.Join(tlsDir, CAName+".key")); err == nil {
+		return nil
+	}
+
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	template, err := certTemplate(pkix.Name{CommonName: "PBFT local CA"})
+	if err != nil {
+		return err
+	}
+	template.IsCA = true
+	template.BasicConstraintsValid = true
+	template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &privateKey.PublicKey, privateKey)
+	if err != nil {
+		return err
+	}
+	return writeCertificate(tlsDir, CAName, der, privateKey)
+}
+
+// GenerateCertificate 用本地 CA 为 id 签发证书，hosts 为证书中的主机名或 IP。
+// 节点和客户端既接受连接也发起连接，因此证书同时用于服务端和客户端认证。已经存在的证书不会被覆盖。
+func GenerateCertificate(dir string, id string, role string, hosts []string) error {
+	tlsDir := filepath.Join(dir, TLSDir)
+	if _, err := os.Stat(filepath.Join(tlsDir, id+".key")); err == nil {
+		return nil
+	}
+
+	ca, err := tls.LoadX509KeyPair(filepath.Join(tlsDir, CAName+".crt"), filepath.Join(tlsDir, CAName+".key"))
+	if err != nil {
+		return err
+	}
+	caCert, err := x509.ParseCertificate(ca.Certificate[0])
+	if err != nil {
+		return err
+	}
+
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	template, err := certTemplate(pkix.Name{CommonName: id, OrganizationalUnit: []string{role}})
+	if err != nil {
+		return err
+	}
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &privateKey.PublicKey, ca.PrivateKey)
+	if err != nil {
+		return err
+	}
+	return writeCertificate(tlsDir, id, der, privateKey)
+}
+
+// GenerateTLSCertificates 生成本地 CA，并为节点列表中的每个节点以及 clientIDs 中的客户端签发证书。
+// 节点证书包含节点地址中的主机，客户端在本机接收回复，证书包含 localhost 和 127.0.0.1。
+func GenerateTLSCertificates(config *Config, clientIDs []string) error {
+	if err := GenerateCA(config.KeyDir); err != nil {
+		return err
+	}
+	for _, nodeID := range config.NodeIDs() {
+		if err := GenerateNodeCertificate(config.KeyDir, nodeID, config.Nodes[nodeID].Addr); err != nil {
+			return err
+		}
+	}
+	for _, clientID := range clientIDs {
+		if err := GenerateCertificate(config.KeyDir, clientID, ClientRole, []string{"localhost", "127.0.0.1"}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GenerateNodeCertificate 为监听在 addr 上的节点签发证书
+func GenerateNodeCertificate(dir string, nodeID string, addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	hosts := []string{host}
+	if host == "localhost" {
+		hosts = append(hosts, "127.0.0.1")
+	}
+	return GenerateCertificate(dir, nodeID, ReplicaRole, hosts)
+}
+
+func certTemplate(subject pkix.Name) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      subject,
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(CertValidity),
+	}, nil
+}
+
+func writeCertificate(dir string, id string, der []byte, privateKey *ecdsa.PrivateKey) error {
+	keyDER, err := x509.MarshalECPrivateKey(privateKey)
+	if err != nil {
+		return err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(filepath.Join(dir, id+".key"), keyPEM, 0600); err != nil {
+		return err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	return os.WriteFile(filepath.Join(dir, id+".crt"), certPEM, 0644)
+}
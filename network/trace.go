@@ -0,0 +1,78 @@
+package network
+
+import (
+	"goPBFT/consensus"
+	"goPBFT/trace"
+	"sort"
+)
+
+// record 在轨迹中记录一个事件，没有开启轨迹时什么也不做
+func (node *Node) record(event *trace.Event) {
+	if node.Trace == nil || event == nil {
+		return
+	}
+	event.Time = node.Clock.Now()
+	event.Node = node.NodeID
+	node.Trace.Record(event)
+}
+
+// recordCommit 记录由投票提交的批次，以及计入法定人数的投票
+func (node *Node) recordCommit(state *consensus.State) {
+	if node.Trace == nil {
+		return
+	}
+	node.record(&trace.Event{
+		Type:     trace.EventCommit,
+		View:     state.ViewID,
+		Sequence: state.SequenceID,
+		Digest:   state.MsgLogs.Digest,
+		Replicas: node.replicaIDs(),
+		Source:   trace.SourceVotes,
+		Prepares: state.Voters(consensus.PrepareMsg),
+		Commits:  state.Voters(consensus.CommitMsg),
+	})
+}
+
+// recordStateCommit 记录由状态传输提交的批次，以及回复了该批次的节点
+func (node *Node) recordStateCommit(prePrepareMsg *consensus.PrePrepareMsg) {
+	if node.Trace == nil {
+		return
+	}
+	senders := make([]string, 0)
+	for nodeID, stateMsg := range node.StateMsgs {
+		for _, committed := range stateMsg.CommittedMsgs {
+			if committed.SequenceID == prePrepareMsg.SequenceID && committed.Digest == prePrepareMsg.Digest {
+				senders = append(senders, nodeID)
+				break
+			}
+		}
+	}
+	sort.Strings(senders)
+	node.record(&trace.Event{
+		Type:     trace.EventCommit,
+		View:     prePrepareMsg.ViewID,
+		Sequence: prePrepareMsg.SequenceID,
+		Digest:   prePrepareMsg.Digest,
+		Replicas: node.replicaIDs(),
+		Source:   trace.SourceState,
+		Commits:  senders,
+	})
+}
+
+// recordExecute 记录执行的批次
+func (node *Node) recordExecute(sequenceID int64, committedMsg *CommittedMsg) {
+	if node.Trace == nil {
+		return
+	}
+	requests := make([]string, 0, len(committedMsg.PrePrepareMsg.RequestMsgs))
+	for _, reqMsg := range committedMsg.PrePrepareMsg.RequestMsgs {
+		requests = append(requests, trace.RequestKey(reqMsg))
+	}
+	node.record(&trace.Event{
+		Type:     trace.EventExecute,
+		View:     committedMsg.ViewID,
+		Sequence: sequenceID,
+		Digest:   committedMsg.PrePrepareMsg.Digest,
+		Requests: requests,
+	})
+}
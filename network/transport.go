@@ -0,0 +1,58 @@
+package network
+
+import (
+	"crypto/tls"
+	"errors"
+)
+
+// 可以在配置文件中选择的传输方式，集群中的节点和客户端必须相同
+const (
+	HTTPTransportType = "http"
+	TCPTransportType  = "tcp"
+)
+
+// Message 是传输层上的一条消息。Path 为消息的类型，沿用 HTTP 中的路由（如 "/prepare"），
+// Payload 为 JSON 编码的消息。
+type Message struct {
+	Path    string
+	Payload []byte
+	// 使用 TLS 时为发送者证书中的身份，由接收方的传输层填写，不使用 TLS 时为空
+	Peer *PeerIdentity
+}
+
+// Transport 在节点以及客户端之间传递消息，节点只通过它收发消息，不关心底层的协议。
+// 地址即为 NodeTable 中的地址或者客户端的 ReplyAddr。
+type Transport interface {
+	// Addr 返回本地接收消息的地址
+	Addr() string
+	// Send 异步地将消息发送给 addr，不等待对方处理，发送失败的消息直接丢弃
+	Send(addr string, msg *Message)
+	// Broadcast 将消息发送给 addrs 中的每一个地址
+	Broadcast(addrs []string, msg *Message)
+	// Receive 返回接收到的消息
+	Receive() <-chan *Message
+	// Close 停止接收消息并关闭所有连接
+	Close() error
+}
+
+// ReceiveBufferSize 是每个 Transport 中等待处理的消息的最大数量
+const ReceiveBufferSize = 1024
+
+// NewTransport 创建 transportType 对应的传输方式，并开始在 addr 上接收消息。
+// tlsConfig 不为空时所有的连接都使用双向认证的 TLS。
+func NewTransport(transportType string, addr string, tlsConfig *tls.Config) (Transport, error) {
+	switch transportType {
+	case HTTPTransportType:
+		return NewHTTPTransport(addr, tlsConfig)
+	case TCPTransportType:
+		return NewTCPTransport(addr, tlsConfig)
+	}
+	return nil, errors.New("unknown transport " + transportType)
+}
+
+// broadcast 依次调用 Send，供没有更高效的广播方式的实现使用
+func broadcast(transport Transport, addrs []string, msg *Message) {
+	for _, addr := range addrs {
+		transport.Send(addr, msg)
+	}
+}
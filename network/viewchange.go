@@ -0,0 +1,288 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"goPBFT/consensus"
+	"goPBFT/trace"
+	"sort"
+	"time"
+)
+
+// viewChanging 判断节点是否正在进行视图切换
+func (node *Node) viewChanging() bool {
+	return node.ViewChangeID > node.View.ID
+}
+
+// replicaIDs 返回按字典序排列的副本集合 R
+func (node *Node) replicaIDs() []string {
+	ids := make([]string, 0, len(node.NodeTable))
+	for nodeID := range node.NodeTable {
+		ids = append(ids, nodeID)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// primaryOf 根据 p = v mod |R| 计算视图 v 的主节点
+func (node *Node) primaryOf(viewID int64) string {
+	ids := node.replicaIDs()
+	return ids[viewID%int64(len(ids))]
+}
+
+// StartViewChange 停止接收当前视图中的消息，并广播切换到 newViewID 的 view-change 消息
+func (node *Node) StartViewChange(newViewID int64) error {
+	if newViewID <= node.ViewChangeID {
+		return nil
+	}
+
+	LogStage(fmt.Sprintf("View Change (ViewID:%d)", newViewID), false)
+	node.ViewChangeID = newViewID
+	node.stopTimer()
+	if err := node.persistView(); err != nil {
+		return err
+	}
+
+	// MACMode 中还需要携带已经接受的 pre-prepare 消息
+	var prePrepareMsgs map[int64]*consensus.PrePrepareMsg
+	if node.Keys.Mode == consensus.MACMode {
+		prePrepareMsgs = node.PrePrepareMsgs
+	}
+	viewChangeMsg := consensus.CreateViewChange(newViewID, node.StableCheckpoint, node.PreparedCerts, prePrepareMsgs)
+	viewChangeMsg.NodeID = node.NodeID
+	node.saveViewChangeMsg(viewChangeMsg)
+	node.Broadcast(viewChangeMsg, "/viewchange")
+
+	// 如果新视图迟迟没有建立，计时器会再次超时并切换到下一个视图
+	node.startTimer()
+
+	return node.tryNewView(newViewID)
+}
+
+// GetViewChange 处理其他节点发来的 view-change 消息
+func (node *Node) GetViewChange(viewChangeMsg *consensus.ViewChangeMsg) error {
+	LogMsg(viewChangeMsg)
+
+	// 过期的视图切换消息直接忽略
+	if viewChangeMsg.NewViewID <= node.View.ID {
+		return nil
+	}
+	if err := consensus.VerifyViewChange(viewChangeMsg, node.Keys); err != nil {
+		return err
+	}
+	node.saveViewChangeMsg(viewChangeMsg)
+
+	// 已经有 f+1 个节点要求切换到更高的视图时，说明至少有一个正常节点怀疑主节点，本节点也加入视图切换
+	if newViewID, ok := consensus.ViewChangeTarget(node.ViewChangeMsgs, node.ViewChangeID, node.Keys.Quorum()); ok {
+		err := node.StartViewChange(newViewID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return node.tryNewView(viewChangeMsg.NewViewID)
+}
+
+// GetNewView 处理新视图主节点发来的 new-view 消息
+func (node *Node) GetNewView(newViewMsg *consensus.NewViewMsg) error {
+	LogMsg(newViewMsg)
+
+	if newViewMsg.ViewID <= node.View.ID {
+		return nil
+	}
+	if newViewMsg.NodeID != node.primaryOf(newViewMsg.ViewID) {
+		return errors.New("new-view message is not sent by the primary of the new view")
+	}
+	if err := consensus.VerifyNewView(newViewMsg, node.Keys); err != nil {
+		return err
+	}
+
+	node.enterView(newViewMsg)
+	return nil
+}
+
+// tryNewView 由新视图的主节点调用，收集到 2f+1 个 view-change 消息后广播 new-view 消息
+func (node *Node) tryNewView(viewID int64) error {
+	if !node.viewChanging() || viewID != node.ViewChangeID || node.primaryOf(viewID) != node.NodeID {
+		return nil
+	}
+
+	newViewMsg, err := consensus.CreateNewView(viewID, node.ViewChangeMsgs[viewID], node.Keys)
+	if err != nil {
+		// 还没有收集到足够的 view-change 消息
+		return nil
+	}
+	newViewMsg.NodeID = node.NodeID
+
+	// 重新提议的 pre-prepare 消息同样由新的主节点签名
+	for _, prePrepareMsg := range newViewMsg.PrePrepareMsgs {
+		prePrepareMsg.NodeID = node.NodeID
+		if err := consensus.Sign(node.PrivateKey, prePrepareMsg); err != nil {
+			return err
+		}
+	}
+
+	node.Broadcast(newViewMsg, "/newview")
+	node.enterView(newViewMsg)
+	return nil
+}
+
+// setView 切换到视图 viewID，旧视图中的共识实例不再需要，prepared 证明已经单独保存
+func (node *Node) setView(viewID int64) {
+	node.View = &View{
+		ID:      viewID,
+		Primary: node.primaryOf(viewID),
+	}
+	if node.ViewChangeID < node.View.ID {
+		node.ViewChangeID = node.View.ID
+	}
+	node.stopTimer()
+	if err := node.persistView(); err != nil {
+		fmt.Println(err)
+	}
+	node.record(&trace.Event{Type: trace.EventView, View: node.View.ID})
+
+	for key := range node.States {
+		if key.ViewID < node.View.ID {
+			delete(node.States, key)
+		}
+	}
+}
+
+// enterView 切换到新视图，并处理 new-view 消息中重新提议的 pre-prepare 消息
+func (node *Node) enterView(newViewMsg *consensus.NewViewMsg) {
+	node.setView(newViewMsg.ViewID)
+	if err := node.WAL.Append(&walRecord{Type: walNewView, NewViewMsg: newViewMsg}); err != nil {
+		fmt.Println(err)
+	}
+
+	// 新视图的主节点紧接着 max-s 分配序列号。之前的视图中分配过的更大的序列号已经作废，
+	// 不能跳过它们，否则新的序列号之前留下的空缺永远不会被执行
+	_, maxSequenceID := newViewMsg.SequenceRange()
+	node.SequenceID = maxSequenceID
+
+	for viewID := range node.ViewChangeMsgs {
+		if viewID <= node.View.ID {
+			delete(node.ViewChangeMsgs, viewID)
+		}
+	}
+	LogStage(fmt.Sprintf("View Change (ViewID:%d, Primary:%s)", node.View.ID, node.View.Primary), true)
+
+	// 新视图中已经重新提议的请求不需要再转发给主节点
+	reproposed := make(map[string]bool)
+	for _, prePrepareMsg := range newViewMsg.PrePrepareMsgs {
+		for _, reqMsg := range prePrepareMsg.RequestMsgs {
+			reproposed[pendingKey(reqMsg)] = true
+		}
+	}
+	keys := make([]string, 0, len(node.PendingReqs))
+	for key := range node.PendingReqs {
+		if !reproposed[key] {
+			keys = append(keys, key)
+		}
+	}
+	// 按固定的顺序重新处理，dispatchMsg 正在处理本信息，因此在计时器的回调中交给节点
+	sort.Strings(keys)
+	for _, key := range keys {
+		reqMsg := node.PendingReqs[key]
+		delete(node.PendingReqs, key)
+		node.Clock.AfterFunc(0, func() {
+			node.post(reqMsg)
+		})
+	}
+
+	// 重新提议的请求可以同时进行共识，已经处于稳定检查点之前的序列号不需要再处理
+	for _, prePrepareMsg := range newViewMsg.PrePrepareMsgs {
+		if prePrepareMsg.SequenceID <= node.StableCheckpoint.SequenceID {
+			continue
+		}
+		LogMsg(prePrepareMsg)
+		err := node.acceptPrePrepare(prePrepareMsg)
+		if err != nil {
+			fmt.Println(err)
+		}
+	}
+
+	// 处理视图切换期间暂存的请求
+	errs := node.routeMsgWhenAlarmed()
+	for _, err := range errs {
+		fmt.Println(err)
+	}
+}
+
+// resolveViewChangeAlarm 处理请求计时器超时
+func (node *Node) resolveViewChangeAlarm(alarm *viewChangeAlarm) error {
+	// 计时器开启之后节点已经切换过视图，忽略本次超时
+	if alarm.ViewID != node.ViewChangeID {
+		return nil
+	}
+	node.ViewChangeTimer = nil
+	return node.StartViewChange(node.ViewChangeID + 1)
+}
+
+// startTimer 开启请求计时器，视图切换连续失败时等待时间加倍
+func (node *Node) startTimer() {
+	if node.ViewChangeTimer != nil {
+		return
+	}
+
+	viewID := node.ViewChangeID
+	timeout := time.Duration(node.Config.ViewChangeTimeout)
+	for i := node.View.ID; i < viewID && timeout < time.Duration(node.Config.ViewChangeTimeout)*64; i++ {
+		timeout *= 2
+	}
+	node.ViewChangeTimer = node.Clock.AfterFunc(timeout, func() {
+		node.post(&viewChangeAlarm{viewID})
+	})
+}
+
+func (node *Node) stopTimer() {
+	if node.ViewChangeTimer == nil {
+		return
+	}
+	node.ViewChangeTimer.Stop()
+	node.ViewChangeTimer = nil
+}
+
+// addPending 记录等待执行的请求，已经执行过的请求不需要等待
+func (node *Node) addPending(reqMsg *consensus.RequestMsg) {
+	if reqMsg == nil || node.Replies.Executed(reqMsg) {
+		return
+	}
+	node.PendingReqs[pendingKey(reqMsg)] = reqMsg
+	node.startTimer()
+}
+
+// removePending 请求执行后停止计时器，若还有其他等待执行的请求则重新计时
+func (node *Node) removePending(reqMsg *consensus.RequestMsg) {
+	delete(node.PendingReqs, pendingKey(reqMsg))
+	node.stopTimer()
+	if len(node.PendingReqs) != 0 {
+		node.startTimer()
+	}
+}
+
+// saveViewChangeMsg 只保留每个节点最新的 view-change 消息，发送者进入更高的视图之后不再支持之前的视图，
+// 因此一个错误的节点不能让日志无限增长
+func (node *Node) saveViewChangeMsg(viewChangeMsg *consensus.ViewChangeMsg) {
+	for viewID, viewChangeMsgs := range node.ViewChangeMsgs {
+		if _, ok := viewChangeMsgs[viewChangeMsg.NodeID]; !ok || viewID == viewChangeMsg.NewViewID {
+			continue
+		}
+		if viewID > viewChangeMsg.NewViewID {
+			return
+		}
+		delete(viewChangeMsgs, viewChangeMsg.NodeID)
+		if len(viewChangeMsgs) == 0 {
+			delete(node.ViewChangeMsgs, viewID)
+		}
+	}
+	if node.ViewChangeMsgs[viewChangeMsg.NewViewID] == nil {
+		node.ViewChangeMsgs[viewChangeMsg.NewViewID] = make(map[string]*consensus.ViewChangeMsg)
+	}
+	node.ViewChangeMsgs[viewChangeMsg.NewViewID][viewChangeMsg.NodeID] = viewChangeMsg
+}
+
+func pendingKey(reqMsg *consensus.RequestMsg) string {
+	return fmt.Sprintf("%s/%d", reqMsg.ClinetID, reqMsg.Timestamp)
+}
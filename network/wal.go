@@ -0,0 +1,367 @@
+package network
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"goPBFT/consensus"
+	"goPBFT/trace"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// WALDir 保存每个节点的预写日志
+const WALDir = "wal"
+
+// WAL 中记录的类型
+const (
+	walView       = "view"       // 当前视图以及正在切换的视图
+	walNewView    = "newview"    // 进入当前视图的 new-view 消息，主节点从其中的 max-s 之后分配序列号
+	walPrePrepare = "preprepare" // 接受或发送的 pre-prepare 消息
+	walVote       = "vote"       // 本节点发送的 prepare、commit 消息
+	walPrepared   = "prepared"   // prepared 证明
+	walCommitted  = "committed"  // 已经提交的批次
+	walCheckpoint = "checkpoint" // 稳定检查点及其快照的文件名（快照保存在同一目录下的单独文件中），压缩日志时写在最前面
+)
+
+type walRecord struct {
+	Type          string                      `json:"type"`
+	ViewID        int64                       `json:"viewID"`
+	ViewChangeID  int64                       `json:"viewChangeID"`
+	NewViewMsg    *consensus.NewViewMsg       `json:"newViewMsg,omitempty"`
+	PrePrepareMsg *consensus.PrePrepareMsg    `json:"prePrepareMsg,omitempty"`
+	VoteMsg       *consensus.VoteMsg          `json:"voteMsg,omitempty"`
+	PreparedCert  *consensus.PreparedCert     `json:"preparedCert,omitempty"`
+	Checkpoint    *consensus.StableCheckpoint `json:"checkpoint,omitempty"`
+	Snapshot      string                      `json:"snapshot,omitempty"`
+}
+
+// sequenceID 返回记录所属的序列号，视图记录不属于任何序列号
+func (record *walRecord) sequenceID() int64 {
+	switch {
+	case record.PrePrepareMsg != nil:
+		return record.PrePrepareMsg.SequenceID
+	case record.VoteMsg != nil:
+		return record.VoteMsg.SequenceID
+	case record.PreparedCert != nil:
+		return record.PreparedCert.PrePrepareMsg.SequenceID
+	case record.Checkpoint != nil:
+		return record.Checkpoint.SequenceID
+	}
+	return -1
+}
+
+// WAL 是按行保存 JSON 记录的追加写日志，每条记录 fsync 之后才返回，
+// 节点在发送消息之前先写入日志，重启后不会发送与之前矛盾的消息。
+type WAL struct {
+	path    string
+	file    *os.File
+	records []*walRecord
+}
+
+// OpenWAL 打开节点的日志并读出其中的记录。只有最后一条没有换行的记录是崩溃时未写完的，会被截断；
+// 中间的记录损坏时返回错误，不会静默地丢弃已经落盘的记录。
+func OpenWAL(dir string, nodeID string) (*WAL, []*walRecord, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, nil, err
+	}
+	path := filepath.Join(dir, nodeID+".wal")
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	records := make([]*walRecord, 0)
+	var offset int64
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			// io.EOF 时 line 为节点崩溃时没有写完的记录
+			if err != io.EOF {
+				file.Close()
+				return nil, nil, err
+			}
+			break
+		}
+		// 以换行结尾的记录已经完整写入，无法解析说明日志已经损坏，不能丢弃它之后的记录
+		var record walRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			file.Close()
+			return nil, nil, fmt.Errorf("%s: corrupt record at offset %d: %v", path, offset, err)
+		}
+		records = append(records, &record)
+		offset += int64(len(line))
+	}
+
+	if err := file.Truncate(offset); err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+
+	return &WAL{path, file, records}, records, nil
+}
+
+// Append 写入一条记录并等待其落盘，wal 为 nil 时不做任何持久化
+func (wal *WAL) Append(record *walRecord) error {
+	if wal == nil {
+		return nil
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if _, err := wal.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if err := wal.file.Sync(); err != nil {
+		return err
+	}
+	wal.records = append(wal.records, record)
+	return nil
+}
+
+// Compact 将稳定检查点的快照写入单独的文件，然后用一条检查点记录替换日志中该检查点之前的记录，视图记录和 new-view 记录只保留最后一条。
+// 快照和新日志都先写入临时文件，fsync 之后再替换，新日志落盘之后才删除之前的快照。
+func (wal *WAL) Compact(checkpoint *consensus.StableCheckpoint, snapshot *consensus.SnapshotChunks) error {
+	if wal == nil {
+		return nil
+	}
+
+	name := fmt.Sprintf("%s.%d.snapshot", strings.TrimSuffix(filepath.Base(wal.path), ".wal"), checkpoint.SequenceID)
+	if err := writeFile(filepath.Join(filepath.Dir(wal.path), name), snapshot.Data()); err != nil {
+		return err
+	}
+
+	var view, newView *walRecord
+	records := []*walRecord{{Type: walCheckpoint, Checkpoint: checkpoint, Snapshot: name}}
+	for _, record := range wal.records {
+		switch {
+		case record.Type == walView:
+			view = record
+		case record.Type == walNewView:
+			newView = record
+		case record.sequenceID() > checkpoint.SequenceID:
+			records = append(records, record)
+		}
+	}
+	// new-view 消息之后是它所在的视图的记录，重放时两者的顺序不变
+	if newView != nil {
+		records = append(records, newView)
+	}
+	if view != nil {
+		records = append(records, view)
+	}
+
+	var buffer bytes.Buffer
+	for _, record := range records {
+		line, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		buffer.Write(append(line, '\n'))
+	}
+	if err := writeFile(wal.path, buffer.Bytes()); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(wal.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	wal.file.Close()
+	wal.file = file
+	wal.records = records
+	wal.removeSnapshots(name)
+	return nil
+}
+
+// readSnapshot 读取检查点记录中的快照文件，并检查它是否与检查点的摘要一致
+func (wal *WAL) readSnapshot(record *walRecord) (*consensus.SnapshotChunks, error) {
+	data, err := os.ReadFile(filepath.Join(filepath.Dir(wal.path), record.Snapshot))
+	if err != nil {
+		return nil, err
+	}
+	snapshot := consensus.SplitSnapshot(data)
+	if snapshot.Digest() != record.Checkpoint.Digest {
+		return nil, errors.New("the snapshot " + record.Snapshot + " does not match the digest of the checkpoint")
+	}
+	return snapshot, nil
+}
+
+// removeSnapshots 删除除了 keep 以外本节点的快照文件，包括压缩日志之前崩溃时留下的快照
+func (wal *WAL) removeSnapshots(keep string) {
+	pattern := strings.TrimSuffix(wal.path, ".wal") + ".*.snapshot"
+	paths, err := filepath.Glob(pattern)
+	if err != nil {
+		return
+	}
+	for _, path := range paths {
+		if filepath.Base(path) != keep {
+			os.Remove(path)
+		}
+	}
+}
+
+func (wal *WAL) Close() error {
+	if wal == nil {
+		return nil
+	}
+	return wal.file.Close()
+}
+
+// writeFile 先将 data 写入临时文件并 fsync，再替换 path，崩溃之后 path 要么是原来的内容，要么是完整的新内容
+func writeFile(path string, data []byte) error {
+	tmpPath := path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir 保证 rename 之后目录项也已经落盘
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
+
+// persistView 记录当前视图以及正在切换的视图
+func (node *Node) persistView() error {
+	return node.WAL.Append(&walRecord{
+		Type:         walView,
+		ViewID:       node.View.ID,
+		ViewChangeID: node.ViewChangeID,
+	})
+}
+
+// persistSent 在消息签名之后、发送之前记录主节点的 pre-prepare 消息和本节点的投票
+func (node *Node) persistSent(msg interface{}) error {
+	switch msg := msg.(type) {
+	case *consensus.PrePrepareMsg:
+		return node.WAL.Append(&walRecord{Type: walPrePrepare, PrePrepareMsg: msg})
+	case *consensus.VoteMsg:
+		return node.WAL.Append(&walRecord{Type: walVote, VoteMsg: msg})
+	}
+	return nil
+}
+
+// replay 按顺序重放日志中的记录，恢复视图、稳定检查点、共识实例、prepared 证明和已提交的批次，
+// 之后重新执行检查点之后已经提交的批次。
+func (node *Node) replay(records []*walRecord) error {
+	viewChangeID := node.ViewChangeID
+	var newViewMsg *consensus.NewViewMsg
+	for _, record := range records {
+		switch record.Type {
+		case walCheckpoint:
+			chunks, err := node.WAL.readSnapshot(record)
+			if err != nil {
+				return err
+			}
+			snapshot, err := chunks.Snapshot()
+			if err != nil {
+				return err
+			}
+			if err := node.restore(snapshot); err != nil {
+				return err
+			}
+			node.StableCheckpoint = record.Checkpoint
+			node.ExecutedSequenceID = record.Checkpoint.SequenceID
+			node.record(&trace.Event{Type: trace.EventRestore, Sequence: record.Checkpoint.SequenceID, Digest: record.Checkpoint.Digest})
+			node.Snapshots[record.Checkpoint.SequenceID] = chunks
+			if node.SequenceID < record.Checkpoint.SequenceID {
+				node.SequenceID = record.Checkpoint.SequenceID
+			}
+		case walNewView:
+			newViewMsg = record.NewViewMsg
+		case walView:
+			node.View = &View{
+				ID:      record.ViewID,
+				Primary: node.primaryOf(record.ViewID),
+			}
+			node.ViewChangeID = record.ViewID
+			viewChangeID = record.ViewChangeID
+		case walPrePrepare:
+			prePrepareMsg := record.PrePrepareMsg
+			node.PrePrepareMsgs[prePrepareMsg.SequenceID] = prePrepareMsg
+			key := consensus.InstanceKey{ViewID: prePrepareMsg.ViewID, SequenceID: prePrepareMsg.SequenceID}
+			node.States[key] = consensus.RestoreState(prePrepareMsg, node.Keys)
+		case walVote:
+			key := consensus.InstanceKey{ViewID: record.VoteMsg.ViewID, SequenceID: record.VoteMsg.SequenceID}
+			if state, ok := node.States[key]; ok {
+				state.RestoreVote(record.VoteMsg)
+			}
+		case walPrepared:
+			node.PreparedCerts[record.PreparedCert.PrePrepareMsg.SequenceID] = record.PreparedCert
+		case walCommitted:
+			if record.PrePrepareMsg.SequenceID > node.ExecutedSequenceID {
+				node.CommittedMsgs[record.PrePrepareMsg.SequenceID] = &CommittedMsg{record.ViewID, record.PrePrepareMsg}
+			}
+		}
+	}
+
+	// 之前视图中的共识实例不再需要，pre-prepare 消息和 prepared 证明已经单独恢复
+	for key := range node.States {
+		if key.ViewID != node.View.ID || key.SequenceID <= node.StableCheckpoint.SequenceID {
+			delete(node.States, key)
+		}
+	}
+	for sequenceID := range node.PrePrepareMsgs {
+		if sequenceID <= node.StableCheckpoint.SequenceID {
+			delete(node.PrePrepareMsgs, sequenceID)
+		}
+	}
+	for sequenceID := range node.PreparedCerts {
+		if sequenceID <= node.StableCheckpoint.SequenceID {
+			delete(node.PreparedCerts, sequenceID)
+		}
+	}
+
+	// 与 enterView 相同，主节点从当前视图的 max-s 之后分配序列号，此后还要跳过本视图中已经分配的序列号；
+	// 其他视图中的 pre-prepare 消息不影响序列号
+	if newViewMsg != nil && newViewMsg.ViewID == node.View.ID {
+		_, maxSequenceID := newViewMsg.SequenceRange()
+		if node.SequenceID < maxSequenceID {
+			node.SequenceID = maxSequenceID
+		}
+	}
+	for sequenceID, prePrepareMsg := range node.PrePrepareMsgs {
+		if prePrepareMsg.ViewID == node.View.ID && node.SequenceID < sequenceID {
+			node.SequenceID = sequenceID
+		}
+	}
+
+	node.execute()
+
+	// 重启之前正在进行视图切换，重新发送 view-change 消息并等待新视图
+	if viewChangeID > node.View.ID {
+		return node.StartViewChange(viewChangeID)
+	}
+	return nil
+}
@@ -0,0 +1,319 @@
+package network
+
+import (
+	"bytes"
+	"fmt"
+	"goPBFT/consensus"
+	"goPBFT/kvstore"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var walTestNodes = []string{"Node0", "Node1", "Node2", "Node3"}
+
+// walTestConfig 生成 4 个节点的密钥，返回 Node0 的配置，WAL 保存在 dir 中
+func walTestConfig(t *testing.T, dir string) *Config {
+	keyDir := filepath.Join(dir, KeyDir)
+	if err := GenerateKeysFrom(keyDir, walTestNodes, rand.New(rand.NewSource(1))); err != nil {
+		t.Fatal(err)
+	}
+	config := DefaultConfig()
+	config.NodeID = walTestNodes[0]
+	config.Nodes = make(map[string]*NodeConfig)
+	for _, nodeID := range walTestNodes {
+		config.Nodes[nodeID] = &NodeConfig{Addr: nodeID}
+	}
+	config.KeyDir = keyDir
+	config.DataDir = filepath.Join(dir, config.NodeID)
+	return config
+}
+
+// restartNode 从 WAL 中恢复节点，返回节点和它的状态机
+func restartNode(t *testing.T, config *Config) (*Node, *kvstore.Store, error) {
+	transport, err := NewMemoryNetwork().Listen(config.NodeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := kvstore.NewStore()
+	node, err := CreateNode(config, store, transport, SystemClock{})
+	if err != nil {
+		transport.Close()
+		return nil, nil, err
+	}
+	t.Cleanup(func() {
+		node.WAL.Close()
+		transport.Close()
+	})
+	return node, store, nil
+}
+
+// writeWAL 以节点写入的方式追加记录
+func writeWAL(t *testing.T, config *Config, records ...*walRecord) {
+	wal, _, err := OpenWAL(config.WALDir(), config.NodeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	for _, record := range records {
+		if err := wal.Append(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// batch 返回视图 viewID 中序列号为 sequenceID 的批次，每个操作为一个请求
+func batch(viewID int64, sequenceID int64, operations ...string) *consensus.PrePrepareMsg {
+	requests := make([]*consensus.RequestMsg, 0, len(operations))
+	for i, operation := range operations {
+		requests = append(requests, &consensus.RequestMsg{
+			Timestamp: sequenceID*100 + int64(i) + 1,
+			ClinetID:  "Client0",
+			Operation: operation,
+		})
+	}
+	return &consensus.PrePrepareMsg{ViewID: viewID, SequenceID: sequenceID, RequestMsgs: requests, NodeID: walTestNodes[viewID%4]}
+}
+
+// committed 返回 pre-prepare 和提交两条记录
+func committed(prePrepareMsg *consensus.PrePrepareMsg) []*walRecord {
+	return []*walRecord{
+		{Type: walPrePrepare, PrePrepareMsg: prePrepareMsg},
+		{Type: walCommitted, ViewID: prePrepareMsg.ViewID, PrePrepareMsg: prePrepareMsg},
+	}
+}
+
+func checkStore(t *testing.T, store *kvstore.Store, expected map[string]string) {
+	t.Helper()
+	if len(store.Data) != len(expected) {
+		t.Errorf("store = %v, want %v", store.Data, expected)
+		return
+	}
+	for key, value := range expected {
+		if store.Data[key] != value {
+			t.Errorf("store = %v, want %v", store.Data, expected)
+			return
+		}
+	}
+}
+
+func TestWALReplay(t *testing.T) {
+	config := walTestConfig(t, t.TempDir())
+
+	// 视图 0 中提交了 0、1，主节点已经分配到 5；视图 1 的 new-view 消息重新提议了 2、3，其中 2 已经提交
+	records := append(committed(batch(0, 0, "PUT a 1")), committed(batch(0, 1, "PUT b 2"))...)
+	records = append(records,
+		&walRecord{Type: walPrePrepare, PrePrepareMsg: batch(0, 2, "PUT c 3")},
+		&walRecord{Type: walVote, VoteMsg: &consensus.VoteMsg{ViewID: 0, SequenceID: 2, NodeID: config.NodeID, MsgType: consensus.PrepareMsg}},
+		&walRecord{Type: walPrePrepare, PrePrepareMsg: batch(0, 5, "PUT d 4")},
+		&walRecord{Type: walView, ViewID: 1, ViewChangeID: 1},
+		&walRecord{Type: walNewView, NewViewMsg: &consensus.NewViewMsg{
+			ViewID:         1,
+			PrePrepareMsgs: []*consensus.PrePrepareMsg{batch(1, 2, "PUT c 3"), batch(1, 3)},
+		}},
+		&walRecord{Type: walPrePrepare, PrePrepareMsg: batch(1, 3)},
+	)
+	records = append(records, committed(batch(1, 2, "PUT c 3"))...)
+	writeWAL(t, config, records...)
+
+	node, store, err := restartNode(t, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node.View.ID != 1 || node.ViewChangeID != 1 {
+		t.Errorf("view = %d, view change = %d, want 1, 1", node.View.ID, node.ViewChangeID)
+	}
+	if node.ExecutedSequenceID != 2 {
+		t.Errorf("ExecutedSequenceID = %d, want 2", node.ExecutedSequenceID)
+	}
+	// 视图 0 中分配的 5 已经作废，主节点从 new-view 消息的 max-s 之后继续分配
+	if node.SequenceID != 3 {
+		t.Errorf("SequenceID = %d, want 3", node.SequenceID)
+	}
+	checkStore(t, store, map[string]string{"a": "1", "b": "2", "c": "3"})
+
+	if prePrepareMsg := node.PrePrepareMsgs[2]; prePrepareMsg == nil || prePrepareMsg.ViewID != 1 {
+		t.Errorf("pre-prepare 2 = %+v, want the one of view 1", prePrepareMsg)
+	}
+	for key := range node.States {
+		if key.ViewID != 1 {
+			t.Errorf("instance %+v of an earlier view is restored", key)
+		}
+	}
+	if _, ok := node.States[consensus.InstanceKey{ViewID: 1, SequenceID: 3}]; !ok {
+		t.Error("instance 3 of view 1 is not restored")
+	}
+}
+
+func TestWALDamagedTail(t *testing.T) {
+	tests := []struct {
+		name string
+		// damage 修改日志文件的内容
+		damage func(data []byte) []byte
+		// 恢复之后执行到的序列号，-2 表示节点拒绝启动
+		executed int64
+	}{
+		{
+			name:     "intact",
+			damage:   func(data []byte) []byte { return data },
+			executed: 2,
+		},
+		{
+			name: "torn last record",
+			damage: func(data []byte) []byte {
+				return append(data, []byte(`{"type":"committed","viewID":0,"prePrep`)...)
+			},
+			executed: 2,
+		},
+		{
+			name: "last record cut in the middle",
+			damage: func(data []byte) []byte {
+				lines := bytes.SplitAfter(data, []byte("\n"))
+				last := lines[len(lines)-2]
+				return data[:len(data)-len(last)/2-1]
+			},
+			executed: 1,
+		},
+		{
+			name: "corrupt record in the middle",
+			damage: func(data []byte) []byte {
+				lines := bytes.SplitAfter(data, []byte("\n"))
+				lines[1] = []byte("{\"type\":\"committed\",\"viewID\":0,garbage\n")
+				return bytes.Join(lines, nil)
+			},
+			executed: -2,
+		},
+		{
+			name: "corrupt last record with a newline",
+			damage: func(data []byte) []byte {
+				return append(data, []byte("not json\n")...)
+			},
+			executed: -2,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := walTestConfig(t, t.TempDir())
+			records := committed(batch(0, 0, "PUT a 1"))
+			records = append(records, committed(batch(0, 1, "PUT b 2"))...)
+			records = append(records, committed(batch(0, 2, "PUT c 3"))...)
+			writeWAL(t, config, records...)
+
+			path := filepath.Join(config.WALDir(), config.NodeID+".wal")
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, test.damage(data), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			node, _, err := restartNode(t, config)
+			if test.executed == -2 {
+				if err == nil {
+					t.Fatal("the node starts from a corrupt log")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if node.ExecutedSequenceID != test.executed {
+				t.Errorf("ExecutedSequenceID = %d, want %d", node.ExecutedSequenceID, test.executed)
+			}
+
+			// 截断之后的日志可以继续追加，重启后读到完整的记录
+			if err := node.WAL.Append(committed(batch(0, 3, "PUT d 4"))[0]); err != nil {
+				t.Fatal(err)
+			}
+			node.WAL.Close()
+			wal, recovered, err := OpenWAL(config.WALDir(), config.NodeID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer wal.Close()
+			last := recovered[len(recovered)-1]
+			if last.Type != walPrePrepare || last.PrePrepareMsg.SequenceID != 3 {
+				t.Errorf("last record = %+v, want the pre-prepare of 3", last)
+			}
+		})
+	}
+}
+
+func TestWALCompact(t *testing.T) {
+	config := walTestConfig(t, t.TempDir())
+	records := make([]*walRecord, 0)
+	expected := make(map[string]string)
+	for sequenceID := int64(0); sequenceID < consensus.CheckpointPeriod; sequenceID++ {
+		key, value := fmt.Sprintf("k%d", sequenceID), fmt.Sprintf("v%d", sequenceID)
+		records = append(records, committed(batch(0, sequenceID, "PUT "+key+" "+value))...)
+		expected[key] = value
+	}
+	records = append(records, &walRecord{Type: walView, ViewID: 0, ViewChangeID: 0})
+	writeWAL(t, config, records...)
+
+	// 重放时执行到检查点，生成快照之后压缩日志
+	node, _, err := restartNode(t, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sequenceID := int64(consensus.CheckpointPeriod - 1)
+	chunks := node.Snapshots[sequenceID]
+	if chunks == nil {
+		t.Fatalf("no snapshot at %d", sequenceID)
+	}
+	checkpoint := &consensus.StableCheckpoint{SequenceID: sequenceID, Digest: chunks.Digest()}
+	if err := node.WAL.Compact(checkpoint, chunks); err != nil {
+		t.Fatal(err)
+	}
+	for _, record := range committed(batch(0, sequenceID+1, "PUT last 1")) {
+		if err := node.WAL.Append(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected["last"] = "1"
+	node.WAL.Close()
+
+	wal, compacted, err := OpenWAL(config.WALDir(), config.NodeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wal.Close()
+	if compacted[0].Type != walCheckpoint || compacted[0].Checkpoint.SequenceID != sequenceID {
+		t.Errorf("first record = %+v, want the checkpoint", compacted[0])
+	}
+	for _, record := range compacted[1:] {
+		if record.Type != walView && record.sequenceID() <= sequenceID {
+			t.Errorf("record %+v before the checkpoint is kept", record)
+		}
+	}
+
+	node, store, err := restartNode(t, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node.StableCheckpoint.SequenceID != sequenceID {
+		t.Errorf("stable checkpoint = %d, want %d", node.StableCheckpoint.SequenceID, sequenceID)
+	}
+	if node.ExecutedSequenceID != sequenceID+1 {
+		t.Errorf("ExecutedSequenceID = %d, want %d", node.ExecutedSequenceID, sequenceID+1)
+	}
+	checkStore(t, store, expected)
+	node.WAL.Close()
+
+	// 快照与检查点的摘要不一致时拒绝启动
+	path := filepath.Join(config.WALDir(), compacted[0].Snapshot)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)/2] ^= 0xff
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := restartNode(t, config); err == nil {
+		t.Error("the node starts from a corrupt snapshot")
+	}
+}
@@ -0,0 +1,338 @@
+package simulation
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"goPBFT/consensus"
+	"goPBFT/network"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Outgoing 是拜占庭节点将要发出的一条消息。Resign 为 true 时在发送之前用本节点的密钥重新签名，
+// 被修改过的消息都需要重新签名，重放的消息保持原样。
+type Outgoing struct {
+	To     string
+	Path   string
+	Msg    interface{}
+	Delay  time.Duration
+	Resign bool
+}
+
+// Behavior 是拜占庭节点的一种行为。节点发出的每条消息依次经过每个 Behavior，
+// Tamper 返回替换这条消息的零条或多条消息。
+type Behavior interface {
+	Tamper(byzantine *Byzantine, out *Outgoing) []*Outgoing
+}
+
+// Byzantine 包装一个节点的传输层。节点本身仍然按照协议运行，但它发出的消息由 behaviors 改写，
+// 改写之后的消息用节点自己的密钥签名，即拜占庭节点只能做它的密钥允许它做的事情。
+type Byzantine struct {
+	sim       *Simulator
+	replica   *replica
+	endpoint  *Endpoint
+	behaviors []Behavior
+
+	// 主节点发给被欺骗的节点的另一个摘要
+	conflicts map[consensus.InstanceKey]string
+	// 收到和发出的投票，以及已经重放到的视图
+	votes        []*consensus.VoteMsg
+	seenVotes    map[string]bool
+	replayedView int64
+}
+
+func newByzantine(sim *Simulator, r *replica, endpoint *Endpoint, behaviors []Behavior) *Byzantine {
+	return &Byzantine{
+		sim:       sim,
+		replica:   r,
+		endpoint:  endpoint,
+		behaviors: behaviors,
+		conflicts: make(map[consensus.InstanceKey]string),
+		seenVotes: make(map[string]bool),
+	}
+}
+
+// Node 返回被包装的节点
+func (byzantine *Byzantine) Node() *network.Node {
+	return byzantine.replica.node
+}
+
+// Replicas 返回除本节点以外按字典序排列的副本
+func (byzantine *Byzantine) Replicas() []string {
+	ids := make([]string, 0, len(byzantine.Node().NodeTable))
+	for nodeID := range byzantine.Node().NodeTable {
+		if nodeID != byzantine.replica.id {
+			ids = append(ids, nodeID)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Elapsed 返回模拟开始之后经过的虚拟时间
+func (byzantine *Byzantine) Elapsed() time.Duration {
+	return byzantine.sim.clock.Elapsed()
+}
+
+func (byzantine *Byzantine) Addr() string {
+	return byzantine.endpoint.Addr()
+}
+
+func (byzantine *Byzantine) Send(addr string, msg *network.Message) {
+	// 从 WAL 中恢复时节点还没有创建完成，恢复期间发出的消息保持原样
+	if byzantine.Node() == nil {
+		byzantine.endpoint.Send(addr, msg)
+		return
+	}
+	decoded, err := network.DecodeMessage(msg)
+	if err != nil {
+		byzantine.sim.fail(err)
+		return
+	}
+	outgoing := []*Outgoing{{To: addr, Path: msg.Path, Msg: decoded}}
+	for _, behavior := range byzantine.behaviors {
+		tampered := make([]*Outgoing, 0, len(outgoing))
+		for _, out := range outgoing {
+			tampered = append(tampered, behavior.Tamper(byzantine, out)...)
+		}
+		outgoing = tampered
+	}
+	for _, out := range outgoing {
+		byzantine.Deliver(out)
+	}
+}
+
+func (byzantine *Byzantine) Broadcast(addrs []string, msg *network.Message) {
+	for _, addr := range addrs {
+		byzantine.Send(addr, msg)
+	}
+}
+
+func (byzantine *Byzantine) Receive() <-chan *network.Message {
+	return nil
+}
+
+func (byzantine *Byzantine) Close() error {
+	return byzantine.endpoint.Close()
+}
+
+// Deliver 签名并发送一条消息，不再经过 behaviors
+func (byzantine *Byzantine) Deliver(out *Outgoing) {
+	if out.Resign {
+		if err := byzantine.sign(out.Msg); err != nil {
+			byzantine.sim.fail(err)
+			return
+		}
+	}
+	payload, err := json.Marshal(out.Msg)
+	if err != nil {
+		byzantine.sim.fail(err)
+		return
+	}
+	msg := &network.Message{Path: out.Path, Payload: payload}
+	if out.Delay <= 0 {
+		byzantine.endpoint.Send(out.To, msg)
+		return
+	}
+	// 节点崩溃之后延迟的消息也不再发送
+	byzantine.replica.clock.AfterFunc(out.Delay, func() {
+		byzantine.endpoint.Send(out.To, msg)
+	})
+}
+
+// sign 和 Node.Broadcast 一样，MACMode 中的投票计算认证码，其余消息签名
+func (byzantine *Byzantine) sign(msg interface{}) error {
+	node := byzantine.Node()
+	if voteMsg, ok := msg.(*consensus.VoteMsg); ok && node.Keys.Mode == consensus.MACMode {
+		return node.Keys.AddAuthenticators(voteMsg)
+	}
+	if signedMsg, ok := msg.(consensus.SignedMsg); ok {
+		return consensus.Sign(node.PrivateKey, signedMsg)
+	}
+	return nil
+}
+
+// received 在节点处理收到的消息之前调用，记录其他节点的投票用于重放
+func (byzantine *Byzantine) received(msg interface{}) {
+	if voteMsg, ok := msg.(*consensus.VoteMsg); ok {
+		byzantine.recordVote(voteMsg)
+	}
+}
+
+func (byzantine *Byzantine) recordVote(voteMsg *consensus.VoteMsg) {
+	key := fmt.Sprintf("%s/%d/%d/%d", voteMsg.NodeID, voteMsg.ViewID, voteMsg.SequenceID, voteMsg.MsgType)
+	if byzantine.seenVotes[key] {
+		return
+	}
+	byzantine.seenVotes[key] = true
+	copied := *voteMsg
+	byzantine.votes = append(byzantine.votes, &copied)
+}
+
+// Equivocate 让主节点对一半的备份节点发送另一个批次：批次中有多个请求时顺序相反，只有一个请求时为空批次。
+// 之后发给这些节点的投票也改为另一个摘要，两组节点都能看到主节点支持自己收到的批次。
+type Equivocate struct{}
+
+func (Equivocate) Tamper(byzantine *Byzantine, out *Outgoing) []*Outgoing {
+	if !byzantine.deceived(out.To) {
+		return []*Outgoing{out}
+	}
+
+	switch msg := out.Msg.(type) {
+	case *consensus.PrePrepareMsg:
+		requests := make([]*consensus.RequestMsg, 0, len(msg.RequestMsgs))
+		if len(msg.RequestMsgs) > 1 {
+			for i := len(msg.RequestMsgs) - 1; i >= 0; i-- {
+				requests = append(requests, msg.RequestMsgs[i])
+			}
+		}
+		digest, err := consensus.BatchDigest(requests)
+		if err != nil || digest == msg.Digest {
+			return []*Outgoing{out}
+		}
+		msg.RequestMsgs = requests
+		msg.Digest = digest
+		byzantine.conflicts[consensus.InstanceKey{ViewID: msg.ViewID, SequenceID: msg.SequenceID}] = digest
+		out.Resign = true
+	case *consensus.VoteMsg:
+		if digest, ok := byzantine.conflicts[consensus.InstanceKey{ViewID: msg.ViewID, SequenceID: msg.SequenceID}]; ok {
+			msg.Digest = digest
+			out.Resign = true
+		}
+	}
+	return []*Outgoing{out}
+}
+
+// deceived 判断主节点是否对 to 发送另一个批次，被欺骗的是按字典序排在后一半的副本
+func (byzantine *Byzantine) deceived(to string) bool {
+	replicas := byzantine.Replicas()
+	index := sort.SearchStrings(replicas, to)
+	return index < len(replicas) && replicas[index] == to && index >= len(replicas)/2
+}
+
+// ForgeVotes 在每个投票之外，再以其他每个副本的名义发送同样内容的投票，签名仍然是本节点的
+type ForgeVotes struct{}
+
+func (ForgeVotes) Tamper(byzantine *Byzantine, out *Outgoing) []*Outgoing {
+	voteMsg, ok := out.Msg.(*consensus.VoteMsg)
+	if !ok {
+		return []*Outgoing{out}
+	}
+	outgoing := []*Outgoing{out}
+	for _, nodeID := range byzantine.Replicas() {
+		if nodeID == out.To {
+			continue
+		}
+		forged := *voteMsg
+		forged.NodeID = nodeID
+		outgoing = append(outgoing, &Outgoing{To: out.To, Path: out.Path, Msg: &forged, Delay: out.Delay, Resign: true})
+	}
+	return outgoing
+}
+
+// ReplayVotes 在节点进入新视图之后，将之前视图中收到和发出的所有投票原样重放给其他副本。
+// 其他节点的投票带有它们自己的签名或认证码，只有视图能区分它们。
+type ReplayVotes struct{}
+
+func (ReplayVotes) Tamper(byzantine *Byzantine, out *Outgoing) []*Outgoing {
+	if voteMsg, ok := out.Msg.(*consensus.VoteMsg); ok {
+		byzantine.recordVote(voteMsg)
+	}
+
+	viewID := byzantine.Node().View.ID
+	if viewID <= byzantine.replayedView {
+		return []*Outgoing{out}
+	}
+	byzantine.replayedView = viewID
+
+	remaining := make([]*consensus.VoteMsg, 0)
+	for _, voteMsg := range byzantine.votes {
+		if voteMsg.ViewID >= viewID {
+			remaining = append(remaining, voteMsg)
+			continue
+		}
+		path := "/prepare"
+		if voteMsg.MsgType == consensus.CommitMsg {
+			path = "/commit"
+		}
+		for _, nodeID := range byzantine.Replicas() {
+			replayed := *voteMsg
+			byzantine.Deliver(&Outgoing{To: byzantine.sim.addr(nodeID), Path: path, Msg: &replayed})
+		}
+	}
+	byzantine.votes = remaining
+	return []*Outgoing{out}
+}
+
+// Silent 从 From 开始不再发送任何消息，但仍然接收并处理消息
+type Silent struct {
+	From time.Duration
+}
+
+func (silent Silent) Tamper(byzantine *Byzantine, out *Outgoing) []*Outgoing {
+	if byzantine.Elapsed() >= silent.From {
+		return nil
+	}
+	return []*Outgoing{out}
+}
+
+// DelayCommits 将每个 commit 投票推迟 Delay 之后再发送
+type DelayCommits struct {
+	Delay time.Duration
+}
+
+func (delay DelayCommits) Tamper(byzantine *Byzantine, out *Outgoing) []*Outgoing {
+	if voteMsg, ok := out.Msg.(*consensus.VoteMsg); ok && voteMsg.MsgType == consensus.CommitMsg {
+		out.Delay += delay.Delay
+	}
+	return []*Outgoing{out}
+}
+
+// Scenario 是一组拜占庭节点和它们的行为，Nodes 不为 0 时覆盖模拟的节点数量
+type Scenario struct {
+	Name      string
+	Nodes     int
+	Byzantine map[string][]Behavior
+}
+
+// Scenarios 是安全性测试中运行的场景，每个场景中拜占庭节点的数量都不超过 f
+var Scenarios = []*Scenario{
+	{Name: "equivocate", Byzantine: map[string][]Behavior{"Node0": {Equivocate{}}}},
+	{Name: "equivocate-forge", Byzantine: map[string][]Behavior{"Node0": {Equivocate{}, ForgeVotes{}}}},
+	{Name: "forge", Byzantine: map[string][]Behavior{"Node2": {ForgeVotes{}}}},
+	{Name: "silent", Byzantine: map[string][]Behavior{"Node2": {Silent{}}}},
+	{Name: "silent-primary", Byzantine: map[string][]Behavior{"Node0": {Silent{From: time.Millisecond * 300}}}},
+	{Name: "delay-commits", Byzantine: map[string][]Behavior{"Node0": {DelayCommits{Delay: time.Second * 2}}}},
+	// 主节点沉默之后切换视图，另一个拜占庭节点将视图 0 中的投票重放到新视图
+	{Name: "replay", Nodes: 7, Byzantine: map[string][]Behavior{
+		"Node0": {Silent{From: time.Millisecond * 300}},
+		"Node2": {ReplayVotes{}},
+	}},
+	{Name: "equivocate-replay", Nodes: 7, Byzantine: map[string][]Behavior{
+		"Node0": {Equivocate{}, ForgeVotes{}, Silent{From: time.Millisecond * 500}},
+		"Node2": {ReplayVotes{}, DelayCommits{Delay: time.Second}},
+	}},
+}
+
+// FindScenarios 按名称查找场景，名称用逗号分隔，all 表示所有场景
+func FindScenarios(names string) ([]*Scenario, error) {
+	if names == "all" {
+		return Scenarios, nil
+	}
+	scenarios := make([]*Scenario, 0)
+	for _, name := range strings.Split(names, ",") {
+		found := false
+		for _, scenario := range Scenarios {
+			if scenario.Name == name {
+				scenarios = append(scenarios, scenario)
+				found = true
+			}
+		}
+		if !found {
+			return nil, errors.New("unknown scenario " + name)
+		}
+	}
+	return scenarios, nil
+}
@@ -0,0 +1,36 @@
+package simulation
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScenarios(t *testing.T) {
+	discardStdout(t)
+
+	for _, scenario := range Scenarios {
+		t.Run(scenario.Name, func(t *testing.T) {
+			config := &Config{
+				Seed:      1,
+				Nodes:     4,
+				Clients:   3,
+				Requests:  10,
+				Keys:      4,
+				Faults:    Faults{MinDelay: time.Millisecond, MaxDelay: time.Millisecond * 20},
+				Byzantine: scenario.Byzantine,
+				Timeout:   time.Minute * 10,
+			}
+			if scenario.Nodes != 0 {
+				config.Nodes = scenario.Nodes
+			}
+
+			result, err := Run(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Violation != nil {
+				t.Fatalf("seed %d: %v", result.Seed, result.Violation)
+			}
+		})
+	}
+}
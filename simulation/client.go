@@ -0,0 +1,139 @@
+package simulation
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"goPBFT/consensus"
+	"goPBFT/network"
+	"time"
+)
+
+// RetransmitTimeout 是模拟的客户端等待回复的虚拟时间，超时后请求会被广播给所有节点
+const RetransmitTimeout = time.Second * 5
+
+// Operation 是客户端提交的一个操作，Invoke 和 Complete 为模拟开始之后的虚拟时间
+type Operation struct {
+	ClientID  string
+	Timestamp int64
+	Operation string
+	Result    string
+	Invoke    time.Duration
+	Complete  time.Duration
+	Done      bool
+}
+
+// simClient 依次提交操作，每个操作收到 f+1 个相同的回复之后再提交下一个，行为和 client.Client 相同
+type simClient struct {
+	sim        *Simulator
+	id         string
+	privateKey ed25519.PrivateKey
+	endpoint   *Endpoint
+
+	view          int64
+	lastTimestamp int64
+	remaining     int
+	current       *consensus.RequestMsg
+	operation     *Operation
+	results       map[string]map[string]int64
+	timer         network.Timer
+}
+
+// submit 提交下一个操作，没有剩余的操作时返回
+func (client *simClient) submit() {
+	if client.remaining == 0 {
+		return
+	}
+	client.remaining--
+
+	timestamp := client.sim.clock.Now().UnixNano()
+	if timestamp <= client.lastTimestamp {
+		timestamp = client.lastTimestamp + 1
+	}
+	client.lastTimestamp = timestamp
+
+	reqMsg := &consensus.RequestMsg{
+		Timestamp: timestamp,
+		ClinetID:  client.id,
+		Operation: client.sim.workload.Next(client.id),
+		ReplyAddr: client.endpoint.Addr(),
+	}
+	if err := consensus.Sign(client.privateKey, reqMsg); err != nil {
+		client.sim.fail(err)
+		return
+	}
+	client.current = reqMsg
+	client.results = make(map[string]map[string]int64)
+	client.operation = &Operation{
+		ClientID:  client.id,
+		Timestamp: timestamp,
+		Operation: reqMsg.Operation,
+		Invoke:    client.sim.clock.Elapsed(),
+	}
+	client.sim.result.Operations = append(client.sim.result.Operations, client.operation)
+
+	client.send(false)
+}
+
+// send 将当前的请求发送给客户端所知道的主节点，all 为 true 时广播给所有节点
+func (client *simClient) send(all bool) {
+	jsonMsg, err := json.Marshal(client.current)
+	if err != nil {
+		client.sim.fail(err)
+		return
+	}
+	msg := &network.Message{Path: "/req", Payload: jsonMsg}
+	if all {
+		client.endpoint.Broadcast(client.sim.nodeAddrs(), msg)
+	} else {
+		ids := client.sim.nodeIDs
+		client.endpoint.Send(client.sim.addr(ids[client.view%int64(len(ids))]), msg)
+	}
+
+	current := client.current
+	client.timer = client.sim.clock.AfterFunc(RetransmitTimeout, func() {
+		if client.current == current {
+			client.send(true)
+		}
+	})
+}
+
+func (client *simClient) receive(msg *network.Message) {
+	decoded, err := network.DecodeMessage(msg)
+	if err != nil {
+		return
+	}
+	replyMsg, ok := decoded.(*consensus.ReplyMsg)
+	if !ok || client.current == nil || replyMsg.ClientID != client.id || replyMsg.Timestamp != client.current.Timestamp {
+		return
+	}
+	if err := client.sim.keys.Verify(replyMsg.NodeID, replyMsg); err != nil {
+		return
+	}
+
+	if client.results[replyMsg.Result] == nil {
+		client.results[replyMsg.Result] = make(map[string]int64)
+	}
+	client.results[replyMsg.Result][replyMsg.NodeID] = replyMsg.ViewID
+	if len(client.results[replyMsg.Result]) < consensus.NewQuorum(len(client.sim.nodeIDs)).Reply() {
+		return
+	}
+	// 和 client.Client 一样只采用 f+1 个回复中最小的视图
+	view := replyMsg.ViewID
+	for _, viewID := range client.results[replyMsg.Result] {
+		if viewID < view {
+			view = viewID
+		}
+	}
+	if view > client.view {
+		client.view = view
+	}
+
+	client.operation.Result = replyMsg.Result
+	client.operation.Complete = client.sim.clock.Elapsed()
+	client.operation.Done = true
+	client.sim.observe(fmt.Sprintf("complete %s %d %s", client.id, client.current.Timestamp, replyMsg.Result))
+	client.current = nil
+	client.timer.Stop()
+	client.submit()
+}
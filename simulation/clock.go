@@ -0,0 +1,107 @@
+package simulation
+
+import (
+	"container/heap"
+	"goPBFT/network"
+	"time"
+)
+
+// Epoch 是虚拟时间的起点，每次模拟都从这里开始
+var Epoch = time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// VirtualClock 是离散事件模拟的时钟。时间只在取出下一个事件时前进，
+// 同一时刻的事件按照加入的顺序执行，因此同样的输入总是得到同样的执行顺序。
+type VirtualClock struct {
+	now    time.Time
+	events eventQueue
+	seq    uint64
+}
+
+type event struct {
+	at   time.Time
+	seq  uint64
+	fn   func()
+	done bool
+}
+
+func NewVirtualClock() *VirtualClock {
+	return &VirtualClock{now: Epoch}
+}
+
+func (clock *VirtualClock) Now() time.Time {
+	return clock.now
+}
+
+// Elapsed 返回模拟开始之后经过的虚拟时间
+func (clock *VirtualClock) Elapsed() time.Duration {
+	return clock.now.Sub(Epoch)
+}
+
+// AfterFunc 在虚拟时间经过 d 之后调用 f，f 总是在 Step 中执行
+func (clock *VirtualClock) AfterFunc(d time.Duration, f func()) network.Timer {
+	if d < 0 {
+		d = 0
+	}
+	clock.seq++
+	e := &event{at: clock.now.Add(d), seq: clock.seq, fn: f}
+	heap.Push(&clock.events, e)
+	return e
+}
+
+// Step 执行下一个事件，没有事件时返回 false
+func (clock *VirtualClock) Step() bool {
+	if len(clock.events) == 0 {
+		return false
+	}
+	e := heap.Pop(&clock.events).(*event)
+	e.done = true
+	clock.now = e.at
+	e.fn()
+	return true
+}
+
+// Next 返回下一个事件的时间
+func (clock *VirtualClock) Next() (time.Time, bool) {
+	if len(clock.events) == 0 {
+		return time.Time{}, false
+	}
+	return clock.events[0].at, true
+}
+
+// Stop 取消还没有执行的事件
+func (e *event) Stop() bool {
+	if e.done {
+		return false
+	}
+	e.done = true
+	e.fn = func() {}
+	return true
+}
+
+// eventQueue 是按照 (时间, 加入顺序) 排列的最小堆
+type eventQueue []*event
+
+func (q eventQueue) Len() int { return len(q) }
+
+func (q eventQueue) Less(i, j int) bool {
+	if !q[i].at.Equal(q[j].at) {
+		return q[i].at.Before(q[j].at)
+	}
+	return q[i].seq < q[j].seq
+}
+
+func (q eventQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+}
+
+func (q *eventQueue) Push(x interface{}) {
+	*q = append(*q, x.(*event))
+}
+
+func (q *eventQueue) Pop() interface{} {
+	old := *q
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	return e
+}
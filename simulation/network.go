@@ -0,0 +1,116 @@
+package simulation
+
+import (
+	"goPBFT/network"
+	"math/rand"
+	"time"
+)
+
+// Faults 描述模拟网络中每条消息的命运：先以 DropRate 的概率丢弃，
+// 否则在 [MinDelay, MaxDelay] 之间随机延迟之后送达，并以 DuplicateRate 的概率再独立地送达一次。
+// 每条消息的延迟相互独立，因此消息会被乱序送达。
+type Faults struct {
+	MinDelay      time.Duration
+	MaxDelay      time.Duration
+	DropRate      float64
+	DuplicateRate float64
+}
+
+// Network 是模拟器中的网络，所有的随机决定都来自同一个带种子的随机数生成器
+type Network struct {
+	clock     *VirtualClock
+	random    *rand.Rand
+	faults    Faults
+	endpoints map[string]*Endpoint
+	// 每条送达的消息，用于计算模拟的指纹
+	observe func(from string, to string, msg *network.Message)
+}
+
+// Endpoint 是模拟网络上的一个地址，实现 network.Transport。
+// 送达的消息直接交给 handler，不经过 Receive。
+type Endpoint struct {
+	addr    string
+	simnet  *Network
+	handler func(msg *network.Message)
+	closed  bool
+}
+
+func newNetwork(clock *VirtualClock, random *rand.Rand, faults Faults) *Network {
+	return &Network{
+		clock:     clock,
+		random:    random,
+		faults:    faults,
+		endpoints: make(map[string]*Endpoint),
+	}
+}
+
+// listen 在 addr 上创建新的地址，之前在同一个地址上的 Endpoint 不再收到消息
+func (simnet *Network) listen(addr string, handler func(msg *network.Message)) *Endpoint {
+	if old, ok := simnet.endpoints[addr]; ok {
+		old.closed = true
+	}
+	endpoint := &Endpoint{addr: addr, simnet: simnet, handler: handler}
+	simnet.endpoints[addr] = endpoint
+	return endpoint
+}
+
+func (simnet *Network) transmit(from string, to string, msg *network.Message) {
+	if simnet.random.Float64() < simnet.faults.DropRate {
+		return
+	}
+	copies := 1
+	if simnet.random.Float64() < simnet.faults.DuplicateRate {
+		copies++
+	}
+	for i := 0; i < copies; i++ {
+		simnet.clock.AfterFunc(simnet.delay(), func() {
+			endpoint, ok := simnet.endpoints[to]
+			if !ok || endpoint.closed {
+				return
+			}
+			if simnet.observe != nil {
+				simnet.observe(from, to, msg)
+			}
+			endpoint.handler(msg)
+		})
+	}
+}
+
+func (simnet *Network) delay() time.Duration {
+	delay := simnet.faults.MinDelay
+	if spread := simnet.faults.MaxDelay - simnet.faults.MinDelay; spread > 0 {
+		delay += time.Duration(simnet.random.Int63n(int64(spread) + 1))
+	}
+	return delay
+}
+
+func (endpoint *Endpoint) Addr() string {
+	return endpoint.addr
+}
+
+func (endpoint *Endpoint) Send(addr string, msg *network.Message) {
+	if endpoint.closed {
+		return
+	}
+	// 接收者不会和发送者共享同一块内存
+	payload := make([]byte, len(msg.Payload))
+	copy(payload, msg.Payload)
+	endpoint.simnet.transmit(endpoint.addr, addr, &network.Message{Path: msg.Path, Payload: payload})
+}
+
+func (endpoint *Endpoint) Broadcast(addrs []string, msg *network.Message) {
+	for _, addr := range addrs {
+		endpoint.Send(addr, msg)
+	}
+}
+
+// Receive 返回一个永远没有消息的 channel，模拟网络中的消息由 handler 处理
+func (endpoint *Endpoint) Receive() <-chan *network.Message {
+	return nil
+}
+
+// Close 之后不再发送和接收消息，用于模拟节点崩溃
+func (endpoint *Endpoint) Close() error {
+	endpoint.closed = true
+	return nil
+}
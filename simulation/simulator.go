@@ -0,0 +1,458 @@
+package simulation
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"goPBFT/consensus"
+	"goPBFT/kvstore"
+	"goPBFT/linearizability"
+	"goPBFT/network"
+	"goPBFT/trace"
+	"hash"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// TraceDir 是模拟目录中保存节点轨迹的子目录
+const TraceDir = "trace"
+
+// Config 是一次模拟的配置。同样的配置和种子总是得到同样的执行过程，
+// 因此失败的种子可以被完整地重放。
+type Config struct {
+	Seed     int64
+	Nodes    int
+	Clients  int
+	Requests int // 每个客户端依次提交的操作数量
+	Keys     int // 操作使用的 key 的数量，越少冲突越多
+	Faults   Faults
+	Crashes  []Crash
+	// 拜占庭节点以及它们的行为，一致性只在其余的正常节点之间检查
+	Byzantine map[string][]Behavior
+	// 虚拟时间的上限，到达时还有没有完成的操作即为活性失败
+	Timeout time.Duration
+	// 节点配置的模板，其中的节点列表、NodeID、密钥目录和数据目录由模拟器设置，为空时使用默认配置
+	Node *network.Config
+	// 保存密钥和 WAL 的目录，为空时使用临时目录并在结束后删除
+	Dir string
+}
+
+// Crash 在虚拟时间 At 时让节点崩溃，Restart 不为 0 时在该时间从 WAL 中重启
+type Crash struct {
+	NodeID  string
+	At      time.Duration
+	Restart time.Duration
+}
+
+// Result 是一次模拟的结果。Fingerprint 为所有送达的消息和执行的请求的摘要，重放同一个种子时应该完全相同。
+type Result struct {
+	Seed        int64
+	Operations  []*Operation
+	Executed    map[string]int64
+	Elapsed     time.Duration
+	Events      int
+	Fingerprint string
+	// 违反的安全性或活性，为空表示通过
+	Violation error
+}
+
+// Simulator 在一个进程、一个 goroutine 中运行整个集群，所有的事件都由虚拟时钟按顺序执行
+type Simulator struct {
+	config   *Config
+	clock    *VirtualClock
+	random   *rand.Rand
+	network  *Network
+	workload *linearizability.KVWorkload
+	keys     *consensus.KeyRegistry
+	dir      string
+
+	nodeIDs  []string
+	replicas map[string]*replica
+	clients  []*simClient
+
+	// 每个序列号中按顺序执行的请求，由第一个执行到该位置的节点确定，用于检查一致性
+	executed map[int64][]string
+	trace    hash.Hash
+	result   *Result
+}
+
+// replica 是一个节点的当前实例，崩溃之后重启的节点是新的实例
+type replica struct {
+	id       string
+	config   *network.Config
+	node     *network.Node
+	endpoint *Endpoint
+	clock    *nodeClock
+	// 拜占庭节点的传输层，正常节点为空
+	byzantine *Byzantine
+}
+
+// nodeClock 是节点实例使用的时钟，节点崩溃之后它的计时器不再触发
+type nodeClock struct {
+	*VirtualClock
+	stopped bool
+}
+
+func (clock *nodeClock) AfterFunc(d time.Duration, f func()) network.Timer {
+	return clock.VirtualClock.AfterFunc(d, func() {
+		if !clock.stopped {
+			f()
+		}
+	})
+}
+
+// recordingApp 在状态机执行请求时检查各节点在同一个位置执行的请求是否相同
+type recordingApp struct {
+	*kvstore.Store
+	sim       *Simulator
+	replica   *replica
+	positions map[int64]int
+}
+
+func (app *recordingApp) Execute(request *consensus.RequestMsg) string {
+	// 主节点重新提议请求时会修改请求中的序列号，因此以节点正在执行的序列号为准；
+	// 从 WAL 中恢复时节点还没有创建完成，恢复的请求是重新解码的，其中的序列号不会被修改
+	sequenceID := request.SequenceID
+	if node := app.replica.node; node != nil {
+		sequenceID = node.ExecutedSequenceID
+	}
+	position := app.positions[sequenceID]
+	app.positions[sequenceID]++
+	app.sim.checkExecution(app.replica.id, sequenceID, request, position)
+	return app.Store.Execute(request)
+}
+
+// Run 运行一次模拟。返回的错误表示模拟本身无法进行，协议的错误记录在 Result.Violation 中。
+func Run(config *Config) (*Result, error) {
+	sim := &Simulator{
+		config:   config,
+		clock:    NewVirtualClock(),
+		random:   rand.New(rand.NewSource(config.Seed)),
+		replicas: make(map[string]*replica),
+		executed: make(map[int64][]string),
+		trace:    sha256.New(),
+		result:   &Result{Seed: config.Seed, Executed: make(map[string]int64)},
+	}
+	sim.network = newNetwork(sim.clock, sim.random, config.Faults)
+	sim.workload = linearizability.NewKVWorkload(sim.random, config.Keys)
+	sim.network.observe = func(from string, to string, msg *network.Message) {
+		sim.observe(fmt.Sprintf("deliver %s %s %s", from, to, msg.Path))
+	}
+
+	sim.dir = config.Dir
+	if sim.dir == "" {
+		dir, err := os.MkdirTemp("", "pbft-sim")
+		if err != nil {
+			return nil, err
+		}
+		defer os.RemoveAll(dir)
+		sim.dir = dir
+	}
+	if err := sim.setup(); err != nil {
+		return nil, err
+	}
+	defer sim.close()
+
+	sim.run()
+
+	for _, nodeID := range sim.nodeIDs {
+		sim.result.Executed[nodeID] = sim.replicas[nodeID].node.ExecutedSequenceID
+	}
+	sim.result.Elapsed = sim.clock.Elapsed()
+	sim.result.Fingerprint = hex.EncodeToString(sim.trace.Sum(nil))
+	return sim.result, nil
+}
+
+func (sim *Simulator) setup() error {
+	config := sim.config
+	if config.Nodes < 1 {
+		return errors.New("the simulation needs at least one node")
+	}
+	for i := 0; i < config.Nodes; i++ {
+		sim.nodeIDs = append(sim.nodeIDs, fmt.Sprintf("Node%d", i))
+	}
+	clientIDs := make([]string, config.Clients)
+	for i := range clientIDs {
+		clientIDs[i] = fmt.Sprintf("Client%d", i)
+	}
+
+	// 密钥同样由种子决定，消息的内容在重放时完全相同
+	keyDir := filepath.Join(sim.dir, network.KeyDir)
+	keyRandom := rand.New(rand.NewSource(config.Seed))
+	if err := network.GenerateKeysFrom(keyDir, sim.nodeIDs, keyRandom); err != nil {
+		return err
+	}
+	if err := network.GenerateClientKeysFrom(keyDir, clientIDs, keyRandom); err != nil {
+		return err
+	}
+
+	for _, nodeID := range sim.nodeIDs {
+		nodeConfig := network.DefaultConfig()
+		if config.Node != nil {
+			copied := *config.Node
+			nodeConfig = &copied
+		}
+		nodeConfig.NodeID = nodeID
+		nodeConfig.ListenAddr = ""
+		nodeConfig.Nodes = make(map[string]*network.NodeConfig)
+		for _, id := range sim.nodeIDs {
+			nodeConfig.Nodes[id] = &network.NodeConfig{Addr: sim.addr(id)}
+		}
+		nodeConfig.KeyDir = keyDir
+		nodeConfig.DataDir = filepath.Join(sim.dir, nodeID)
+		nodeConfig.TraceDir = filepath.Join(sim.dir, TraceDir)
+		if err := nodeConfig.Validate(); err != nil {
+			return err
+		}
+
+		r := &replica{id: nodeID, config: nodeConfig}
+		sim.replicas[nodeID] = r
+		if err := sim.start(r); err != nil {
+			return err
+		}
+	}
+
+	keys, err := sim.replicas[sim.nodeIDs[0]].config.LoadPublicKeys()
+	if err != nil {
+		return err
+	}
+	sim.keys = keys
+
+	for _, clientID := range clientIDs {
+		privateKey, err := network.LoadClientKey(keyDir, clientID)
+		if err != nil {
+			return err
+		}
+		client := &simClient{sim: sim, id: clientID, privateKey: privateKey, remaining: config.Requests}
+		client.endpoint = sim.network.listen(clientID, client.receive)
+		sim.clients = append(sim.clients, client)
+		sim.clock.AfterFunc(0, client.submit)
+	}
+
+	for nodeID := range config.Byzantine {
+		if _, ok := sim.replicas[nodeID]; !ok {
+			return errors.New("unknown byzantine node " + nodeID)
+		}
+	}
+
+	for _, crash := range config.Crashes {
+		crash := crash
+		r, ok := sim.replicas[crash.NodeID]
+		if !ok {
+			return errors.New("unknown node " + crash.NodeID)
+		}
+		sim.clock.AfterFunc(crash.At, func() {
+			sim.observe("crash " + crash.NodeID)
+			sim.stop(r)
+		})
+		if crash.Restart > crash.At {
+			sim.clock.AfterFunc(crash.Restart, func() {
+				sim.observe("restart " + crash.NodeID)
+				if err := sim.start(r); err != nil {
+					sim.fail(err)
+				}
+			})
+		}
+	}
+	return nil
+}
+
+// start 创建节点的新实例，重启的节点从 WAL 中恢复
+func (sim *Simulator) start(r *replica) error {
+	clock := &nodeClock{VirtualClock: sim.clock}
+	app := &recordingApp{Store: kvstore.NewStore(), sim: sim, replica: r, positions: make(map[int64]int)}
+	r.node = nil
+
+	var node *network.Node
+	endpoint := sim.network.listen(sim.addr(r.id), func(msg *network.Message) {
+		decoded, err := network.DecodeMessage(msg)
+		if err != nil {
+			return
+		}
+		if _, ok := decoded.(*consensus.ReplyMsg); ok {
+			return
+		}
+		if r.byzantine != nil {
+			r.byzantine.received(decoded)
+		}
+		node.Step(decoded)
+	})
+	var transport network.Transport = endpoint
+	r.byzantine = nil
+	if behaviors, ok := sim.config.Byzantine[r.id]; ok {
+		r.byzantine = newByzantine(sim, r, endpoint, behaviors)
+		transport = r.byzantine
+	}
+	node, err := network.CreateNode(r.config, app, transport, clock)
+	if err != nil {
+		return err
+	}
+	r.node, r.endpoint, r.clock = node, endpoint, clock
+
+	// 代替 alarmToDispatcher 定时处理 buffer 中的请求
+	var resolve func()
+	resolve = func() {
+		node.Resolve()
+		clock.AfterFunc(network.ResolvingTimeDuration, resolve)
+	}
+	clock.AfterFunc(network.ResolvingTimeDuration, resolve)
+	return nil
+}
+
+// stop 让节点崩溃：不再收发消息，计时器不再触发，WAL 中已经写入的内容保留
+func (sim *Simulator) stop(r *replica) {
+	if r.clock.stopped {
+		return
+	}
+	r.clock.stopped = true
+	r.endpoint.Close()
+	r.node.WAL.Close()
+	r.node.Trace.Close()
+}
+
+func (sim *Simulator) close() {
+	for _, r := range sim.replicas {
+		sim.stop(r)
+	}
+}
+
+func (sim *Simulator) run() {
+	for sim.result.Violation == nil && !sim.finished() {
+		if next, ok := sim.clock.Next(); !ok || next.Sub(Epoch) > sim.config.Timeout {
+			sim.fail(fmt.Errorf("liveness: %d of %d operations completed in %v", sim.completed(), sim.config.Clients*sim.config.Requests, sim.config.Timeout))
+			return
+		}
+		sim.clock.Step()
+		sim.result.Events++
+	}
+	if sim.result.Violation == nil {
+		sim.checkStates()
+	}
+	if sim.result.Violation == nil {
+		sim.checkTraces()
+	}
+	if sim.result.Violation == nil {
+		sim.checkLinearizability()
+	}
+}
+
+func (sim *Simulator) finished() bool {
+	return sim.completed() == sim.config.Clients*sim.config.Requests
+}
+
+func (sim *Simulator) completed() int {
+	completed := 0
+	for _, operation := range sim.result.Operations {
+		if operation.Done {
+			completed++
+		}
+	}
+	return completed
+}
+
+// checkExecution 检查节点在 sequenceID 的第 position 个位置执行的请求是否和其他节点相同
+func (sim *Simulator) checkExecution(nodeID string, sequenceID int64, request *consensus.RequestMsg, position int) {
+	key := fmt.Sprintf("%s/%d/%s", request.ClinetID, request.Timestamp, request.Operation)
+	sim.observe(fmt.Sprintf("execute %s %d %d %s", nodeID, sequenceID, position, key))
+	if !sim.honest(nodeID) {
+		return
+	}
+
+	executed := sim.executed[sequenceID]
+	if position < len(executed) {
+		if executed[position] != key {
+			sim.fail(fmt.Errorf("agreement: %s executed %s at sequence %d position %d, another node executed %s", nodeID, key, sequenceID, position, executed[position]))
+		}
+		return
+	}
+	if position == len(executed) {
+		sim.executed[sequenceID] = append(executed, key)
+	}
+}
+
+// checkStates 检查执行到同一个序列号的节点的状态是否相同
+func (sim *Simulator) checkStates() {
+	digests := make(map[int64]string)
+	owners := make(map[int64]string)
+	for _, nodeID := range sim.nodeIDs {
+		r := sim.replicas[nodeID]
+		if r.clock.stopped || !sim.honest(nodeID) {
+			continue
+		}
+		sequenceID := r.node.ExecutedSequenceID
+		digest := r.node.App.StateDigest()
+		if other, ok := digests[sequenceID]; ok && other != digest {
+			sim.fail(fmt.Errorf("agreement: %s and %s have different states at sequence %d", owners[sequenceID], nodeID, sequenceID))
+			return
+		}
+		digests[sequenceID] = digest
+		owners[sequenceID] = nodeID
+	}
+}
+
+// checkTraces 用 trace.Check 检查所有正常节点记录的轨迹
+func (sim *Simulator) checkTraces() {
+	events, err := trace.LoadDir(filepath.Join(sim.dir, TraceDir))
+	if err != nil {
+		sim.fail(err)
+		return
+	}
+	ignore := make([]string, 0, len(sim.config.Byzantine))
+	for nodeID := range sim.config.Byzantine {
+		ignore = append(ignore, nodeID)
+	}
+	if errs := trace.Check(events, ignore...); len(errs) != 0 {
+		sim.fail(fmt.Errorf("trace: %v (%d violations in total)", errs[0], len(errs)))
+	}
+}
+
+// checkLinearizability 检查客户端收到的结果是否可以线性化
+func (sim *Simulator) checkLinearizability() {
+	history := make([]*linearizability.Operation, 0, len(sim.result.Operations))
+	for _, operation := range sim.result.Operations {
+		history = append(history, &linearizability.Operation{
+			ClientID: operation.ClientID,
+			Input:    operation.Operation,
+			Output:   operation.Result,
+			Call:     Epoch.Add(operation.Invoke),
+			Return:   Epoch.Add(operation.Complete),
+			Done:     operation.Done,
+		})
+	}
+	if err := linearizability.Check(linearizability.KVModel{}, history, 0).Err(); err != nil {
+		sim.fail(fmt.Errorf("linearizability: %v", err))
+	}
+}
+
+// honest 判断节点是否为正常节点
+func (sim *Simulator) honest(nodeID string) bool {
+	_, ok := sim.config.Byzantine[nodeID]
+	return !ok
+}
+
+func (sim *Simulator) fail(err error) {
+	if sim.result.Violation == nil {
+		sim.result.Violation = fmt.Errorf("at %v: %v", sim.clock.Elapsed(), err)
+	}
+}
+
+func (sim *Simulator) observe(event string) {
+	fmt.Fprintf(sim.trace, "%d %s\n", sim.clock.Elapsed(), event)
+}
+
+func (sim *Simulator) addr(nodeID string) string {
+	return nodeID
+}
+
+func (sim *Simulator) nodeAddrs() []string {
+	addrs := make([]string, 0, len(sim.nodeIDs))
+	for _, nodeID := range sim.nodeIDs {
+		addrs = append(addrs, sim.addr(nodeID))
+	}
+	sort.Strings(addrs)
+	return addrs
+}
@@ -0,0 +1,129 @@
+package simulation
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+// discardStdout 在测试期间丢弃节点写入标准输出的日志
+func discardStdout(t *testing.T) {
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = devNull
+	t.Cleanup(func() {
+		os.Stdout = stdout
+		devNull.Close()
+	})
+}
+
+func testConfig(seed int64) *Config {
+	return &Config{
+		Seed:     seed,
+		Nodes:    4,
+		Clients:  3,
+		Requests: 20,
+		Keys:     4,
+		Faults: Faults{
+			MinDelay:      time.Millisecond,
+			MaxDelay:      time.Millisecond * 20,
+			DropRate:      0.01,
+			DuplicateRate: 0.01,
+		},
+		Crashes: []Crash{{NodeID: "Node2", At: time.Millisecond * 300, Restart: time.Second * 2}},
+		Timeout: time.Minute * 10,
+	}
+}
+
+func TestDeterministic(t *testing.T) {
+	discardStdout(t)
+
+	results := make([]*Result, 0, 3)
+	for _, seed := range []int64{1, 1, 2} {
+		result, err := Run(testConfig(seed))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Violation != nil {
+			t.Fatalf("seed %d: %v", seed, result.Violation)
+		}
+		results = append(results, result)
+	}
+
+	first, replayed := results[0], results[1]
+	if replayed.Fingerprint != first.Fingerprint {
+		t.Errorf("the fingerprint of seed 1 changes from %s to %s", first.Fingerprint, replayed.Fingerprint)
+	}
+	if replayed.Events != first.Events || replayed.Elapsed != first.Elapsed {
+		t.Errorf("seed 1 runs %d events in %v, then %d events in %v", first.Events, first.Elapsed, replayed.Events, replayed.Elapsed)
+	}
+	for nodeID, executed := range first.Executed {
+		if replayed.Executed[nodeID] != executed {
+			t.Errorf("%s executes up to %d, then %d", nodeID, executed, replayed.Executed[nodeID])
+		}
+	}
+	if results[2].Fingerprint == first.Fingerprint {
+		t.Error("seeds 1 and 2 have the same fingerprint")
+	}
+}
+
+func TestCrashRestart(t *testing.T) {
+	discardStdout(t)
+
+	tests := []struct {
+		name    string
+		crashes []Crash
+	}{
+		{"backup restarts", []Crash{{NodeID: "Node2", At: time.Millisecond * 300, Restart: time.Second * 2}}},
+		// 主节点崩溃之后其他节点切换视图，重启的主节点从 WAL 中恢复之后跟上新的视图
+		{"primary restarts", []Crash{{NodeID: "Node0", At: time.Millisecond * 300, Restart: time.Second * 3}}},
+		// 至多 f 个节点失效时集群仍然可以完成所有的操作
+		{"backup never restarts", []Crash{{NodeID: "Node3", At: time.Millisecond * 300}}},
+		{"two crashes in turn", []Crash{
+			{NodeID: "Node1", At: time.Millisecond * 200, Restart: time.Second},
+			{NodeID: "Node2", At: time.Second * 2, Restart: time.Second * 3},
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for seed := int64(1); seed <= 2; seed++ {
+				config := testConfig(seed)
+				config.Faults.DropRate, config.Faults.DuplicateRate = 0, 0
+				config.Requests = 60 // 运行足够长的时间，重启的节点能够通过之后的检查点追上其他节点
+				config.Crashes = test.crashes
+
+				result, err := Run(config)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if result.Violation != nil {
+					t.Fatalf("seed %d: %v", seed, result.Violation)
+				}
+				if len(result.Operations) != config.Clients*config.Requests {
+					t.Errorf("seed %d: %d operations, want %d", seed, len(result.Operations), config.Clients*config.Requests)
+				}
+
+				// 重启的节点从 WAL 中恢复，并继续执行崩溃期间提交的批次
+				var executed int64
+				for _, sequenceID := range result.Executed {
+					if sequenceID > executed {
+						executed = sequenceID
+					}
+				}
+				for _, crash := range test.crashes {
+					if crash.Restart != 0 && result.Elapsed < crash.Restart {
+						t.Fatalf("seed %d: the run ends at %v before %s restarts", seed, result.Elapsed, crash.NodeID)
+					}
+					if crash.Restart != 0 && result.Executed[crash.NodeID] < executed-1 {
+						t.Errorf("seed %d: %s executes up to %d after restarting, the others up to %d",
+							seed, crash.NodeID, result.Executed[crash.NodeID], executed)
+					}
+				}
+			}
+		})
+	}
+}
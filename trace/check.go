@@ -0,0 +1,163 @@
+package trace
+
+import (
+	"fmt"
+	"goPBFT/consensus"
+	"strings"
+)
+
+// Check 检查轨迹是否满足 PBFT 的不变式，返回发现的所有问题：
+//   - 一致性：所有节点在同一个序列号上提交和执行同一个批次，执行的批次中的请求也相同；
+//   - 执行没有空缺：每个节点按序列号依次执行，只有从检查点恢复时可以跳过；
+//   - 视图单调：每个节点进入的视图不会变小，重启之后也一样；
+//   - 每次提交都有法定人数的证明：投票的节点属于副本集合且数量足够，并且每个投票都确实由本节点收到或者发出。
+//
+// ignore 中的节点（例如拜占庭节点）的事件不参与检查。
+func Check(events []*Event, ignore ...string) []error {
+	ignored := make(map[string]bool)
+	for _, nodeID := range ignore {
+		ignored[nodeID] = true
+	}
+
+	checker := &checker{
+		committed: make(map[int64]*Event),
+		executed:  make(map[int64]*Event),
+	}
+	nodes := make([]string, 0)
+	histories := make(map[string][]*Event)
+	for _, event := range events {
+		if ignored[event.Node] {
+			continue
+		}
+		if _, ok := histories[event.Node]; !ok {
+			nodes = append(nodes, event.Node)
+		}
+		histories[event.Node] = append(histories[event.Node], event)
+	}
+	for _, nodeID := range nodes {
+		checker.checkNode(nodeID, histories[nodeID])
+	}
+	return checker.errs
+}
+
+type checker struct {
+	// 每个序列号上第一个提交和执行的事件，其余节点与之比较
+	committed map[int64]*Event
+	executed  map[int64]*Event
+	errs      []error
+}
+
+func (checker *checker) fail(event *Event, format string, args ...interface{}) {
+	prefix := fmt.Sprintf("%s at %s: ", event.Node, event.Time.Format("15:04:05.000000"))
+	checker.errs = append(checker.errs, fmt.Errorf(prefix+format, args...))
+}
+
+// checkNode 按照写入的顺序检查一个节点的历史
+func (checker *checker) checkNode(nodeID string, history []*Event) {
+	// 节点发出和收到的消息，用于检查提交的证明
+	sent := make(map[string]bool)
+	received := make(map[string]bool)
+	lastExecuted := int64(-1)
+	lastView := int64(-1)
+
+	for _, event := range history {
+		switch event.Type {
+		case EventStart:
+			// 重启之后从 WAL 中的检查点或者头开始重新执行
+			lastExecuted = -1
+		case EventSend:
+			sent[voteKey(event.Path, nodeID, event)] = true
+		case EventReceive:
+			received[voteKey(event.Path, event.Peer, event)] = true
+			received[event.Path+" "+event.Peer] = true
+		case EventView:
+			if event.View < lastView {
+				checker.fail(event, "the view goes back from %d to %d", lastView, event.View)
+			}
+			lastView = event.View
+		case EventRestore:
+			if event.Sequence < lastExecuted {
+				checker.fail(event, "restores the checkpoint %d after executing %d", event.Sequence, lastExecuted)
+			}
+			lastExecuted = event.Sequence
+		case EventCommit:
+			checker.checkAgreement(checker.committed, event, "commits")
+			checker.checkCertificate(event, sent, received)
+		case EventExecute:
+			if event.Sequence != lastExecuted+1 {
+				checker.fail(event, "executes %d after %d", event.Sequence, lastExecuted)
+			}
+			lastExecuted = event.Sequence
+			checker.checkAgreement(checker.executed, event, "executes")
+			if committed, ok := checker.committed[event.Sequence]; ok && committed.Digest != event.Digest {
+				checker.fail(event, "executes %s at %d, but %s committed %s", event.Digest, event.Sequence, committed.Node, committed.Digest)
+			}
+		}
+	}
+}
+
+// checkAgreement 比较同一个序列号上不同节点的批次
+func (checker *checker) checkAgreement(first map[int64]*Event, event *Event, verb string) {
+	other, ok := first[event.Sequence]
+	if !ok {
+		first[event.Sequence] = event
+		return
+	}
+	if other.Digest != event.Digest {
+		checker.fail(event, "%s %s at %d, but %s %s %s", verb, event.Digest, event.Sequence, other.Node, verb, other.Digest)
+		return
+	}
+	if event.Type == EventExecute && strings.Join(other.Requests, ",") != strings.Join(event.Requests, ",") {
+		checker.fail(event, "executes requests %v at %d, but %s executes %v", event.Requests, event.Sequence, other.Node, other.Requests)
+	}
+}
+
+// checkCertificate 检查提交的依据：投票时需要 2f 个 prepare 和 2f+1 个 commit，状态传输需要 f+1 个回复，
+// 投票的节点都属于副本集合，并且每个投票都能在本节点的收发记录中找到
+func (checker *checker) checkCertificate(event *Event, sent map[string]bool, received map[string]bool) {
+	quorum := consensus.NewQuorum(len(event.Replicas))
+	replicas := make(map[string]bool)
+	for _, nodeID := range event.Replicas {
+		replicas[nodeID] = true
+	}
+
+	switch event.Source {
+	case SourceVotes:
+		checker.checkVoters(event, "prepare", event.Prepares, quorum.Prepare(), replicas, func(voter string) bool {
+			return sent[voteKey("/prepare", voter, event)] || received[voteKey("/prepare", voter, event)]
+		})
+		checker.checkVoters(event, "commit", event.Commits, quorum.Commit(), replicas, func(voter string) bool {
+			return sent[voteKey("/commit", voter, event)] || received[voteKey("/commit", voter, event)]
+		})
+	case SourceState:
+		checker.checkVoters(event, "state", event.Commits, quorum.Reply(), replicas, func(voter string) bool {
+			return received["/state "+voter]
+		})
+	default:
+		checker.fail(event, "commits %d without a known source %q", event.Sequence, event.Source)
+	}
+}
+
+func (checker *checker) checkVoters(event *Event, kind string, voters []string, needed int, replicas map[string]bool, seen func(voter string) bool) {
+	distinct := make(map[string]bool)
+	for _, voter := range voters {
+		if distinct[voter] {
+			checker.fail(event, "counts the %s vote of %s twice at %d", kind, voter, event.Sequence)
+		}
+		distinct[voter] = true
+		if !replicas[voter] {
+			checker.fail(event, "counts the %s vote of %s at %d, which is not a replica", kind, voter, event.Sequence)
+		}
+		if !seen(voter) {
+			checker.fail(event, "counts the %s vote of %s at %d that was never sent or received", kind, voter, event.Sequence)
+		}
+	}
+	if len(distinct) < needed {
+		checker.fail(event, "commits %d with %d %s votes, %d are needed", event.Sequence, len(distinct), kind, needed)
+	}
+}
+
+// voteKey 唯一确定 sender 在某个共识实例中对某个摘要的投票
+func voteKey(path string, sender string, event *Event) string {
+	return fmt.Sprintf("%s %s %d %d %s", path, sender, event.View, event.Sequence, event.Digest)
+}
@@ -0,0 +1,272 @@
+package trace
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+var checkNodes = []string{"Node0", "Node1", "Node2", "Node3"}
+
+// vote 返回节点在序列号 sequence 上发送的投票以及收到的其他节点的投票
+func vote(nodeID string, path string, sequence int64, digest string) []*Event {
+	events := []*Event{{Node: nodeID, Type: EventSend, Path: path, Peer: "broadcast", Sequence: sequence, Digest: digest}}
+	for _, peer := range checkNodes {
+		if peer != nodeID {
+			events = append(events, &Event{Node: nodeID, Type: EventReceive, Path: path, Peer: peer, Sequence: sequence, Digest: digest})
+		}
+	}
+	return events
+}
+
+// commit 返回节点在视图 0 中提交并执行序列号 sequence 的事件，prepare 来自前两个其他节点，commit 来自包括自己在内的前三个节点
+func commit(nodeID string, sequence int64, digest string) []*Event {
+	prepares := make([]string, 0, 2)
+	for _, peer := range checkNodes {
+		if peer != nodeID && len(prepares) < 2 {
+			prepares = append(prepares, peer)
+		}
+	}
+	commits := []string{nodeID}
+	for _, peer := range checkNodes {
+		if peer != nodeID && len(commits) < 3 {
+			commits = append(commits, peer)
+		}
+	}
+
+	events := vote(nodeID, "/prepare", sequence, digest)
+	events = append(events, vote(nodeID, "/commit", sequence, digest)...)
+	return append(events,
+		&Event{Node: nodeID, Type: EventCommit, Sequence: sequence, Digest: digest, Replicas: checkNodes, Source: SourceVotes, Prepares: prepares, Commits: commits},
+		&Event{Node: nodeID, Type: EventExecute, Sequence: sequence, Digest: digest, Requests: []string{fmt.Sprintf("Client0/%d", sequence)}},
+	)
+}
+
+// history 返回 4 个节点依次提交并执行序列号 0、1 的轨迹
+func history() []*Event {
+	events := make([]*Event, 0)
+	for _, nodeID := range checkNodes {
+		events = append(events, &Event{Node: nodeID, Type: EventStart}, &Event{Node: nodeID, Type: EventView})
+		for sequence := int64(0); sequence < 2; sequence++ {
+			events = append(events, commit(nodeID, sequence, fmt.Sprintf("digest%d", sequence))...)
+		}
+	}
+	return events
+}
+
+// find 返回节点的第一个满足条件的事件
+func find(events []*Event, nodeID string, eventType string, sequence int64) *Event {
+	for _, event := range events {
+		if event.Node == nodeID && event.Type == eventType && event.Sequence == sequence {
+			return event
+		}
+	}
+	return nil
+}
+
+func without(events []*Event, removed *Event) []*Event {
+	kept := make([]*Event, 0, len(events))
+	for _, event := range events {
+		if event != removed {
+			kept = append(kept, event)
+		}
+	}
+	return kept
+}
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		name   string
+		events func() []*Event
+		ignore []string
+		// 期望的错误中包含的内容，为空时轨迹没有问题
+		want string
+	}{
+		{
+			name:   "honest",
+			events: history,
+		},
+		{
+			name: "commits a different batch",
+			events: func() []*Event {
+				events := history()
+				for _, event := range events {
+					if event.Node == "Node3" && event.Sequence == 1 {
+						event.Digest = "forged"
+					}
+				}
+				return events
+			},
+			want: "commits forged at 1, but Node0 commits digest1",
+		},
+		{
+			name: "executes different requests",
+			events: func() []*Event {
+				events := history()
+				find(events, "Node2", EventExecute, 0).Requests = []string{"Client1/7"}
+				return events
+			},
+			want: "executes requests [Client1/7] at 0",
+		},
+		{
+			name: "executes a batch it did not commit",
+			events: func() []*Event {
+				events := history()
+				find(events, "Node1", EventExecute, 1).Digest = "forged"
+				return events
+			},
+			want: "executes forged at 1, but Node0 committed digest1",
+		},
+		{
+			name: "ignored byzantine node",
+			events: func() []*Event {
+				events := history()
+				find(events, "Node3", EventCommit, 1).Digest = "forged"
+				find(events, "Node3", EventExecute, 1).Digest = "forged"
+				return events
+			},
+			ignore: []string{"Node3"},
+		},
+		{
+			name: "execution gap",
+			events: func() []*Event {
+				events := history()
+				return without(events, find(events, "Node2", EventExecute, 0))
+			},
+			want: "Node2 at 00:00:00.000000: executes 1 after -1",
+		},
+		{
+			name: "restart from a checkpoint",
+			events: func() []*Event {
+				events := history()
+				return append(events,
+					&Event{Node: "Node2", Type: EventStart},
+					&Event{Node: "Node2", Type: EventRestore, Sequence: 0, Digest: "checkpoint"},
+					&Event{Node: "Node2", Type: EventExecute, Sequence: 1, Digest: "digest1", Requests: []string{"Client0/1"}},
+					&Event{Node: "Node2", Type: EventView},
+				)
+			},
+		},
+		{
+			name: "restores an older checkpoint",
+			events: func() []*Event {
+				events := history()
+				return append(events, &Event{Node: "Node2", Type: EventRestore, Sequence: 0, Digest: "checkpoint"})
+			},
+			want: "restores the checkpoint 0 after executing 1",
+		},
+		{
+			name: "view goes back",
+			events: func() []*Event {
+				events := history()
+				return append(events, &Event{Node: "Node1", Type: EventView, View: 2}, &Event{Node: "Node1", Type: EventView, View: 1})
+			},
+			want: "the view goes back from 2 to 1",
+		},
+		{
+			name: "view goes back after a restart",
+			events: func() []*Event {
+				events := history()
+				return append(events,
+					&Event{Node: "Node1", Type: EventView, View: 2},
+					&Event{Node: "Node1", Type: EventStart},
+					&Event{Node: "Node1", Type: EventView, View: 0},
+				)
+			},
+			want: "the view goes back from 2 to 0",
+		},
+		{
+			name: "missing commit vote",
+			events: func() []*Event {
+				events := history()
+				event := find(events, "Node0", EventCommit, 0)
+				event.Commits = event.Commits[:2]
+				return events
+			},
+			want: "commits 0 with 2 commit votes, 3 are needed",
+		},
+		{
+			name: "duplicate prepare vote",
+			events: func() []*Event {
+				events := history()
+				event := find(events, "Node0", EventCommit, 0)
+				event.Prepares = []string{"Node1", "Node1"}
+				return events
+			},
+			want: "counts the prepare vote of Node1 twice at 0",
+		},
+		{
+			name: "vote never received",
+			events: func() []*Event {
+				events := history()
+				for _, event := range events {
+					if event.Node == "Node0" && event.Type == EventReceive && event.Path == "/commit" && event.Peer == "Node2" && event.Sequence == 1 {
+						return without(events, event)
+					}
+				}
+				return events
+			},
+			want: "counts the commit vote of Node2 at 1 that was never sent or received",
+		},
+		{
+			name: "vote of a non-replica",
+			events: func() []*Event {
+				events := history()
+				find(events, "Node0", EventCommit, 0).Replicas = checkNodes[:3]
+				find(events, "Node0", EventCommit, 0).Prepares = []string{"Node1", "Node3"}
+				return events
+			},
+			want: "counts the prepare vote of Node3 at 0, which is not a replica",
+		},
+		{
+			name: "state transfer",
+			events: func() []*Event {
+				events := history()
+				return append(events,
+					&Event{Node: "Node3", Type: EventReceive, Path: "/state", Peer: "Node0"},
+					&Event{Node: "Node3", Type: EventReceive, Path: "/state", Peer: "Node1"},
+					&Event{Node: "Node3", Type: EventCommit, Sequence: 2, Digest: "digest2", Replicas: checkNodes, Source: SourceState, Commits: []string{"Node0", "Node1"}},
+				)
+			},
+		},
+		{
+			name: "state transfer with a single reply",
+			events: func() []*Event {
+				events := history()
+				return append(events,
+					&Event{Node: "Node3", Type: EventReceive, Path: "/state", Peer: "Node0"},
+					&Event{Node: "Node3", Type: EventCommit, Sequence: 2, Digest: "digest2", Replicas: checkNodes, Source: SourceState, Commits: []string{"Node0"}},
+				)
+			},
+			want: "commits 2 with 1 state votes, 2 are needed",
+		},
+		{
+			name: "unknown source",
+			events: func() []*Event {
+				events := history()
+				find(events, "Node0", EventCommit, 0).Source = ""
+				return events
+			},
+			want: `commits 0 without a known source ""`,
+		},
+	}
+
+	for _, test := range tests {
+		errs := Check(test.events(), test.ignore...)
+		if test.want == "" {
+			if len(errs) != 0 {
+				t.Errorf("%s: Check = %v, want no errors", test.name, errs)
+			}
+			continue
+		}
+		found := false
+		for _, err := range errs {
+			if strings.Contains(err.Error(), test.want) {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("%s: Check = %v, want an error containing %q", test.name, errs, test.want)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package trace
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"goPBFT/consensus"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// 事件的类型
+const (
+	// 节点启动，之后是从 WAL 中恢复产生的事件
+	EventStart = "start"
+	// 发送和收到的消息，Peer 分别为接收者的地址和消息中声明的发送者
+	EventSend    = "send"
+	EventReceive = "receive"
+	// 节点进入新视图
+	EventView = "view"
+	// 节点提交一个批次，Source 为提交的依据
+	EventCommit = "commit"
+	// 节点执行一个批次
+	EventExecute = "execute"
+	// 节点从检查点的快照恢复状态，之后从 Sequence+1 开始执行
+	EventRestore = "restore"
+)
+
+// 提交的依据
+const (
+	// 本节点收集到的 prepare 和 commit 投票
+	SourceVotes = "votes"
+	// 状态传输中 f+1 个节点的回复
+	SourceState = "state"
+)
+
+// TraceFileSuffix 是轨迹文件的后缀，每个节点的轨迹保存在 <NodeID>.trace 中
+const TraceFileSuffix = ".trace"
+
+// Event 是节点轨迹中的一个事件，只有与事件类型相关的字段有值
+type Event struct {
+	Time     time.Time `json:"time"`
+	Node     string    `json:"node"`
+	Type     string    `json:"type"`
+	Path     string    `json:"path,omitempty"`
+	Peer     string    `json:"peer,omitempty"`
+	View     int64     `json:"view"`
+	Sequence int64     `json:"sequence"`
+	Digest   string    `json:"digest,omitempty"`
+	// 提交时的副本集合、依据以及投票的节点
+	Replicas []string `json:"replicas,omitempty"`
+	Source   string   `json:"source,omitempty"`
+	Prepares []string `json:"prepares,omitempty"`
+	Commits  []string `json:"commits,omitempty"`
+	// 执行的批次中的请求，格式为 ClientID/Timestamp
+	Requests []string `json:"requests,omitempty"`
+}
+
+// Recorder 将事件逐行写入轨迹文件。节点重启之后继续追加到同一个文件，因此一个文件包含节点的完整历史。
+type Recorder struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// Open 打开 dir 中节点 nodeID 的轨迹文件
+func Open(dir string, nodeID string) (*Recorder, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(filepath.Join(dir, nodeID+TraceFileSuffix), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &Recorder{file: file}, nil
+}
+
+// Record 写入一个事件，写入失败时只输出错误，轨迹不影响节点的运行
+func (recorder *Recorder) Record(event *Event) {
+	line, err := json.Marshal(event)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	if _, err := recorder.file.Write(append(line, '\n')); err != nil {
+		fmt.Println(err)
+	}
+}
+
+func (recorder *Recorder) Close() error {
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	return recorder.file.Close()
+}
+
+// Load 读取轨迹文件，每个文件中的事件保持写入的顺序
+func Load(paths ...string) ([]*Event, error) {
+	events := make([]*Event, 0)
+	for _, path := range paths {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		events, err = readEvents(file, events)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	return events, nil
+}
+
+// LoadDir 读取 dir 中所有节点的轨迹文件
+func LoadDir(dir string) ([]*Event, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+TraceFileSuffix))
+	if err != nil {
+		return nil, err
+	}
+	return Load(paths...)
+}
+
+func readEvents(reader io.Reader, events []*Event) ([]*Event, error) {
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1<<28)
+	for scanner.Scan() {
+		// 节点崩溃时最后一行可能只写入了一部分
+		event := &Event{}
+		if err := json.Unmarshal(scanner.Bytes(), event); err != nil {
+			continue
+		}
+		events = append(events, event)
+	}
+	return events, scanner.Err()
+}
+
+// MessageEvent 根据消息的内容构造收发消息的事件，Path 为消息在传输层中的路径。
+// 不属于共识的信息（例如计时器产生的信息）返回 nil。
+func MessageEvent(eventType string, peer string, msg interface{}) *Event {
+	event := &Event{Type: eventType, Peer: peer}
+	switch msg := msg.(type) {
+	case *consensus.RequestMsg:
+		event.Path = "/req"
+		event.Requests = []string{RequestKey(msg)}
+	case *consensus.PrePrepareMsg:
+		event.Path = "/preprepare"
+		event.View, event.Sequence, event.Digest = msg.ViewID, msg.SequenceID, msg.Digest
+	case *consensus.VoteMsg:
+		event.Path = "/prepare"
+		if msg.MsgType == consensus.CommitMsg {
+			event.Path = "/commit"
+		}
+		event.View, event.Sequence, event.Digest = msg.ViewID, msg.SequenceID, msg.Digest
+	case *consensus.ReplyMsg:
+		event.Path = "/reply"
+		event.View = msg.ViewID
+	case *consensus.ViewChangeMsg:
+		event.Path = "/viewchange"
+		event.View, event.Sequence = msg.NewViewID, msg.StableSequenceID
+	case *consensus.NewViewMsg:
+		event.Path = "/newview"
+		event.View = msg.ViewID
+	case *consensus.CheckpointMsg:
+		event.Path = "/checkpoint"
+		event.Sequence, event.Digest = msg.SequenceID, msg.Digest
+	case *consensus.FetchStateMsg:
+		event.Path = "/fetchstate"
+		event.Sequence = msg.SequenceID
+	case *consensus.StateMsg:
+		event.Path = "/state"
+		event.View = msg.ViewID
+	case *consensus.FetchChunkMsg:
+		event.Path = "/fetchchunk"
+		event.Sequence = msg.SequenceID
+	case *consensus.ChunkMsg:
+		event.Path = "/chunk"
+		event.Sequence = msg.SequenceID
+	default:
+		return nil
+	}
+	return event
+}
+
+// Sender 返回消息中声明的发送者
+func Sender(msg interface{}) string {
+	switch msg := msg.(type) {
+	case *consensus.RequestMsg:
+		return msg.ClinetID
+	case *consensus.PrePrepareMsg:
+		return msg.NodeID
+	case *consensus.VoteMsg:
+		return msg.NodeID
+	case *consensus.ReplyMsg:
+		return msg.NodeID
+	case *consensus.ViewChangeMsg:
+		return msg.NodeID
+	case *consensus.NewViewMsg:
+		return msg.NodeID
+	case *consensus.CheckpointMsg:
+		return msg.NodeID
+	case *consensus.FetchStateMsg:
+		return msg.NodeID
+	case *consensus.StateMsg:
+		return msg.NodeID
+	case *consensus.FetchChunkMsg:
+		return msg.NodeID
+	case *consensus.ChunkMsg:
+		return msg.NodeID
+	}
+	return ""
+}
+
+// RequestKey 唯一确定一个客户端请求
+func RequestKey(request *consensus.RequestMsg) string {
+	return fmt.Sprintf("%s/%d", request.ClinetID, request.Timestamp)
+}